@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+)
+
+const (
+	scheduleTrigger = "schedule"
+	apiTrigger      = "api"
+
+	// maxTrackedRuns is the number of runs kept by a runRegistry. Runs still
+	// going are kept regardless.
+	maxTrackedRuns = 100
+)
+
+// runRegistry keeps track of recent and in-progress backup runs, so they can
+// be inspected and cancelled
+type runRegistry struct {
+	mu   sync.Mutex
+	runs []*trackedRun
+	max  int
+}
+
+type trackedRun struct {
+	run    *report.Run
+	cancel context.CancelFunc
+}
+
+func newRunRegistry(max int) *runRegistry {
+	return &runRegistry{max: max}
+}
+
+// track adds run to the registry, unless it is nil. The returned context is
+// cancelled when the run is cancelled, and the returned func must be called
+// once it is over.
+func (r *runRegistry) track(ctx context.Context, run *report.Run) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	if r == nil {
+		return ctx, cancel
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs = append(r.runs, &trackedRun{run: run, cancel: cancel})
+
+	// Forget the oldest finished runs
+	for i := 0; len(r.runs) > r.max && i < len(r.runs); {
+		if r.runs[i].run.Done() {
+			r.runs = append(r.runs[:i], r.runs[i+1:]...)
+			continue
+		}
+		i++
+	}
+	return ctx, cancel
+}
+
+func (r *runRegistry) get(id string) *trackedRun {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.runs {
+		if t.run.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// list returns snapshots of the runs of job, or of every job if job is empty,
+// newest first
+func (r *runRegistry) list(job string, limit int) []*report.Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	runs := []*report.Run{}
+	for i := len(r.runs) - 1; i >= 0 && (limit <= 0 || len(runs) < limit); i-- {
+		snapshot := r.runs[i].run.Snapshot()
+		if job == "" || snapshot.Job == job {
+			runs = append(runs, snapshot)
+		}
+	}
+	return runs
+}
+
+// api serves endpoints to trigger, inspect and cancel backups:
+//
+//	GET    /api/jobs                  lists the jobs
+//	POST   /api/jobs/{job}/runs       triggers a run, optionally of some databases
+//	GET    /api/runs?job=&limit=      lists recent runs
+//	GET    /api/runs/{id}             returns a run's report
+//	DELETE /api/runs/{id}             cancels a run
+type api struct {
+	// ctx is the parent of the contexts runs triggered through the api use
+	ctx   context.Context
+	token string
+	jobs  []*cronJob
+	runs  *runRegistry
+
+	// inflight counts the runs triggered that haven't returned
+	inflight sync.WaitGroup
+}
+
+type triggerRequest struct {
+	// Databases narrows the run to the databases matching these patterns
+	Databases []string `json:"databases"`
+}
+
+type jobResponse struct {
+	Name                 string `json:"name"`
+	Running              bool   `json:"running"`
+	LastBackupSuccessful bool   `json:"last_backup_successful"`
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	switch {
+	case p == "jobs":
+		a.allow(w, r, http.MethodGet, a.listJobs)
+	case strings.HasPrefix(p, "jobs/") && strings.HasSuffix(p, "/runs"):
+		name := strings.TrimSuffix(strings.TrimPrefix(p, "jobs/"), "/runs")
+		a.allow(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			a.trigger(w, r, name)
+		})
+	case p == "runs":
+		a.allow(w, r, http.MethodGet, a.listRuns)
+	case strings.HasPrefix(p, "runs/"):
+		id := strings.TrimPrefix(p, "runs/")
+		switch r.Method {
+		case http.MethodGet:
+			a.getRun(w, id)
+		case http.MethodDelete:
+			a.cancelRun(w, id)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (a *api) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *api) allow(w http.ResponseWriter, r *http.Request, method string, h http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	h(w, r)
+}
+
+func (a *api) listJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := []jobResponse{}
+	for _, job := range a.jobs {
+		job.mu.Lock()
+		running := job.running
+		job.mu.Unlock()
+		jobs = append(jobs, jobResponse{
+			Name:                 job.name,
+			Running:              running,
+			LastBackupSuccessful: job.lastBackupSuccessful.Load(),
+		})
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// trigger starts a run of a job straight away. Like scheduled runs it waits
+// for, cancels or is skipped in favour of a run in progress, as the job's
+// overlap policy says, and is claimed with the job's lock.
+func (a *api) trigger(w http.ResponseWriter, r *http.Request, name string) {
+	var job *cronJob
+	for _, j := range a.jobs {
+		if j.name == name {
+			job = j
+		}
+	}
+	if job == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown job: %s", name))
+		return
+	}
+
+	var req triggerRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+			return
+		}
+	}
+
+	o := job.once
+	if len(req.Databases) > 0 {
+		if o.Mode == physicalMode {
+			writeError(w, http.StatusBadRequest, "physical backups can't be limited to some databases")
+			return
+		}
+		var err error
+		if o, err = o.narrowed(req.Databases); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if job.overlapPolicy == overlapSkip && job.busy() {
+		writeError(w, http.StatusConflict, "a backup of the job is already running")
+		return
+	}
+
+	run := report.New()
+	run.Job = job.name
+	run.Trigger = apiTrigger
+	ctx, finish := a.runs.track(a.ctx, run)
+	key := job.name + "@" + apiTrigger + "-" + run.ID
+	a.inflight.Add(1)
+	go func() {
+		defer a.inflight.Done()
+		defer finish()
+		ran := job.exclusive(ctx, key, func(runCtx context.Context) {
+			err := o.backupRun(runCtx, run)
+			observeRun(run)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"job": job.name,
+					"run": run.ID,
+				}).Error(err)
+			}
+			if runCtx.Err() == nil {
+				o.notify(runCtx, run)
+			}
+		})
+		if !ran {
+			run.Finish(errors.New("backup skipped, see the logs"))
+		}
+	}()
+
+	log.WithFields(log.Fields{
+		"job":       job.name,
+		"run":       run.ID,
+		"databases": strings.Join(req.Databases, ","),
+	}).Info("Backup triggered")
+	writeJSON(w, http.StatusAccepted, run.Snapshot())
+}
+
+// wait waits for the runs triggered through the api to return
+func (a *api) wait() {
+	a.inflight.Wait()
+}
+
+// narrowed returns a copy of o backing up, and pruning the backups of, only
+// the databases matching dbs. Everything but the Retriever and Selects is
+// shared with o, which holds no state of a single run.
+func (o *once) narrowed(dbs []string) (*once, error) {
+	match, err := db.Matcher(dbs)
+	if err != nil {
+		return nil, err
+	}
+	narrowed := *o
+	narrowed.Retriever = db.FilteredRetriever{
+		R:      o.Retriever,
+		Filter: db.OnlyFilterType,
+		DBs:    dbs,
+	}
+	narrowed.Selects = func(name string) bool {
+		return match(name) && (o.Selects == nil || o.Selects(name))
+	}
+	return &narrowed, nil
+}
+
+func (a *api) listRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit: %s", s))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, a.runs.list(r.URL.Query().Get("job"), limit))
+}
+
+func (a *api) getRun(w http.ResponseWriter, id string) {
+	t := a.runs.get(id)
+	if t == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown run: %s", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, t.run.Snapshot())
+}
+
+func (a *api) cancelRun(w http.ResponseWriter, id string) {
+	t := a.runs.get(id)
+	if t == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown run: %s", id))
+		return
+	}
+	if t.run.Done() {
+		writeError(w, http.StatusConflict, "run has already finished")
+		return
+	}
+	t.cancel()
+	log.WithFields(log.Fields{
+		"job": t.run.Job,
+		"run": id,
+	}).Info("Backup cancelled through the api")
+	writeJSON(w, http.StatusAccepted, t.run.Snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Debug("Failed to write response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
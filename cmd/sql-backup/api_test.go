@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+)
+
+func newTestAPI(t *testing.T, dumper *blockingDumper) (*api, *cronJob) {
+	job := newTestCronJob("api", overlapSkip, dumper)
+	job.once.Retriever = stubRetriever{"users", "billing"}
+	a := &api{
+		ctx:   context.Background(),
+		token: "secret",
+		jobs:  []*cronJob{job},
+		runs:  newRunRegistry(maxTrackedRuns),
+	}
+	return a, job
+}
+
+func apiRequest(t *testing.T, a *api, method, path, body string) (*httptest.ResponseRecorder, *report.Run) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+
+	var run report.Run
+	if rec.Code < http.StatusMultipleChoices {
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &run))
+	}
+	return rec, &run
+}
+
+func TestAPI_Unauthorized(t *testing.T) {
+	a, _ := newTestAPI(t, newBlockingDumper())
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/runs", nil)
+		req.Header.Set("Authorization", header)
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestAPI_TriggerAndInspect(t *testing.T) {
+	dumper := newBlockingDumper()
+	a, job := newTestAPI(t, dumper)
+
+	rec, run := apiRequest(t, a, http.MethodPost, "/api/jobs/api/runs", `{"databases": ["billing"]}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "api", run.Job)
+	assert.Equal(t, apiTrigger, run.Trigger)
+	<-dumper.started
+
+	rec, running := apiRequest(t, a, http.MethodGet, "/api/runs/"+run.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, running.Finished.IsZero())
+	require.Len(t, running.Databases, 1)
+	assert.Equal(t, "billing", running.Databases[0].Name)
+	assert.Equal(t, report.StatusRunning, running.Databases[0].Status)
+
+	close(dumper.release)
+	require.Eventually(t, func() bool {
+		_, r := apiRequest(t, a, http.MethodGet, "/api/runs/"+run.ID, "")
+		return !r.Finished.IsZero()
+	}, time.Second, time.Millisecond)
+
+	_, finished := apiRequest(t, a, http.MethodGet, "/api/runs/"+run.ID, "")
+	assert.Empty(t, finished.Error)
+	assert.Equal(t, report.StatusSucceeded, finished.Databases[0].Status)
+	assert.Contains(t, job.once.Store.(*memStore).objects, "billing.sql")
+	assert.NotContains(t, job.once.Store.(*memStore).objects, "users.sql")
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/runs?job=api", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	a.ServeHTTP(rec, req)
+	var runs []report.Run
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &runs))
+	require.Len(t, runs, 1)
+	assert.Equal(t, run.ID, runs[0].ID)
+}
+
+func TestAPI_Cancel(t *testing.T) {
+	dumper := newBlockingDumper()
+	a, _ := newTestAPI(t, dumper)
+
+	_, run := apiRequest(t, a, http.MethodPost, "/api/jobs/api/runs", "")
+	<-dumper.started
+
+	rec, _ := apiRequest(t, a, http.MethodDelete, "/api/runs/"+run.ID, "")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	require.Eventually(t, func() bool {
+		_, r := apiRequest(t, a, http.MethodGet, "/api/runs/"+run.ID, "")
+		return !r.Finished.IsZero()
+	}, time.Second, time.Millisecond)
+	_, cancelled := apiRequest(t, a, http.MethodGet, "/api/runs/"+run.ID, "")
+	assert.Contains(t, cancelled.Error, "context canceled")
+
+	rec, _ = apiRequest(t, a, http.MethodDelete, "/api/runs/"+run.ID, "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestAPI_Overlap(t *testing.T) {
+	dumper := newBlockingDumper()
+	a, job := newTestAPI(t, dumper)
+
+	// A scheduled run is going, so the api run is skipped as it would be
+	go job.tick(context.Background(), time.Now())
+	<-dumper.started
+	rec, _ := apiRequest(t, a, http.MethodPost, "/api/jobs/api/runs", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	// With the queue policy it runs once the scheduled run is over
+	job.overlapPolicy = overlapQueue
+	rec, run := apiRequest(t, a, http.MethodPost, "/api/jobs/api/runs", "")
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Eventually(t, func() bool { return job.busy() }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), dumper.dumps.Load())
+
+	close(dumper.release)
+	a.wait()
+	// Both runs back up users and billing
+	assert.Equal(t, int32(4), dumper.dumps.Load())
+	_, finished := apiRequest(t, a, http.MethodGet, "/api/runs/"+run.ID, "")
+	assert.Empty(t, finished.Error)
+}
+
+func TestAPI_WaitCancelled(t *testing.T) {
+	dumper := newBlockingDumper()
+	a, _ := newTestAPI(t, dumper)
+	ctx, cancel := context.WithCancel(context.Background())
+	a.ctx = ctx
+
+	_, run := apiRequest(t, a, http.MethodPost, "/api/jobs/api/runs", "")
+	<-dumper.started
+
+	// Shutting down cancels the run, which is waited for
+	cancel()
+	a.wait()
+	_, cancelled := apiRequest(t, a, http.MethodGet, "/api/runs/"+run.ID, "")
+	assert.False(t, cancelled.Finished.IsZero())
+	assert.Contains(t, cancelled.Error, "context canceled")
+}
+
+func TestAPI_Errors(t *testing.T) {
+	a, _ := newTestAPI(t, newBlockingDumper())
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodPost, "/api/jobs/unknown/runs", "", http.StatusNotFound},
+		{http.MethodPost, "/api/jobs/api/runs", "{", http.StatusBadRequest},
+		{http.MethodPost, "/api/jobs/api/runs", `{"databases": ["/(/"]}`, http.StatusBadRequest},
+		{http.MethodGet, "/api/jobs/api/runs", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/runs/unknown", "", http.StatusNotFound},
+		{http.MethodPut, "/api/runs/unknown", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/runs?limit=many", "", http.StatusBadRequest},
+		{http.MethodGet, "/api/unknown", "", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, "%s %s", tc.method, tc.path)
+	}
+}
+
+func TestRunRegistry_Forgets(t *testing.T) {
+	r := newRunRegistry(2)
+	var runs []*report.Run
+	for i := 0; i < 3; i++ {
+		run := report.New()
+		runs = append(runs, run)
+		_, finish := r.track(context.Background(), run)
+		if i > 0 {
+			run.Finish(nil)
+			finish()
+		}
+	}
+	r.track(context.Background(), report.New())
+
+	// The first run is still going, so only finished ones are forgotten
+	assert.NotNil(t, r.get(runs[0].ID))
+	assert.Nil(t, r.get(runs[1].ID))
+	assert.Nil(t, r.get(runs[2].ID))
+	assert.Len(t, r.list("", 0), 2)
+}
+
+func TestOnce_Narrowed(t *testing.T) {
+	o := &once{
+		Retriever: stubRetriever{"users", "billing", "audit"},
+		Selects:   func(name string) bool { return name != "audit" },
+	}
+	narrowed, err := o.narrowed([]string{"billing", "a*"})
+	require.Nil(t, err)
+
+	databases, err := narrowed.Retriever.Retrieve(context.Background())
+	require.Nil(t, err)
+	var names []string
+	for _, d := range databases {
+		names = append(names, d.Name)
+	}
+	assert.Equal(t, []string{"billing", "audit"}, names)
+
+	// Only the backups of the databases asked for are pruned
+	assert.True(t, narrowed.Selects("billing"))
+	assert.False(t, narrowed.Selects("users"))
+	assert.False(t, narrowed.Selects("audit"))
+	assert.True(t, o.Selects("users"))
+
+	_, err = o.narrowed([]string{"~["})
+	assert.Error(t, err)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"github.com/utilitywarehouse/go-operational/op"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+// CheckCmd checks the newest backups in storage are recent enough, for
+// external monitoring
+type CheckCmd struct{}
+
+// Run checks every job, failing if any database's newest backup is older
+// than its max age
+func (cmd *CheckCmd) Run(c *cli.Context) error {
+	jobs, err := jobsFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for _, j := range jobs {
+		if j.MaxAge <= 0 {
+			return errors.Errorf("no max age set for job %s, see --max-age", j.Name)
+		}
+		o, err := checkerFromJob(j)
+		if err != nil {
+			return errors.Wrapf(err, "job %s", j.Name)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		f, err := o.checkFreshness(ctx, j.MaxAge)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "job %s", j.Name)
+		}
+		observeFreshness(j.Name, f)
+
+		for _, name := range f.names() {
+			status := "OK"
+			if f.isStale(name) {
+				status = "STALE"
+				stale = append(stale, j.Name+"/"+name)
+			}
+			fmt.Fprintf(c.App.Writer, "%s\t%s/%s\t%s\n", status, j.Name, name, f.describe(name))
+		}
+	}
+	publishMetrics(c, jobs)
+
+	if len(stale) > 0 {
+		return cli.NewExitError(fmt.Sprintf("stale backups: %s", strings.Join(stale, ",")), 1)
+	}
+	return nil
+}
+
+// checkerFromJob returns just enough of a job to check the freshness of its
+// backups. Storage is enough to tell how recent they are, so neither the
+// databases nor the dump binaries are needed.
+func checkerFromJob(j jobConfig) (*once, error) {
+	o := &once{Job: j.Name, Mode: j.Mode}
+	var err error
+	switch o.Mode {
+	case logicalMode, "":
+		o.Selects, err = selectorFromJob(j)
+		if err != nil {
+			return nil, err
+		}
+		o.BackupFormat = j.BackupFormat
+		switch j.Kind {
+		case dbcli.FullDump, "":
+		case dbcli.SchemaDump, dbcli.DataDump:
+			o.BackupFormat = store.KindFormat(o.BackupFormat, j.Kind)
+		default:
+			return nil, errors.Errorf("unknown backup kind: %s", j.Kind)
+		}
+		o.Retriever = storedRetriever{o: o, names: db.Literals(j.Only)}
+	case physicalMode:
+		o.BaseBackupHost, err = dsnHost(j.DSN)
+		if err != nil {
+			return nil, err
+		}
+		o.Selects = func(name string) bool { return name == o.BaseBackupHost }
+		o.BaseBackupFormat = j.BaseBackup.Format
+	default:
+		return nil, errors.Errorf("unknown backup mode: %s", o.Mode)
+	}
+	if len(j.Destinations) == 0 {
+		return nil, errors.New("no backup destinations")
+	}
+	o.Store = storerFromJob(j)
+	return o, nil
+}
+
+// storedRetriever lists the databases the job has backups of in storage,
+// plus names, the databases it must have backups of
+type storedRetriever struct {
+	o     *once
+	names []string
+}
+
+func (r storedRetriever) Retrieve(ctx context.Context) ([]db.Database, error) {
+	backups, err := r.o.storedBackups(ctx, r.o.backupFormat())
+	if err != nil {
+		return nil, err
+	}
+	names := append([]string{}, r.names...)
+	for _, b := range backups {
+		names = append(names, b.db)
+	}
+	sort.Strings(names)
+
+	var databases []db.Database
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		databases = append(databases, db.Database{Name: name, Size: -1, ConnLimit: -1, AllowConn: true})
+	}
+	return databases, nil
+}
+
+// freshness is what storage says about how recent each database's newest
+// backup is
+type freshness struct {
+	checked time.Time
+	maxAge  time.Duration
+	// last maps databases to the time of their newest backup, or the zero
+	// time if they have none
+	last  map[string]time.Time
+	stale []string
+}
+
+// checkFreshness finds the databases whose newest backup in storage is older
+// than maxAge, or that have none
+func (o *once) checkFreshness(ctx context.Context, maxAge time.Duration) (*freshness, error) {
+	last, err := o.lastBackups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f := &freshness{checked: time.Now(), maxAge: maxAge, last: last}
+	for _, name := range f.names() {
+		if f.checked.Sub(last[name]) > maxAge {
+			f.stale = append(f.stale, name)
+		}
+	}
+	return f, nil
+}
+
+func (f *freshness) names() []string {
+	names := make([]string, 0, len(f.last))
+	for name := range f.last {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *freshness) isStale(name string) bool {
+	for _, s := range f.stale {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *freshness) describe(name string) string {
+	last := f.last[name]
+	if last.IsZero() {
+		return "no backup"
+	}
+	return fmt.Sprintf("last backup %s ago", f.checked.Sub(last).Round(time.Second))
+}
+
+// monitorFreshness checks the freshness of the job's backups every interval
+// until ctx is done
+func (job *cronJob) monitorFreshness(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f, err := job.once.checkFreshness(ctx, job.maxAge)
+		if err != nil {
+			log.WithField("job", job.name).WithError(err).Warn("Failed to check backup freshness")
+		} else {
+			observeFreshness(job.name, f)
+			if len(f.stale) > 0 {
+				log.WithFields(log.Fields{
+					"job":   job.name,
+					"stale": strings.Join(f.stale, ","),
+				}).Warn("Backups are stale")
+			}
+		}
+
+		job.mu.Lock()
+		job.freshness, job.freshnessErr = f, err
+		job.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (job *cronJob) freshnessCheck() func(cr *op.CheckResponse) {
+	return func(cr *op.CheckResponse) {
+		job.mu.Lock()
+		f, err := job.freshness, job.freshnessErr
+		job.mu.Unlock()
+
+		switch {
+		case err != nil:
+			cr.Unhealthy(err.Error(), "Check the backup destinations can be listed", "Backup freshness is unknown")
+		case f == nil:
+			cr.Healthy("Backup freshness not checked yet")
+		case len(f.stale) > 0:
+			var details []string
+			for _, name := range f.stale {
+				details = append(details, fmt.Sprintf("%s: %s", name, f.describe(name)))
+			}
+			cr.Unhealthy(
+				fmt.Sprintf("Backups older than %s: %s", f.maxAge, strings.Join(details, ", ")),
+				"Check backups are running and succeeding",
+				"Databases can't be restored to a recent state",
+			)
+		default:
+			cr.Healthy(fmt.Sprintf("Every backup is newer than %s", f.maxAge))
+		}
+	}
+}
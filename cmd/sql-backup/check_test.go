@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+)
+
+func TestCheckFreshness(t *testing.T) {
+	s := newMemStore()
+	o := &once{
+		Retriever:    stubRetriever{"users", "billing", "audit"},
+		Store:        s,
+		BackupFormat: "%s_2006-01-02.sql",
+	}
+	now := time.Now()
+	for name, modTime := range map[string]time.Time{
+		"users_2024-03-01.sql.gz":   now.Add(-48 * time.Hour),
+		"users_2024-03-02.sql.gz":   now.Add(-time.Hour),
+		"billing_2024-03-01.sql.gz": now.Add(-30 * time.Hour),
+	} {
+		s.objects[name] = []byte("dump")
+		s.modTimes[name] = modTime
+	}
+
+	f, err := o.checkFreshness(context.Background(), 26*time.Hour)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"audit", "billing", "users"}, f.names())
+	assert.Equal(t, []string{"audit", "billing"}, f.stale)
+	assert.True(t, f.isStale("billing"))
+	assert.False(t, f.isStale("users"))
+	assert.Equal(t, "no backup", f.describe("audit"))
+	assert.Equal(t, "last backup 1h0m0s ago", f.describe("users"))
+
+	observeFreshness("freshness", f)
+	assert.Equal(t, float64(2), testutil.ToFloat64(staleDatabases.WithLabelValues("freshness")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(databaseNewestBackup.WithLabelValues("freshness", "audit")))
+	assert.Equal(t, float64(now.Add(-time.Hour).Unix()), testutil.ToFloat64(databaseNewestBackup.WithLabelValues("freshness", "users")))
+}
+
+func TestCheckFreshness_StoredRetriever(t *testing.T) {
+	s := newMemStore()
+	o := &once{
+		Store:        s,
+		BackupFormat: "%s_2006-01-02.sql",
+		Selects:      func(name string) bool { return name != "other" },
+	}
+	now := time.Now()
+	for name, modTime := range map[string]time.Time{
+		"users_2024-03-02.sql.gz":   now.Add(-time.Hour),
+		"billing_2024-03-01.sql.gz": now.Add(-30 * time.Hour),
+		"other_2024-03-01.sql.gz":   now.Add(-30 * time.Hour),
+	} {
+		s.objects[name] = []byte("dump")
+		s.modTimes[name] = modTime
+	}
+	// No server to ask, only storage and the databases named by the job
+	o.Retriever = storedRetriever{o: o, names: []string{"audit", "users"}}
+
+	f, err := o.checkFreshness(context.Background(), 26*time.Hour)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"audit", "billing", "users"}, f.names())
+	assert.Equal(t, []string{"audit", "billing"}, f.stale)
+}
+
+func TestCheckerFromJob(t *testing.T) {
+	dir := t.TempDir()
+	j := jobConfig{
+		Name: "schema",
+		DSN:  "postgres@primary:5432/postgres",
+		// Neither is needed to check storage
+		Dumper:       dumperConfig{Binary: "/missing/pg_dump"},
+		BaseBackup:   baseBackupConfig{Binary: "/missing/pg_basebackup", Format: "%s_basebackup"},
+		Only:         []string{"users", "audit"},
+		Kind:         dbcli.SchemaDump,
+		BackupFormat: "%s.sql",
+		Destinations: []destinationConfig{{Dir: dir}},
+	}
+	_, err := onceFromJob(j)
+	require.Error(t, err)
+
+	o, err := checkerFromJob(j)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "users.schema.sql.gz"), []byte("dump"), 0644))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "users.sql.gz"), []byte("dump"), 0644))
+	f, err := o.checkFreshness(context.Background(), time.Hour)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"audit", "users"}, f.names())
+	assert.Equal(t, []string{"audit"}, f.stale)
+
+	j.Mode = physicalMode
+	o, err = checkerFromJob(j)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "primary_basebackup"), []byte("base"), 0644))
+	f, err = o.checkFreshness(context.Background(), time.Hour)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"primary"}, f.names())
+	assert.Empty(t, f.stale)
+}
+
+func TestMonitorFreshness(t *testing.T) {
+	job := newTestCronJob("monitored", overlapSkip, newBlockingDumper())
+	job.maxAge = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		job.monitorFreshness(ctx, time.Hour)
+	}()
+
+	waitFor(t, job, func() bool { return job.freshness != nil })
+	cancel()
+	<-done
+	assert.Nil(t, job.freshnessErr)
+	assert.Equal(t, []string{"users"}, job.freshness.stale)
+}
@@ -1,59 +1,413 @@
 package main
 
 import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
 	"github.com/urfave/cli"
 	"github.com/utilitywarehouse/sql-backup/internal/db"
 	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/lock"
+	"github.com/utilitywarehouse/sql-backup/internal/notify"
 	"github.com/utilitywarehouse/sql-backup/internal/pool"
 	"github.com/utilitywarehouse/sql-backup/internal/store"
+	"github.com/utilitywarehouse/sql-backup/internal/subset"
 )
 
 func retrieverFromFlags(c *cli.Context) (db.Retriever, error) {
-	dsn := c.GlobalString("dbcli-dsn")
-	systemRetriever, err := db.NewSystemRetriever(dsn)
+	return retrieverFromJob(jobFromFlags(c))
+}
+
+func retrieverFromJob(j jobConfig) (db.Retriever, error) {
+	systemRetriever, err := db.NewSystemRetriever(j.DSN)
 	if err != nil {
 		return db.SystemRetriever{}, err
 	}
+	systemRetriever.Timeout = j.DiscoveryTimeout
+	systemRetriever.Engine, systemRetriever.Excluded, err = systemDatabases(j)
+	if err != nil {
+		return nil, err
+	}
 
-	if only := c.GlobalStringSlice("only"); len(only) > 0 {
-		return db.FilteredRetriever{
-			R:      systemRetriever,
+	// Only is applied first and exclude second, so a database matched by
+	// both is excluded
+	var r db.Retriever = systemRetriever
+	if len(j.Only) > 0 {
+		if err := db.ValidatePatterns(j.Only); err != nil {
+			return nil, err
+		}
+		r = db.FilteredRetriever{
+			R:      r,
 			Filter: db.OnlyFilterType,
-			DBs:    only,
-		}, nil
+			DBs:    j.Only,
+		}
 	}
-	if exclude := c.GlobalStringSlice("exclude"); len(exclude) > 0 {
-		return db.FilteredRetriever{
-			R:      systemRetriever,
+	if len(j.Exclude) > 0 {
+		if err := db.ValidatePatterns(j.Exclude); err != nil {
+			return nil, err
+		}
+		r = db.FilteredRetriever{
+			R:      r,
 			Filter: db.ExcludeFilterType,
-			DBs:    exclude,
-		}, nil
+			DBs:    j.Exclude,
+		}
+	}
+	if len(j.scope) > 0 {
+		if err := db.ValidatePatterns(j.scope); err != nil {
+			return nil, err
+		}
+		r = db.FilteredRetriever{
+			R:      r,
+			Filter: db.OnlyFilterType,
+			DBs:    j.scope,
+		}
+	}
+	return r, nil
+}
+
+// systemDatabases returns the engine of the job and the databases it never
+// backs up. The system database is among them even if the job lists its own.
+func systemDatabases(j jobConfig) (string, []string, error) {
+	engine := j.Engine
+	if engine == "" {
+		engine = "postgres"
+	}
+	defaults, ok := db.DefaultExcluded[engine]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown engine: %s", engine)
+	}
+	if len(j.SystemDatabases) == 0 {
+		return engine, defaults, nil
 	}
-	return systemRetriever, nil
+	for _, name := range j.SystemDatabases {
+		if name == db.SystemDatabase {
+			return engine, j.SystemDatabases, nil
+		}
+	}
+	return engine, append([]string{db.SystemDatabase}, j.SystemDatabases...), nil
+}
+
+// selectorFromJob returns a func reporting whether the job backs up a
+// database, going by its filters alone. It tells the backups of the job apart
+// from those of other jobs sharing its storage, including databases that have
+// since been dropped.
+func selectorFromJob(j jobConfig) (func(name string) bool, error) {
+	_, system, err := systemDatabases(j)
+	if err != nil {
+		return nil, err
+	}
+	var filters []func(string) bool
+	for _, f := range []struct {
+		patterns []string
+		exclude  bool
+	}{
+		{system, true},
+		{j.Only, false},
+		{j.Exclude, true},
+		{j.scope, false},
+	} {
+		if len(f.patterns) == 0 {
+			continue
+		}
+		match, err := db.Matcher(f.patterns)
+		if err != nil {
+			return nil, err
+		}
+		exclude := f.exclude
+		filters = append(filters, func(name string) bool { return match(name) != exclude })
+	}
+	return func(name string) bool {
+		for _, f := range filters {
+			if !f(name) {
+				return false
+			}
+		}
+		return true
+	}, nil
 }
 
 func dumperFromFlags(c *cli.Context) (dbcli.Dumper, error) {
-	dumper, err := dbcli.NewDumper(c.GlobalString("dbcli-binary"), c.GlobalString("dbcli-flags"), c.GlobalString("dbcli-dsn"))
+	return dumperFromJob(jobFromFlags(c))
+}
+
+func dumperFromJob(j jobConfig) (dbcli.Dumper, error) {
+	if j.Subset.Rules != "" {
+		return subsetDumperFromJob(j)
+	}
+	dumper, err := dbcli.NewDumper(j.Dumper.Binary, j.Dumper.Flags, j.DSN)
 	if err != nil {
 		return nil, err
 	}
-	if duration := c.GlobalDuration("dbcli-timeout"); duration.Seconds() != 0 {
+	if duration := j.Dumper.Timeout; duration.Seconds() != 0 {
 		dumper.Timeout = duration
 	}
+	dumper.Priority, err = priorityFromJob(j)
+	if err != nil {
+		return nil, err
+	}
+	dumper.Kind = j.Kind
 	return dumper, nil
 }
 
-func poolFromFlags(c *cli.Context) pool.Pooler {
-	return pool.SizablePool{Size: c.GlobalInt("pool")}
+func subsetDumperFromJob(j jobConfig) (dbcli.Dumper, error) {
+	rules, err := subset.LoadFile(j.Subset.Rules)
+	if err != nil {
+		return nil, err
+	}
+	dumper, err := dbcli.NewSubsetDumper(j.Dumper.Binary, j.DSN, rules)
+	if err != nil {
+		return nil, err
+	}
+	dumper.Timeout = j.Dumper.Timeout
+	dumper.Priority, err = priorityFromJob(j)
+	if err != nil {
+		return nil, err
+	}
+	dumper.Kind = j.Kind
+	return dumper, nil
+}
+
+func splitterFromJob(j jobConfig) (dbcli.Splitter, error) {
+	splitter, err := dbcli.NewSplitDumper(j.Dumper.Binary, j.DSN)
+	if err != nil {
+		return nil, err
+	}
+	splitter.Timeout = j.Dumper.Timeout
+	splitter.Priority, err = priorityFromJob(j)
+	if err != nil {
+		return nil, err
+	}
+	splitter.Kind = j.Kind
+	if j.Split.GroupSize != "" {
+		splitter.GroupSize, err = parseByteSize(j.Split.GroupSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return splitter, nil
+}
+
+func baseBackuperFromFlags(c *cli.Context) (dbcli.BaseBackuper, error) {
+	return baseBackuperFromJob(jobFromFlags(c))
+}
+
+func baseBackuperFromJob(j jobConfig) (dbcli.BaseBackuper, error) {
+	backuper, err := dbcli.NewBaseBackuper(j.BaseBackup.Binary, j.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if duration := j.Dumper.Timeout; duration.Seconds() != 0 {
+		backuper.Timeout = duration
+	}
+	backuper.Priority, err = priorityFromJob(j)
+	if err != nil {
+		return nil, err
+	}
+	return backuper, nil
+}
+
+func priorityFromJob(j jobConfig) (dbcli.Priority, error) {
+	ioClass, err := dbcli.ParseIOClass(j.Dumper.IONiceClass)
+	if err != nil {
+		return dbcli.Priority{}, err
+	}
+	return dbcli.Priority{
+		Nice:    j.Dumper.Nice,
+		IOClass: ioClass,
+		IOLevel: j.Dumper.IONiceLevel,
+	}, nil
+}
+
+// parseRate parses a bytes per second limit such as 10MB/s, where empty
+// means unlimited (zero)
+func parseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	rate, err := parseByteSize(strings.TrimSuffix(s, "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate limit: %s", s)
+	}
+	return rate, nil
+}
+
+func poolFromFlags(c *cli.Context) (pool.Pooler, error) {
+	return poolFromJob(jobFromFlags(c))
+}
+
+func poolFromJob(j jobConfig) (pool.Pooler, error) {
+	strategy, err := pool.ParseStrategy(j.Pool.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	var slotSize int64
+	if j.Pool.SlotSize != "" {
+		slotSize, err = parseByteSize(j.Pool.SlotSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pool.SizablePool{
+		Size:     j.Pool.Size,
+		Strategy: strategy,
+		Priority: j.Pool.Priority,
+		SlotSize: slotSize,
+	}, nil
+}
+
+const (
+	noLock       = "none"
+	postgresLock = "postgres"
+	objectLock   = "object"
+)
+
+// lockerFromJob returns the Locker replicas running the job claim scheduled
+// runs with, or nil if runs aren't locked
+func lockerFromJob(j jobConfig) (lock.Locker, error) {
+	switch j.Lock.Backend {
+	case noLock, "":
+		return nil, nil
+	case postgresLock:
+		l, err := lock.NewPGLocker(j.DSN)
+		if err != nil {
+			return nil, err
+		}
+		l.MinHold = j.Lock.MinHold
+		return l, nil
+	case objectLock:
+		return lock.NewObjectLocker(storerFromJob(j), j.Lock.Prefix)
+	default:
+		return nil, fmt.Errorf("unknown lock backend: %s", j.Lock.Backend)
+	}
+}
+
+const (
+	webhookNotify = "webhook"
+	slackNotify   = "slack"
+	emailNotify   = "email"
+
+	// notifyStatePrefix is where notifiers keep their state in the storage
+	// location
+	notifyStatePrefix = "notifications"
+)
+
+// notifiersFromJob returns a Notifier for each of the job's notification
+// channels
+func notifiersFromJob(j jobConfig) ([]*notify.Notifier, error) {
+	var notifiers []*notify.Notifier
+	for i, n := range j.Notify {
+		var sender notify.Sender
+		switch n.Type {
+		case webhookNotify, slackNotify:
+			if n.URL == "" {
+				return nil, fmt.Errorf("%s notifications need a url", n.Type)
+			}
+			sender = notify.Webhook{URL: n.URL}
+			if n.Type == slackNotify {
+				sender = notify.Slack{URL: n.URL}
+			}
+		case emailNotify:
+			if n.SMTP.Addr == "" || n.SMTP.From == "" || len(n.SMTP.To) == 0 {
+				return nil, fmt.Errorf("email notifications need an smtp addr, from and to")
+			}
+			sender = notify.Email{
+				Addr:     n.SMTP.Addr,
+				Username: n.SMTP.Username,
+				Password: n.SMTP.Password,
+				From:     n.SMTP.From,
+				To:       n.SMTP.To,
+			}
+		default:
+			return nil, fmt.Errorf("unknown notification type: %s", n.Type)
+		}
+
+		notifier, err := notify.New(sender, n.On, n.Template, n.MinInterval)
+		if err != nil {
+			return nil, err
+		}
+		notifier.OnSchemaChange = n.OnSchemaChange
+		// Kept in the storage location so once runs know about earlier ones
+		notifier.State = notify.StoreState{
+			Store:  storerFromJob(j),
+			Prefix: path.Join(notifyStatePrefix, strconv.Itoa(i)),
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
 }
 
 func storerFromFlags(c *cli.Context) store.Storer {
-	switch c.GlobalString("driver") {
+	return storerFromJob(jobFromFlags(c))
+}
+
+// storerFromJob returns a Storer writing to every one of the job's
+// destinations
+func storerFromJob(j jobConfig) store.Storer {
+	if len(j.Destinations) == 1 {
+		return storerFromDestination(j.Destinations[0])
+	}
+	var m store.Multi
+	for _, d := range j.Destinations {
+		m = append(m, storerFromDestination(d))
+	}
+	return m
+}
+
+func storerFromDestination(d destinationConfig) store.Storer {
+	switch d.Driver {
 	case "aws":
-		return store.S3{Bucket: c.GlobalString("bucket"), Dir: c.GlobalString("dir")}
+		return store.S3{Bucket: d.Bucket, Dir: d.Dir}
 	case "gcp":
-		return store.GCS{Bucket: c.GlobalString("bucket"), Dir: c.GlobalString("dir")}
+		return store.GCS{Bucket: d.Bucket, Dir: d.Dir}
 	default:
-		return store.File{Dir: c.GlobalString("dir")}
+		return store.File{Dir: d.Dir}
+	}
+}
+
+// dsnHost returns the host of the server a DSN points at
+func dsnHost(dsn string) (string, error) {
+	if !strings.HasPrefix(dsn, "postgresql://") {
+		dsn = "postgresql://" + dsn
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	return u.Hostname(), nil
+}
+
+var byteSizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// parseByteSize parses a human readable size such as 512MB or 50GiB
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	unit, ok := byteSizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
 	}
+	return int64(n * float64(unit)), nil
 }
@@ -38,6 +38,51 @@ func TestRetrieverFromFlags_ValidDsn(t *testing.T) {
 	systemR, ok := r.(db.SystemRetriever)
 	assert.True(t, ok)
 	assert.Equal(t, "postgresql://localhost/dbname", systemR.Dsn)
+	assert.Equal(t, "postgres", systemR.Engine)
+	assert.Contains(t, systemR.Excluded, "system")
+}
+
+func TestRetrieverFromFlags_SystemDatabases(t *testing.T) {
+	set := &flag.FlagSet{}
+	set.String("engine", "cockroach", "")
+	set.Duration("discovery-timeout", time.Minute, "")
+
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	r, err := retrieverFromFlags(c)
+	assert.Nil(t, err)
+
+	systemR, ok := r.(db.SystemRetriever)
+	assert.True(t, ok)
+	assert.Equal(t, "cockroach", systemR.Engine)
+	assert.Equal(t, []string{"system"}, systemR.Excluded)
+	assert.Equal(t, time.Minute, systemR.Timeout)
+
+	excluded := &cli.StringSlice{}
+	assert.NoError(t, excluded.Set("scratch"))
+	set.Var(excluded, "system-databases", "")
+
+	r, err = retrieverFromFlags(c)
+	assert.Nil(t, err)
+
+	systemR, ok = r.(db.SystemRetriever)
+	assert.True(t, ok)
+	// system is excluded whatever the list says
+	assert.Equal(t, []string{"system", "scratch"}, systemR.Excluded)
+
+	_, system, err := systemDatabases(jobConfig{SystemDatabases: []string{"scratch", "system"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"scratch", "system"}, system)
+}
+
+func TestRetrieverFromFlags_UnknownEngine(t *testing.T) {
+	set := &flag.FlagSet{}
+	set.String("engine", "oracle", "")
+
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	_, err := retrieverFromFlags(c)
+	assert.Error(t, err)
 }
 
 func TestRetrieverFromFlags_Only(t *testing.T) {
@@ -85,6 +130,60 @@ func TestRetrieverFromFlags_Exclude(t *testing.T) {
 	assert.Equal(t, expected, excludeRetriever.DBs)
 }
 
+func TestRetrieverFromFlags_OnlyAndExclude(t *testing.T) {
+	set := &flag.FlagSet{}
+	only := &cli.StringSlice{}
+	assert.NoError(t, only.Set("tenant_*"))
+	set.Var(only, "only", "")
+	exclude := &cli.StringSlice{}
+	assert.NoError(t, exclude.Set("*_tmp"))
+	set.Var(exclude, "exclude", "")
+
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	r, err := retrieverFromFlags(c)
+	assert.Nil(t, err)
+
+	excludeRetriever, ok := r.(db.FilteredRetriever)
+	assert.True(t, ok)
+	assert.Equal(t, db.ExcludeFilterType, excludeRetriever.Filter)
+	assert.Equal(t, []string{"*_tmp"}, excludeRetriever.DBs)
+
+	onlyRetriever, ok := excludeRetriever.R.(db.FilteredRetriever)
+	assert.True(t, ok)
+	assert.Equal(t, db.OnlyFilterType, onlyRetriever.Filter)
+	assert.Equal(t, []string{"tenant_*"}, onlyRetriever.DBs)
+}
+
+func TestRetrieverFromJob_Scope(t *testing.T) {
+	r, err := retrieverFromJob(jobConfig{
+		Exclude: []string{"*_tmp"},
+		scope:   []string{"billing"},
+	})
+	assert.Nil(t, err)
+
+	scopeRetriever, ok := r.(db.FilteredRetriever)
+	assert.True(t, ok)
+	assert.Equal(t, db.OnlyFilterType, scopeRetriever.Filter)
+	assert.Equal(t, []string{"billing"}, scopeRetriever.DBs)
+
+	excludeRetriever, ok := scopeRetriever.R.(db.FilteredRetriever)
+	assert.True(t, ok)
+	assert.Equal(t, db.ExcludeFilterType, excludeRetriever.Filter)
+}
+
+func TestRetrieverFromFlags_InvalidPattern(t *testing.T) {
+	set := &flag.FlagSet{}
+	exclude := &cli.StringSlice{}
+	assert.NoError(t, exclude.Set("/tenant_(/"))
+	set.Var(exclude, "exclude", "")
+
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	_, err := retrieverFromFlags(c)
+	assert.Error(t, err)
+}
+
 func TestDumperFromFlags_InvalidBinaryPath(t *testing.T) {
 	set := &flag.FlagSet{}
 	set.String("dbcli-binary", "invalid-dbcli", "")
@@ -141,6 +240,68 @@ func TestDumperFromFlags_Timeout(t *testing.T) {
 	assert.Equal(t, expected, cliDumper.Timeout)
 }
 
+func TestBaseBackuperFromFlags_Timeout(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestBaseBackuperFromFlags_Timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	expected := 2 * time.Hour
+
+	set := &flag.FlagSet{}
+	set.String("basebackup-binary", f.Name(), "")
+	set.String("dbcli-dsn", "user:pw@localhost:5432", "")
+	set.Duration("dbcli-timeout", expected, "")
+
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	b, err := baseBackuperFromFlags(c)
+	assert.Nil(t, err)
+	assert.IsType(t, dbcli.CliBaseBackuper{}, b)
+
+	cliBackuper, ok := b.(dbcli.CliBaseBackuper)
+	assert.True(t, ok)
+	assert.Equal(t, f.Name(), cliBackuper.Cmd)
+	assert.Equal(t, "user:pw@localhost:5432", cliBackuper.DSN)
+	assert.Equal(t, expected, cliBackuper.Timeout)
+}
+
+func TestDumperFromFlags_Priority(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestDumperFromFlags_Priority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	set := &flag.FlagSet{}
+	set.String("dbcli-binary", f.Name(), "")
+	set.Int("dbcli-nice", 10, "")
+	set.String("dbcli-ionice-class", "idle", "")
+
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	d, err := dumperFromFlags(c)
+	assert.Nil(t, err)
+
+	cliDumper, ok := d.(dbcli.CliDumper)
+	assert.True(t, ok)
+	assert.Equal(t, dbcli.Priority{Nice: 10, IOClass: dbcli.IOClassIdle}, cliDumper.Priority)
+}
+
+func TestParseRate(t *testing.T) {
+	r, err := parseRate("10MB/s")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10*1000*1000), r)
+
+	r, err = parseRate("")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), r)
+
+	_, err = parseRate("fast")
+	assert.Error(t, err)
+}
+
 func TestPoolFromFlags_PoolSize(t *testing.T) {
 	expected := 10
 
@@ -149,7 +310,8 @@ func TestPoolFromFlags_PoolSize(t *testing.T) {
 
 	c := cli.NewContext(&cli.App{}, set, nil)
 
-	p := poolFromFlags(c)
+	p, err := poolFromFlags(c)
+	assert.Nil(t, err)
 	assert.IsType(t, pool.SizablePool{}, p)
 
 	sizablePool, ok := p.(pool.SizablePool)
@@ -157,6 +319,58 @@ func TestPoolFromFlags_PoolSize(t *testing.T) {
 	assert.Equal(t, expected, sizablePool.Size)
 }
 
+func TestPoolFromFlags_Scheduling(t *testing.T) {
+	set := &flag.FlagSet{}
+	set.String("pool-strategy", "largest-first", "")
+	set.String("pool-slot-size", "50GiB", "")
+	priority := &cli.StringSlice{}
+	assert.NoError(t, priority.Set("billing"))
+	set.Var(priority, "pool-priority", "")
+
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	p, err := poolFromFlags(c)
+	assert.Nil(t, err)
+
+	sizablePool, ok := p.(pool.SizablePool)
+	assert.True(t, ok)
+	assert.Equal(t, pool.LargestFirst, sizablePool.Strategy)
+	assert.Equal(t, []string{"billing"}, sizablePool.Priority)
+	assert.Equal(t, int64(50<<30), sizablePool.SlotSize)
+}
+
+func TestPoolFromFlags_InvalidStrategy(t *testing.T) {
+	set := &flag.FlagSet{}
+	set.String("pool-strategy", "random", "")
+
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	_, err := poolFromFlags(c)
+	assert.Error(t, err)
+}
+
+func TestParseByteSize(t *testing.T) {
+	inputs := []struct {
+		in       string
+		expected int64
+	}{
+		{"1024", 1024},
+		{"10MB", 10 * 1000 * 1000},
+		{"1.5 GiB", 3 << 29},
+		{"2tb", 2 * 1000 * 1000 * 1000 * 1000},
+	}
+	for _, input := range inputs {
+		size, err := parseByteSize(input.in)
+		assert.Nil(t, err)
+		assert.Equal(t, input.expected, size)
+	}
+
+	_, err := parseByteSize("10 parsecs")
+	assert.Error(t, err)
+	_, err = parseByteSize("GB")
+	assert.Error(t, err)
+}
+
 func TestStorerFromFlags_DefaultFile(t *testing.T) {
 	expected := "/some/dir"
 
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultJobName = "default"
+
+// jobConfig describes a single backup job: what to backup, how, where to and
+// when. Jobs in a --config file default to the values of the global flags.
+type jobConfig struct {
+	Name     string `yaml:"name"`
+	Schedule string `yaml:"schedule"`
+	// Schedules override Schedule for some of the job's databases
+	Schedules     []scheduleConfig `yaml:"schedules"`
+	Retries       int              `yaml:"retries"`
+	RetryBackoff  time.Duration    `yaml:"retry_backoff"`
+	OverlapPolicy string           `yaml:"overlap_policy"`
+	MisfirePolicy string           `yaml:"misfire_policy"`
+	Lock          lockConfig       `yaml:"lock"`
+
+	Mode             string        `yaml:"mode"`
+	Kind             string        `yaml:"kind"`
+	DSN              string        `yaml:"dsn"`
+	Engine           string        `yaml:"engine"`
+	SystemDatabases  []string      `yaml:"system_databases"`
+	DiscoveryTimeout time.Duration `yaml:"discovery_timeout"`
+	Only             []string      `yaml:"only"`
+	Exclude          []string      `yaml:"exclude"`
+	StrictOnly       bool          `yaml:"strict_only"`
+
+	Dumper     dumperConfig     `yaml:"dumper"`
+	BaseBackup baseBackupConfig `yaml:"basebackup"`
+	Pool       poolConfig       `yaml:"pool"`
+	Throttle   throttleConfig   `yaml:"throttle"`
+
+	BackupFormat string `yaml:"backup_format"`
+	// SkipUnchangedSchema skips uploading schema backups identical to the
+	// newest one in storage
+	SkipUnchangedSchema bool                `yaml:"skip_unchanged_schema"`
+	Compression         string              `yaml:"compression"`
+	Destinations        []destinationConfig `yaml:"destinations"`
+	// Retention is how long backups are kept for. Zero keeps them forever.
+	Retention time.Duration `yaml:"retention"`
+	// MaxAge is how old the newest backup of a database may be before it's
+	// reported as stale
+	MaxAge time.Duration `yaml:"max_age"`
+	// DiffSchema compares the schema of each database backed up with its
+	// previous backup after every run
+	DiffSchema bool `yaml:"diff_schema"`
+
+	Notify []notifyConfig `yaml:"notify"`
+	Mask   maskConfig     `yaml:"mask"`
+	Subset subsetConfig   `yaml:"subset"`
+	Split  splitConfig    `yaml:"split"`
+
+	// scope narrows the databases backed up to those matching it, after Only
+	// and Exclude are applied. Set for the entries of schedule overrides.
+	scope []string
+}
+
+// scheduleConfig backs up the databases matching a set of patterns on a
+// schedule of their own
+type scheduleConfig struct {
+	// Name defaults to the patterns. Overrides without patterns back up all
+	// of the job's databases, alongside its own schedule, and must be named.
+	Name      string   `yaml:"name"`
+	Databases []string `yaml:"databases"`
+	Schedule  string   `yaml:"schedule"`
+	// Kind defaults to the job's. Overrides of another kind back up their
+	// databases as well as the job's own schedule, rather than instead.
+	Kind string `yaml:"kind"`
+	// Throttle limits and the priority of dump processes replace the job's
+	// where set, so daytime runs can be gentler than nightly ones
+	Throttle    throttleConfig `yaml:"throttle"`
+	Nice        int            `yaml:"nice"`
+	IONiceClass string         `yaml:"ionice_class"`
+	IONiceLevel int            `yaml:"ionice_level"`
+}
+
+type dumperConfig struct {
+	Binary      string        `yaml:"binary"`
+	Flags       string        `yaml:"flags"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Nice        int           `yaml:"nice"`
+	IONiceClass string        `yaml:"ionice_class"`
+	IONiceLevel int           `yaml:"ionice_level"`
+}
+
+type baseBackupConfig struct {
+	Binary string `yaml:"binary"`
+	Format string `yaml:"format"`
+	TmpDir string `yaml:"tmp_dir"`
+	// WALMethod is one of stream or fetch
+	WALMethod string `yaml:"wal_method"`
+}
+
+type poolConfig struct {
+	Size     int      `yaml:"size"`
+	Strategy string   `yaml:"strategy"`
+	Priority []string `yaml:"priority"`
+	SlotSize string   `yaml:"slot_size"`
+}
+
+type lockConfig struct {
+	Backend string        `yaml:"backend"`
+	Prefix  string        `yaml:"prefix"`
+	MinHold time.Duration `yaml:"min_hold"`
+}
+
+// notifyConfig describes a channel notified about finished runs
+type notifyConfig struct {
+	// Type is one of webhook, slack or email
+	Type        string        `yaml:"type"`
+	URL         string        `yaml:"url"`
+	On          string        `yaml:"on"`
+	Template    string        `yaml:"template"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	SMTP        smtpConfig    `yaml:"smtp"`
+	// OnSchemaChange also notifies about runs that found schema changes,
+	// whatever On is
+	OnSchemaChange bool `yaml:"on_schema_change"`
+}
+
+type smtpConfig struct {
+	Addr     string   `yaml:"addr"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// maskConfig describes the masked variant of logical backups
+type maskConfig struct {
+	// Rules is the path to the masking rules. Nothing is masked without it.
+	Rules string `yaml:"rules"`
+	// Mode is one of alongside or instead
+	Mode         string `yaml:"mode"`
+	BackupFormat string `yaml:"backup_format"`
+}
+
+// subsetConfig describes the subset of rows logical backups have
+type subsetConfig struct {
+	// Rules is the path to the subset rules. Every row is dumped without it.
+	Rules string `yaml:"rules"`
+}
+
+// splitConfig describes splitting logical backups into a part per table, or
+// group of small tables
+type splitConfig struct {
+	Tables bool `yaml:"tables"`
+	// GroupSize is the size small tables are grouped up to, eg. 1GB. Every
+	// table gets a part of its own without it.
+	GroupSize string `yaml:"group_size"`
+	// Parallel is how many parts of a database are dumped at once,
+	// defaultSplitParallel if not set
+	Parallel int `yaml:"parallel"`
+}
+
+const defaultSplitParallel = 4
+
+type throttleConfig struct {
+	Dump     string `yaml:"dump"`
+	DBDump   string `yaml:"db_dump"`
+	Upload   string `yaml:"upload"`
+	DBUpload string `yaml:"db_upload"`
+}
+
+// or returns t with the limits it doesn't set taken from fallback
+func (t throttleConfig) or(fallback throttleConfig) throttleConfig {
+	for _, l := range []struct{ v, fallback *string }{
+		{&t.Dump, &fallback.Dump},
+		{&t.DBDump, &fallback.DBDump},
+		{&t.Upload, &fallback.Upload},
+		{&t.DBUpload, &fallback.DBUpload},
+	} {
+		if *l.v == "" {
+			*l.v = *l.fallback
+		}
+	}
+	return t
+}
+
+type destinationConfig struct {
+	Driver string `yaml:"driver"`
+	Bucket string `yaml:"bucket"`
+	Dir    string `yaml:"dir"`
+}
+
+// String returns a URL-like name for the destination, eg. s3://bucket/dir
+func (d destinationConfig) String() string {
+	switch d.Driver {
+	case "aws":
+		return "s3://" + path.Join(d.Bucket, d.Dir)
+	case "gcp":
+		return "gs://" + path.Join(d.Bucket, d.Dir)
+	default:
+		return d.Dir
+	}
+}
+
+const (
+	gzipCompression = "gzip"
+	noCompression   = "none"
+)
+
+const (
+	walStream = "stream"
+	walFetch  = "fetch"
+)
+
+const (
+	maskAlongside = "alongside"
+	maskInstead   = "instead"
+)
+
+// jobFromFlags returns the job described by the command line flags
+func jobFromFlags(c *cli.Context) jobConfig {
+	j := jobConfig{
+		Name:          defaultJobName,
+		Schedule:      c.String("schedule"),
+		Schedules:     parseScheduleOverrides(c.String("schedule-overrides")),
+		Retries:       c.Int("retries"),
+		RetryBackoff:  c.Duration("retry-backoff"),
+		OverlapPolicy: c.String("overlap-policy"),
+		MisfirePolicy: c.String("misfire-policy"),
+		Lock: lockConfig{
+			Backend: c.String("lock"),
+			Prefix:  c.String("lock-prefix"),
+			MinHold: c.Duration("lock-min-hold"),
+		},
+		Mode:             c.GlobalString("backup-mode"),
+		Kind:             c.GlobalString("backup-kind"),
+		DSN:              c.GlobalString("dbcli-dsn"),
+		Engine:           c.GlobalString("engine"),
+		SystemDatabases:  c.GlobalStringSlice("system-databases"),
+		DiscoveryTimeout: c.GlobalDuration("discovery-timeout"),
+		Only:             c.GlobalStringSlice("only"),
+		Exclude:          c.GlobalStringSlice("exclude"),
+		StrictOnly:       c.GlobalBool("strict-only"),
+		Dumper: dumperConfig{
+			Binary:      c.GlobalString("dbcli-binary"),
+			Flags:       c.GlobalString("dbcli-flags"),
+			Timeout:     c.GlobalDuration("dbcli-timeout"),
+			Nice:        c.GlobalInt("dbcli-nice"),
+			IONiceClass: c.GlobalString("dbcli-ionice-class"),
+			IONiceLevel: c.GlobalInt("dbcli-ionice-level"),
+		},
+		BaseBackup: baseBackupConfig{
+			Binary:    c.GlobalString("basebackup-binary"),
+			Format:    c.GlobalString("basebackup-format"),
+			TmpDir:    c.GlobalString("basebackup-tmp-dir"),
+			WALMethod: c.GlobalString("basebackup-wal-method"),
+		},
+		Pool: poolConfig{
+			Size:     c.GlobalInt("pool"),
+			Strategy: c.GlobalString("pool-strategy"),
+			Priority: c.GlobalStringSlice("pool-priority"),
+			SlotSize: c.GlobalString("pool-slot-size"),
+		},
+		Throttle: throttleConfig{
+			Dump:     c.GlobalString("dump-rate-limit"),
+			DBDump:   c.GlobalString("db-dump-rate-limit"),
+			Upload:   c.GlobalString("upload-rate-limit"),
+			DBUpload: c.GlobalString("db-upload-rate-limit"),
+		},
+		BackupFormat:        c.GlobalString("backup-format"),
+		SkipUnchangedSchema: c.GlobalBool("skip-unchanged-schema"),
+		Compression:         gzipCompression,
+		Destinations: []destinationConfig{{
+			Driver: c.GlobalString("driver"),
+			Bucket: c.GlobalString("bucket"),
+			Dir:    c.GlobalString("dir"),
+		}},
+		Retention:  c.GlobalDuration("retention"),
+		MaxAge:     c.GlobalDuration("max-age"),
+		DiffSchema: c.GlobalBool("diff-schema"),
+		Notify:     notifyFromFlags(c),
+		Mask: maskConfig{
+			Rules:        c.GlobalString("mask-rules"),
+			Mode:         c.GlobalString("mask-mode"),
+			BackupFormat: c.GlobalString("masked-backup-format"),
+		},
+		Subset: subsetConfig{Rules: c.GlobalString("subset-rules")},
+		Split: splitConfig{
+			Tables:    c.GlobalBool("split-tables"),
+			GroupSize: c.GlobalString("split-group-size"),
+			Parallel:  c.GlobalInt("split-parallel"),
+		},
+	}
+	if c.GlobalBool("disable-compression") {
+		j.Compression = noCompression
+	}
+	return j
+}
+
+// notifyFromFlags returns a channel for each of the notification flags set,
+// all sharing the same trigger, template and rate limit
+func notifyFromFlags(c *cli.Context) []notifyConfig {
+	base := notifyConfig{
+		On:             c.GlobalString("notify-on"),
+		OnSchemaChange: c.GlobalBool("notify-on-schema-change"),
+		Template:       c.GlobalString("notify-template"),
+		MinInterval:    c.GlobalDuration("notify-min-interval"),
+	}
+	var channels []notifyConfig
+	if url := c.GlobalString("notify-webhook-url"); url != "" {
+		n := base
+		n.Type, n.URL = webhookNotify, url
+		channels = append(channels, n)
+	}
+	if url := c.GlobalString("notify-slack-url"); url != "" {
+		n := base
+		n.Type, n.URL = slackNotify, url
+		channels = append(channels, n)
+	}
+	if addr := c.GlobalString("notify-smtp-addr"); addr != "" {
+		n := base
+		n.Type = emailNotify
+		n.SMTP = smtpConfig{
+			Addr:     addr,
+			Username: c.GlobalString("notify-smtp-username"),
+			Password: c.GlobalString("notify-smtp-password"),
+			From:     c.GlobalString("notify-email-from"),
+			To:       c.GlobalStringSlice("notify-email-to"),
+		}
+		channels = append(channels, n)
+	}
+	return channels
+}
+
+// jobsFromFlags returns the jobs in the --config file if one was given, or
+// else the single job described by the command line flags.
+func jobsFromFlags(c *cli.Context) ([]jobConfig, error) {
+	defaults := jobFromFlags(c)
+	path := c.GlobalString("config")
+	if path == "" {
+		return []jobConfig{defaults}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open config")
+	}
+	defer f.Close()
+
+	return parseConfig(f, defaults)
+}
+
+// parseConfig decodes the jobs in a config file, starting each from defaults
+func parseConfig(r io.Reader, defaults jobConfig) ([]jobConfig, error) {
+	var raw struct {
+		Jobs []yaml.Node `yaml:"jobs"`
+	}
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&raw); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+	if len(raw.Jobs) == 0 {
+		return nil, errors.New("config contains no jobs")
+	}
+
+	seen := map[string]bool{}
+	jobs := make([]jobConfig, 0, len(raw.Jobs))
+	for i, node := range raw.Jobs {
+		j := defaults
+		j.Name = ""
+		j.Destinations = nil
+		j.Notify = nil
+		if err := decodeStrict(&node, &j); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse job %d", i)
+		}
+		if j.Name == "" {
+			return nil, fmt.Errorf("job %d has no name", i)
+		}
+		if seen[j.Name] {
+			return nil, fmt.Errorf("duplicate job name: %s", j.Name)
+		}
+		if strings.Contains(j.Name, "/") {
+			return nil, fmt.Errorf("job name %s contains a /", j.Name)
+		}
+		seen[j.Name] = true
+		if len(j.Destinations) == 0 {
+			j.Destinations = defaults.Destinations
+		}
+		if len(j.Notify) == 0 {
+			j.Notify = defaults.Notify
+		}
+		if j.Split.Parallel == 0 {
+			j.Split.Parallel = defaultSplitParallel
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// decodeStrict decodes node into v, failing on fields v doesn't have. Unlike
+// a yaml.Decoder, yaml.Node.Decode can't be made to do this itself.
+func decodeStrict(node *yaml.Node, v interface{}) error {
+	b, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	return dec.Decode(v)
+}
+
+// overlappingPatterns returns a database name both a and b match, or nothing
+// if none is found. Exact names are checked against the other patterns, as are
+// globs with their wildcards filled in. Regular expressions and globs with
+// character classes only match what the other side names.
+func overlappingPatterns(a, b []string) (string, error) {
+	for _, pair := range [][2][]string{{a, b}, {b, a}} {
+		match, err := db.Matcher(pair[1])
+		if err != nil {
+			return "", err
+		}
+		for _, p := range pair[0] {
+			name, ok := patternExample(p)
+			if ok && match(name) {
+				return name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// patternExample returns a database name pattern p matches, if it's easy to
+// tell
+func patternExample(p string) (string, bool) {
+	switch {
+	case len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/"):
+		return "", false
+	case strings.Contains(p, "["):
+		return "", false
+	default:
+		return strings.NewReplacer("*", "", "?", "x").Replace(p), true
+	}
+}
+
+// parseScheduleOverrides parses overrides such as
+// "billing=@hourly;tenant_*,audit=0 0 */6 * * *". Entries are separated by
+// semicolons and list comma-separated patterns before the last =.
+func parseScheduleOverrides(s string) []scheduleConfig {
+	var overrides []scheduleConfig
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		o := scheduleConfig{}
+		if i := strings.LastIndex(entry, "="); i != -1 {
+			o.Schedule = strings.TrimSpace(entry[i+1:])
+			entry = entry[:i]
+		}
+		for _, pattern := range strings.Split(entry, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				o.Databases = append(o.Databases, pattern)
+			}
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides
+}
+
+// expandSchedules splits a job into one job per schedule: one for each of its
+// overrides, covering only the databases the override matches, and one on the
+// job's own schedule covering the rest. Without a schedule of its own, the
+// job's other databases aren't backed up. Overrides without databases cover
+// every database of the job. Overrides of the same kind whose databases
+// overlap are rejected, as far as it can be told without listing databases.
+func expandSchedules(j jobConfig) ([]jobConfig, error) {
+	if len(j.Schedules) == 0 {
+		return []jobConfig{j}, nil
+	}
+
+	var jobs []jobConfig
+	seen := map[string]bool{}
+	rest := j
+	rest.Schedules = nil
+	rest.Exclude = append([]string{}, j.Exclude...)
+	for _, o := range j.Schedules {
+		if len(o.Databases) == 0 && o.Name == "" {
+			return nil, errors.New("schedule override has no databases")
+		}
+		name := o.Name
+		if name == "" {
+			name = strings.Join(o.Databases, ",")
+		}
+		if o.Schedule == "" {
+			return nil, fmt.Errorf("schedule override %s has no schedule", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate schedule override: %s", name)
+		}
+		seen[name] = true
+
+		override := j
+		override.Name = j.Name + "/" + name
+		override.Schedule = o.Schedule
+		override.Schedules = nil
+		override.scope = o.Databases
+		if o.Kind != "" {
+			override.Kind = o.Kind
+		}
+		override.Throttle = o.Throttle.or(j.Throttle)
+		if o.Nice != 0 {
+			override.Dumper.Nice = o.Nice
+		}
+		if o.IONiceClass != "" {
+			override.Dumper.IONiceClass = o.IONiceClass
+			override.Dumper.IONiceLevel = o.IONiceLevel
+		}
+		for _, other := range jobs {
+			if other.Kind != override.Kind || len(other.scope) == 0 || len(override.scope) == 0 {
+				continue
+			}
+			overlap, err := overlappingPatterns(other.scope, override.scope)
+			if err != nil {
+				return nil, err
+			}
+			if overlap != "" {
+				return nil, fmt.Errorf("schedule overrides %s and %s both match %s", other.Name, override.Name, overlap)
+			}
+		}
+		jobs = append(jobs, override)
+
+		if override.Kind == j.Kind && len(o.Databases) > 0 {
+			rest.Exclude = append(rest.Exclude, o.Databases...)
+		}
+	}
+	if j.Schedule != "" {
+		jobs = append([]jobConfig{rest}, jobs...)
+	}
+	diffSchemaKind(jobs)
+	return jobs, nil
+}
+
+// diffSchemaKind leaves schema diffs to those of jobs that back up schemas,
+// if any do, so a job can take full backups next to diffed schema snapshots
+func diffSchemaKind(jobs []jobConfig) {
+	schemas := false
+	for _, j := range jobs {
+		schemas = schemas || j.Kind == dbcli.SchemaDump
+	}
+	if !schemas {
+		return
+	}
+	for i := range jobs {
+		if jobs[i].Kind != dbcli.SchemaDump {
+			jobs[i].DiffSchema = false
+		}
+	}
+}
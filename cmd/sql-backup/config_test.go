@@ -0,0 +1,367 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/notify"
+)
+
+func TestParseConfig(t *testing.T) {
+	defaults := jobConfig{
+		Name:         defaultJobName,
+		Schedule:     "0 0 * * * *",
+		DSN:          "postgres@localhost:5432/postgres",
+		Pool:         poolConfig{Size: 5},
+		BackupFormat: "%s.sql",
+		Compression:  gzipCompression,
+		Destinations: []destinationConfig{{Driver: "file", Dir: "/backups"}},
+	}
+
+	config := `
+jobs:
+  - name: primary
+    dsn: postgres@primary:5432/postgres
+    only: [users, billing]
+    retention: 168h
+    dumper:
+      timeout: 30m
+    destinations:
+      - driver: aws
+        bucket: backups
+      - driver: gcp
+        bucket: backups-dr
+  - name: analytics
+    schedule: "0 0 3 * * *"
+    compression: none
+    pool:
+      size: 1
+`
+	jobs, err := parseConfig(strings.NewReader(config), defaults)
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+
+	primary := jobs[0]
+	assert.Equal(t, "primary", primary.Name)
+	assert.Equal(t, "postgres@primary:5432/postgres", primary.DSN)
+	assert.Equal(t, []string{"users", "billing"}, primary.Only)
+	assert.Equal(t, 168*time.Hour, primary.Retention)
+	assert.Equal(t, 30*time.Minute, primary.Dumper.Timeout)
+	assert.Equal(t, "0 0 * * * *", primary.Schedule)
+	assert.Equal(t, 5, primary.Pool.Size)
+	assert.Equal(t, []destinationConfig{
+		{Driver: "aws", Bucket: "backups"},
+		{Driver: "gcp", Bucket: "backups-dr"},
+	}, primary.Destinations)
+
+	analytics := jobs[1]
+	assert.Equal(t, "analytics", analytics.Name)
+	assert.Equal(t, defaults.DSN, analytics.DSN)
+	assert.Equal(t, "0 0 3 * * *", analytics.Schedule)
+	assert.Equal(t, noCompression, analytics.Compression)
+	assert.Equal(t, 1, analytics.Pool.Size)
+	assert.Equal(t, defaults.Destinations, analytics.Destinations)
+}
+
+func TestParseConfig_Invalid(t *testing.T) {
+	for config, expected := range map[string]string{
+		"jobs: []":                                       "config contains no jobs",
+		"jobs:\n  - dsn: postgres@db/postgres":           "job 0 has no name",
+		"jobs:\n  - name: a\n  - name: a":                "duplicate job name: a",
+		"jobs:\n  - name: a\n    unknown: true":          "field unknown not found",
+		"jobs:\n  - name: a\nschedule: '* * * * * *'":    "field schedule not found",
+		"jobs:\n  - name: a\n    retention: a long time": "failed to parse job 0",
+	} {
+		_, err := parseConfig(strings.NewReader(config), jobConfig{})
+		if assert.Error(t, err, config) {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+}
+
+func TestOnceFromJob_Destinations(t *testing.T) {
+	j := jobConfig{
+		Name:         "primary",
+		Mode:         physicalMode,
+		DSN:          "postgres@primary:5432/postgres",
+		BaseBackup:   baseBackupConfig{Binary: "/bin/true"},
+		Compression:  noCompression,
+		Destinations: []destinationConfig{{Dir: "/a"}, {Dir: "/b"}},
+	}
+
+	o, err := onceFromJob(j)
+	require.Nil(t, err)
+	assert.Equal(t, "primary", o.Job)
+	assert.True(t, o.DisableCompression)
+	assert.Len(t, o.Store, 2)
+
+	j.Compression = "zstd"
+	_, err = onceFromJob(j)
+	assert.EqualError(t, err, "unknown compression: zstd")
+
+	j.Compression = ""
+	j.Destinations = nil
+	_, err = onceFromJob(j)
+	assert.EqualError(t, err, "no backup destinations")
+}
+
+func TestParseConfig_Notify(t *testing.T) {
+	defaults := jobConfig{
+		Notify: []notifyConfig{{Type: slackNotify, URL: "https://hooks.slack.com/services/x", On: notify.OnFailure}},
+	}
+
+	config := `
+jobs:
+  - name: primary
+    notify:
+      - type: webhook
+        url: https://alerts.example.com/backups
+        on: always
+        min_interval: 1h
+      - type: email
+        on: recovery
+        template: "{{.Job}} {{.Status}}"
+        smtp:
+          addr: smtp.example.com:587
+          from: backups@example.com
+          to: [dba@example.com]
+  - name: analytics
+`
+	jobs, err := parseConfig(strings.NewReader(config), defaults)
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+
+	assert.Equal(t, []notifyConfig{
+		{Type: webhookNotify, URL: "https://alerts.example.com/backups", On: notify.OnAlways, MinInterval: time.Hour},
+		{Type: emailNotify, On: notify.OnRecovery, Template: "{{.Job}} {{.Status}}", SMTP: smtpConfig{
+			Addr: "smtp.example.com:587",
+			From: "backups@example.com",
+			To:   []string{"dba@example.com"},
+		}},
+	}, jobs[0].Notify)
+	assert.Equal(t, defaults.Notify, jobs[1].Notify)
+
+	notifiers, err := notifiersFromJob(jobs[0])
+	require.Nil(t, err)
+	assert.Len(t, notifiers, 2)
+}
+
+func TestNotifiersFromJob_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		n        notifyConfig
+		expected string
+	}{
+		{notifyConfig{Type: "pager"}, "unknown notification type: pager"},
+		{notifyConfig{Type: slackNotify}, "slack notifications need a url"},
+		{notifyConfig{Type: emailNotify, SMTP: smtpConfig{Addr: "smtp:25"}}, "email notifications need an smtp addr, from and to"},
+		{notifyConfig{Type: webhookNotify, URL: "http://x", On: "sometimes"}, "unknown notification trigger: sometimes"},
+	} {
+		_, err := notifiersFromJob(jobConfig{Notify: []notifyConfig{tc.n}})
+		assert.EqualError(t, err, tc.expected)
+	}
+}
+
+func TestParseScheduleOverrides(t *testing.T) {
+	assert.Nil(t, parseScheduleOverrides(""))
+	assert.Equal(t, []scheduleConfig{
+		{Databases: []string{"billing"}, Schedule: "@hourly"},
+		{Databases: []string{"tenant_*", "/^audit_[0-9]{2}$/"}, Schedule: "0 0,30 * * * *"},
+	}, parseScheduleOverrides("billing=@hourly; tenant_*, /^audit_[0-9]{2}$/ = 0 0,30 * * * *"))
+}
+
+func TestExpandSchedules(t *testing.T) {
+	j := jobConfig{
+		Name:     "primary",
+		Schedule: "@daily",
+		Exclude:  []string{"*_tmp"},
+		Schedules: []scheduleConfig{
+			{Databases: []string{"billing"}, Schedule: "@hourly"},
+			{Name: "tenants", Databases: []string{"tenant_*", "audit"}, Schedule: "@every 6h"},
+		},
+	}
+
+	jobs, err := expandSchedules(j)
+	require.Nil(t, err)
+	require.Len(t, jobs, 3)
+
+	assert.Equal(t, "primary", jobs[0].Name)
+	assert.Equal(t, "@daily", jobs[0].Schedule)
+	assert.Equal(t, []string{"*_tmp", "billing", "tenant_*", "audit"}, jobs[0].Exclude)
+	assert.Nil(t, jobs[0].scope)
+
+	assert.Equal(t, "primary/billing", jobs[1].Name)
+	assert.Equal(t, "@hourly", jobs[1].Schedule)
+	assert.Equal(t, []string{"*_tmp"}, jobs[1].Exclude)
+	assert.Equal(t, []string{"billing"}, jobs[1].scope)
+
+	assert.Equal(t, "primary/tenants", jobs[2].Name)
+	assert.Equal(t, []string{"tenant_*", "audit"}, jobs[2].scope)
+
+	// The job's own exclusions are left alone
+	assert.Equal(t, []string{"*_tmp"}, j.Exclude)
+
+	// Without a schedule of its own only the overrides are run
+	j.Schedule = ""
+	jobs, err = expandSchedules(j)
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, "primary/billing", jobs[0].Name)
+}
+
+func TestExpandSchedules_Kind(t *testing.T) {
+	j := jobConfig{
+		Name:     "primary",
+		Schedule: "@daily",
+		Kind:     "full",
+		Schedules: []scheduleConfig{
+			{Name: "schema", Databases: []string{"*"}, Schedule: "@hourly", Kind: "schema"},
+			{Databases: []string{"billing"}, Schedule: "@every 6h"},
+		},
+	}
+
+	jobs, err := expandSchedules(j)
+	require.Nil(t, err)
+	require.Len(t, jobs, 3)
+
+	// Schema backups are taken as well as the full ones, not instead
+	assert.Equal(t, []string{"billing"}, jobs[0].Exclude)
+	assert.Equal(t, "primary/schema", jobs[1].Name)
+	assert.Equal(t, "schema", jobs[1].Kind)
+	assert.Equal(t, "full", jobs[2].Kind)
+}
+
+func TestOverlappingPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     []string
+		expected string
+	}{
+		{[]string{"billing"}, []string{"users"}, ""},
+		{[]string{"billing"}, []string{"bill*"}, "billing"},
+		{[]string{"tenant_*"}, []string{"tenant_eu_*"}, "tenant_eu_"},
+		{[]string{"tenant_?"}, []string{"/^tenant_[a-z]$/"}, "tenant_x"},
+		{[]string{"tenant_*"}, []string{"audit_*", "users"}, ""},
+	} {
+		overlap, err := overlappingPatterns(tc.a, tc.b)
+		require.Nil(t, err)
+		assert.Equal(t, tc.expected, overlap, "%v %v", tc.a, tc.b)
+	}
+}
+
+func TestExpandSchedules_Throttle(t *testing.T) {
+	j := jobConfig{
+		Name:     "primary",
+		Schedule: "0 0 2 * * *",
+		Exclude:  []string{"*_tmp"},
+		Dumper:   dumperConfig{Nice: 5},
+		Throttle: throttleConfig{Dump: "100MB/s", Upload: "50MB/s"},
+		Schedules: []scheduleConfig{{
+			Name:        "daytime",
+			Schedule:    "0 0 9-17 * * *",
+			Throttle:    throttleConfig{Dump: "10MB/s"},
+			Nice:        19,
+			IONiceClass: "idle",
+		}},
+	}
+
+	jobs, err := expandSchedules(j)
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+
+	// An override without databases covers the whole job, alongside it
+	assert.Equal(t, []string{"*_tmp"}, jobs[0].Exclude)
+	assert.Equal(t, j.Throttle, jobs[0].Throttle)
+	assert.Equal(t, 5, jobs[0].Dumper.Nice)
+
+	assert.Equal(t, "primary/daytime", jobs[1].Name)
+	assert.Nil(t, jobs[1].scope)
+	assert.Equal(t, []string{"*_tmp"}, jobs[1].Exclude)
+	assert.Equal(t, throttleConfig{Dump: "10MB/s", Upload: "50MB/s"}, jobs[1].Throttle)
+	assert.Equal(t, 19, jobs[1].Dumper.Nice)
+	assert.Equal(t, "idle", jobs[1].Dumper.IONiceClass)
+}
+
+func TestExpandSchedules_DiffSchema(t *testing.T) {
+	j := jobConfig{
+		Name:       "primary",
+		Schedule:   "@daily",
+		DiffSchema: true,
+		Schedules:  []scheduleConfig{{Name: "schema", Schedule: "@hourly", Kind: dbcli.SchemaDump}},
+	}
+	jobs, err := expandSchedules(j)
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+	// Only the schema snapshots are diffed
+	assert.False(t, jobs[0].DiffSchema)
+	assert.True(t, jobs[1].DiffSchema)
+
+	// Without any, the full backups are left to be rejected
+	j.Schedules = nil
+	jobs, err = expandSchedules(j)
+	require.Nil(t, err)
+	assert.True(t, jobs[0].DiffSchema)
+
+	j.Dumper = dumperConfig{Binary: "/bin/true"}
+	j.Destinations = []destinationConfig{{Dir: "/a"}}
+	_, err = onceFromJob(j)
+	assert.EqualError(t, err, "schema diffs need schema backups, set the backup kind to schema")
+}
+
+func TestExpandSchedules_Invalid(t *testing.T) {
+	for _, overrides := range [][]scheduleConfig{
+		{{Schedule: "@hourly"}},
+		{{Databases: []string{"billing"}}},
+		{{Databases: []string{"billing"}, Schedule: "@hourly"}, {Databases: []string{"billing"}, Schedule: "@daily"}},
+		// billing is matched by both
+		{{Databases: []string{"billing"}, Schedule: "@hourly"}, {Name: "all", Databases: []string{"*"}, Schedule: "@daily"}},
+		{{Databases: []string{"tenant_*"}, Schedule: "@hourly"}, {Databases: []string{"tenant_eu_*"}, Schedule: "@daily"}},
+		{{Databases: []string{"/^audit_/"}, Schedule: "@hourly"}, {Databases: []string{"audit_2024"}, Schedule: "@daily"}},
+	} {
+		_, err := expandSchedules(jobConfig{Name: "primary", Schedule: "@daily", Schedules: overrides})
+		assert.Error(t, err)
+	}
+}
+
+func TestParseConfig_SplitParallel(t *testing.T) {
+	config := `
+jobs:
+  - name: primary
+    split:
+      tables: true
+  - name: analytics
+    split:
+      tables: true
+      parallel: 2
+`
+	jobs, err := parseConfig(strings.NewReader(config), jobConfig{})
+	require.Nil(t, err)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, defaultSplitParallel, jobs[0].Split.Parallel)
+	assert.Equal(t, 2, jobs[1].Split.Parallel)
+}
+
+func TestOnceFromJob_Split(t *testing.T) {
+	j := jobConfig{
+		Name:         "split",
+		DSN:          "postgres@primary:5432/postgres",
+		Dumper:       dumperConfig{Binary: "/bin/true"},
+		Destinations: []destinationConfig{{Dir: "/a"}},
+		BackupFormat: "%s_2006-01-02_150405.sql",
+		Split:        splitConfig{Tables: true, Parallel: defaultSplitParallel},
+	}
+	o, err := onceFromJob(j)
+	require.Nil(t, err)
+	assert.NotNil(t, o.Splitter)
+
+	j.Engine = "cockroach"
+	_, err = onceFromJob(j)
+	assert.EqualError(t, err, "split backups aren't supported for cockroach")
+
+	j.Engine = ""
+	j.BackupFormat = "%s_2006-01-02.sql"
+	_, err = onceFromJob(j)
+	assert.EqualError(t, err, "split backups need a backup format down to the second, %s_2006-01-02.sql isn't")
+}
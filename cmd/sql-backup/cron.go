@@ -6,79 +6,170 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/robfig/cron"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"github.com/utilitywarehouse/go-operational/op"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+	"github.com/utilitywarehouse/sql-backup/internal/lock"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
 )
 
-var (
-	lastBackupSuccessful = true
-
-	errorsSeen = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "db_backup",
-		Name:      "errors_seen",
-		Help:      "Count of errors seen",
-	})
-	retryAttempted = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "db_backup",
-		Name:      "retries_attempted",
-		Help:      "Count of retries after a failed backup",
-	})
-	backupTimer = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "db_backup",
-		Name:      "backup_timer",
-		Help:      "Time taken to run backup",
-	})
-	databaseBackupFailed = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "db_backup",
-		Name:      "database_backup_failed",
-		Help:      "Count of failed database backups to storage",
-	})
-	databaseBackupSuccessful = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "db_backup",
-		Name:      "database_backup_successful",
-		Help:      "Count of successful database backups to storage",
-	})
+const (
+	// overlapSkip skips a scheduled run while the previous one is running
+	overlapSkip = "skip"
+	// overlapQueue starts a scheduled run once the previous one finishes. At
+	// most one run is queued, later ones are skipped.
+	overlapQueue = "queue"
+	// overlapCancelPrevious cancels the previous run and starts once it has
+	// stopped
+	overlapCancelPrevious = "cancel-previous"
+
+	// misfireSkip waits for the next scheduled run after starting up
+	misfireSkip = "skip"
+	// misfireRunOnce runs immediately on startup if a scheduled run was missed
+	// since the last backup in storage
+	misfireRunOnce = "run-once"
 )
 
-// CronCmd contains the relevant information to schedule a backup
+// CronCmd contains the relevant information to schedule backups
 type CronCmd struct {
-	schedule        string
+	jobs []*cronJob
+	runs *runRegistry
+	// api is set if the api is served
+	api *api
+}
+
+// cronJob is a single backup job run on a schedule. Jobs with schedule
+// overrides are run as one cronJob per schedule.
+type cronJob struct {
+	// job is the name of the configured job, and name that of this schedule
+	// of it
+	job             string
+	name            string
+	schedule        cron.Schedule
 	backoffStrategy backoff.BackOff
 	once            *once
+	overlapPolicy   string
+	misfirePolicy   string
+	// locker, if set, is used to claim each scheduled run so only one
+	// replica runs it
+	locker lock.Locker
+	runs   *runRegistry
+	// maxAge is how old the newest backup of a database may be before it's
+	// stale. Zero disables the freshness monitor.
+	maxAge time.Duration
+
+	lastBackupSuccessful atomic.Bool
+
+	mu sync.Mutex
+	// running is set while a backup runs, which can be cancelled with
+	// cancelRun. done is closed once it has returned.
+	running   bool
+	cancelRun context.CancelFunc
+	done      chan struct{}
+	// waiting is set while a run waits for the previous one to finish
+	waiting bool
+	// freshness is the result of the last freshness check
+	freshness    *freshness
+	freshnessErr error
 }
 
 func (cmd *CronCmd) setup(c *cli.Context) error {
-	if c.String("schedule") == "" {
-		return errors.New("Missing cron schedule")
+	jobs, err := jobsFromFlags(c)
+	if err != nil {
+		return err
 	}
-	cmd.schedule = c.String("schedule")
 
-	if retries := c.Int("retries"); retries > 0 {
-		cmd.backoffStrategy = backoff.WithMaxRetries(backoff.NewConstantBackOff(c.Duration("retry-backoff")), uint64(retries))
-		log.WithFields(log.Fields{
-			"retries": retries,
-			"backoff": c.Duration("retry-backoff"),
+	cmd.runs = newRunRegistry(maxTrackedRuns)
+	for _, j := range jobs {
+		entries, err := expandSchedules(j)
+		if err != nil {
+			return errors.Wrapf(err, "job %s", j.Name)
+		}
+		for _, e := range entries {
+			job, err := newCronJob(j.Name, e)
+			if err != nil {
+				if j.Name != defaultJobName {
+					return errors.Wrapf(err, "job %s", e.Name)
+				}
+				return err
+			}
+			job.runs = cmd.runs
+			cmd.jobs = append(cmd.jobs, job)
+		}
+	}
+	return nil
+}
+
+func newCronJob(name string, j jobConfig) (*cronJob, error) {
+	if j.Schedule == "" {
+		return nil, errors.New("Missing cron schedule")
+	}
+	schedule, err := cron.Parse(j.Schedule)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid cron schedule")
+	}
+	job := &cronJob{job: name, name: j.Name, schedule: schedule, maxAge: j.MaxAge}
+	job.lastBackupSuccessful.Store(true)
+
+	switch job.overlapPolicy = j.OverlapPolicy; job.overlapPolicy {
+	case overlapSkip, overlapQueue, overlapCancelPrevious:
+	case "":
+		job.overlapPolicy = overlapSkip
+	default:
+		return nil, errors.Errorf("unknown overlap policy: %s", j.OverlapPolicy)
+	}
+	switch job.misfirePolicy = j.MisfirePolicy; job.misfirePolicy {
+	case misfireSkip, misfireRunOnce:
+	case "":
+		job.misfirePolicy = misfireSkip
+	default:
+		return nil, errors.Errorf("unknown misfire policy: %s", j.MisfirePolicy)
+	}
+
+	logger := log.WithField("job", j.Name)
+	if j.Retries > 0 {
+		job.backoffStrategy = backoff.WithMaxRetries(backoff.NewConstantBackOff(j.RetryBackoff), uint64(j.Retries))
+		logger.WithFields(log.Fields{
+			"retries": j.Retries,
+			"backoff": j.RetryBackoff,
 		}).Debug("Backup attempts will be retried")
 	} else {
-		cmd.backoffStrategy = &backoff.StopBackOff{}
-		log.Debug("Backup retries disabled")
+		job.backoffStrategy = &backoff.StopBackOff{}
+		logger.Debug("Backup retries disabled")
 	}
 
-	o, err := onceFromFlags(c)
+	job.once, err = onceFromJob(j)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cmd.once = o
+	job.locker, err = lockerFromJob(j)
+	if err != nil {
+		return nil, err
+	}
+	if every, ok := schedule.(cron.ConstantDelaySchedule); ok && job.locker != nil {
+		job.schedule = alignedSchedule{every.Delay}
+	}
+	return job, nil
+}
 
-	return nil
+// alignedSchedule is an @every schedule whose runs fall on multiples of its
+// interval rather than counting from startup, so that replicas run it, and
+// name its locks, at the same times
+type alignedSchedule struct {
+	delay time.Duration
+}
+
+func (s alignedSchedule) Next(t time.Time) time.Time {
+	return t.Truncate(s.delay).Add(s.delay)
 }
 
 // Run executes a Cron job
@@ -87,12 +178,11 @@ func (cmd *CronCmd) Run(c *cli.Context) error {
 		return err
 	}
 
-	log.WithField("schedule", cmd.schedule).Info("Starting backup with schedule")
-	cmd.startOpListener(c)
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	cmd.startOpListener(ctx, c)
+
 	go func() {
 		sCh := make(chan os.Signal, 1)
 		signal.Notify(sCh, os.Interrupt, syscall.SIGTERM)
@@ -102,87 +192,266 @@ func (cmd *CronCmd) Run(c *cli.Context) error {
 		cancel()
 	}()
 
-	errCh := make(chan error)
-	successCh := make(chan struct{})
-	backoffStrategy := backoff.WithContext(cmd.backoffStrategy, ctx)
-
 	cr := cron.New()
-	err := cr.AddFunc(cmd.schedule, func() {
-		log.Debug("Starting backup attempt")
+	for _, job := range cmd.jobs {
+		job := job
+		cr.Schedule(job.schedule, cron.FuncJob(func() {
+			job.tick(ctx, scheduledAt(job.schedule, time.Now()))
+		}))
+		log.WithFields(log.Fields{
+			"job":  job.name,
+			"next": job.schedule.Next(time.Now()),
+		}).Info("Starting backup with schedule")
+	}
+	defer cr.Stop()
+	cr.Start()
+
+	for _, job := range cmd.jobs {
+		if job.maxAge > 0 {
+			go job.monitorFreshness(ctx, c.Duration("freshness-interval"))
+		}
+	}
 
-		backupCb := func() error {
-			timer := prometheus.NewTimer(prometheus.ObserverFunc(backupTimer.Set))
-			defer timer.ObserveDuration()
-			return cmd.once.Backup(ctx)
+	for _, job := range cmd.jobs {
+		if job.misfirePolicy != misfireRunOnce {
+			continue
 		}
-		errCb := func(err error, duration time.Duration) {
-			log.Error(err)
-			errorsSeen.Inc()
-			databaseBackupFailed.Inc()
-			retryAttempted.Inc()
+		go func(job *cronJob) {
+			if at, ok := job.missed(ctx); ok {
+				job.tick(ctx, at)
+			}
+		}(job)
+	}
+
+	<-ctx.Done()
+	if cmd.api != nil {
+		// The runs have been cancelled along with ctx
+		cmd.api.wait()
+	}
+	return ctx.Err()
+}
+
+// tick runs the backup scheduled at a time, applying the overlap policy if the
+// previous one is still running
+func (job *cronJob) tick(ctx context.Context, at time.Time) {
+	job.exclusive(ctx, job.name+"@"+at.UTC().Format("20060102T150405Z"), job.run)
+}
+
+// busy reports whether a run is going or waiting for the previous one
+func (job *cronJob) busy() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.running || job.waiting
+}
+
+// exclusive runs fn, applying the overlap policy if the previous run is still
+// going and claiming key with the locker if there is one. It reports whether
+// fn was run.
+func (job *cronJob) exclusive(ctx context.Context, key string, fn func(context.Context)) bool {
+	logger := log.WithField("job", job.name)
+
+	job.mu.Lock()
+	if job.running || job.waiting {
+		// Only one run waits, anything after it would run straight after it
+		if job.overlapPolicy == overlapSkip || job.waiting {
+			job.mu.Unlock()
+			skippedRuns.WithLabelValues(job.name).Inc()
+			logger.Warn("Skipping backup, the previous one is still running")
+			return false
 		}
 
-		if err := backoff.RetryNotify(backupCb, backoffStrategy, errCb); err != nil {
-			errCh <- errors.Wrapf(err, "backup attempts exhausted")
-			log.Warn("Failed to run backup")
-		} else {
+		job.waiting = true
+		for job.running {
+			if job.overlapPolicy == overlapCancelPrevious {
+				logger.Warn("Cancelling the previous backup, it is still running")
+				job.cancelRun()
+			} else {
+				logger.Info("Queueing backup until the previous one finishes")
+			}
+			done := job.done
+			job.mu.Unlock()
 			select {
-			case successCh <- struct{}{}:
+			case <-done:
 			case <-ctx.Done():
-				return
+				job.mu.Lock()
+				job.waiting = false
+				job.mu.Unlock()
+				return false
 			}
+			job.mu.Lock()
+		}
+		job.waiting = false
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	job.running, job.cancelRun, job.done = true, cancel, done
+	job.mu.Unlock()
+
+	defer func() {
+		cancel()
+		job.mu.Lock()
+		job.running = false
+		close(done)
+		job.mu.Unlock()
+	}()
+
+	if job.locker != nil {
+		release, ok, err := job.locker.TryLock(runCtx, key)
+		switch {
+		case err != nil:
+			// Running it anyway could back it up on every replica at once
+			skippedRuns.WithLabelValues(job.name).Inc()
+			logger.WithField("key", key).WithError(err).Error("Failed to claim backup, skipping it")
+			return false
+		case !ok:
+			lockContended.WithLabelValues(job.name).Inc()
+			logger.WithField("key", key).Info("Backup claimed by another replica")
+			return false
+		default:
+			logger.WithField("key", key).Debug("Claimed backup")
+			defer release()
 		}
+	}
+	fn(runCtx)
+	return true
+}
+
+// scheduledAt returns the time the run of schedule happening now was due,
+// which is the same on every replica. Cron expressions are run on the second
+// they are due, so if there's no run due in the last minute now is rounded to
+// that second.
+func scheduledAt(schedule cron.Schedule, now time.Time) time.Time {
+	at := schedule.Next(now.Add(-time.Minute))
+	if at.After(now) {
+		return now.Truncate(time.Second)
+	}
+	for next := schedule.Next(at); !next.After(now); next = schedule.Next(next) {
+		at = next
+	}
+	return at
+}
 
-		log.WithField("next", cr.Entries()[0].Next).Info("Next scheduled run")
-	})
+// missed reports whether a scheduled run was missed since the last backup of
+// any of the job's databases, and when the first missed run was due
+func (job *cronJob) missed(ctx context.Context) (time.Time, bool) {
+	logger := log.WithField("job", job.name)
+
+	last, err := job.once.lastBackups(ctx)
 	if err != nil {
+		logger.WithError(err).Error("Failed to find the last backups, not checking for missed runs")
+		return time.Time{}, false
+	}
+
+	// The oldest is the one that decides, and because it comes from storage
+	// every replica agrees on it
+	var oldest time.Time
+	var oldestDB string
+	first := true
+	for name, t := range last {
+		if first || t.Before(oldest) {
+			oldest, oldestDB, first = t, name, false
+		}
+	}
+	if first {
+		return time.Time{}, false
+	}
+
+	at := job.schedule.Next(oldest)
+	if !at.Before(time.Now()) {
+		return time.Time{}, false
+	}
+	logger.WithFields(log.Fields{
+		"db":   oldestDB,
+		"last": oldest,
+	}).Info("Scheduled backup was missed, running now")
+	return at, true
+}
+
+// run runs a backup, retrying it as configured
+func (job *cronJob) run(ctx context.Context) {
+	logger := log.WithField("job", job.name)
+	logger.Debug("Starting backup attempt")
+
+	// The report of the last attempt is what notifications are about
+	var run *report.Run
+	backupCb := func() error {
+		run = report.New()
+		run.Job = job.name
+		run.Trigger = scheduleTrigger
+		runCtx, finish := job.runs.track(ctx, run)
+		err := job.once.backupRun(runCtx, run)
+		finish()
+
+		// Retrying won't make a missing database appear
+		var missingErr *db.MissingDatabasesError
+		if errors.As(err, &missingErr) {
+			return backoff.Permanent(err)
+		}
 		return err
 	}
-	defer cr.Stop()
-	cr.Start()
-	log.WithField("next", cr.Entries()[0].Next).Info("Next scheduled run")
-
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case err := <-errCh:
-			lastBackupSuccessful = false
-			errorsSeen.Inc()
-			databaseBackupFailed.Inc()
-			log.Error(err)
-		case <-successCh:
-			lastBackupSuccessful = true
-			databaseBackupSuccessful.Inc()
-			log.Info("Backup successful")
-		}
-	}
-}
-
-func (cmd *CronCmd) startOpListener(c *cli.Context) {
-	http.Handle("/__/", op.NewHandler(
-		op.NewStatus(c.App.Name, c.App.Usage).
-			AddOwner("partner@uw", "#partner-platform").
-			AddOwner("telecom", "#telecom-support").
-			SetRevision(c.App.Version).
-			ReadyAlways().
-			WithInstrumentedChecks().
-			AddMetrics(
-				errorsSeen,
-				retryAttempted,
-				backupTimer,
-				databaseBackupFailed,
-				databaseBackupSuccessful,
-			).
-			AddChecker("db-connection", cmd.dbHealthCheck(c)).
-			AddChecker("last-backup-successful", func(cr *op.CheckResponse) {
-				if !lastBackupSuccessful {
-					cr.Degraded("Last backup attempt failed", "Verify db is running & wait until next schedule backup")
-					return
-				}
-				cr.Healthy("Last backup successful")
-			}),
-	))
+	errCb := func(err error, duration time.Duration) {
+		logger.Error(err)
+		errorsSeen.WithLabelValues(job.name).Inc()
+		retryAttempted.WithLabelValues(job.name).Inc()
+	}
+
+	err := backoff.RetryNotify(backupCb, backoff.WithContext(job.backoffStrategy, ctx), errCb)
+	// Only the last attempt counts, or databases that failed then succeeded
+	// would be counted as both
+	if run != nil {
+		observeRun(run)
+	}
+	if ctx.Err() != nil {
+		logger.Warn("Backup cancelled")
+		return
+	}
+	if run != nil {
+		job.once.notify(ctx, run)
+	}
+	if err != nil {
+		job.lastBackupSuccessful.Store(false)
+		errorsSeen.WithLabelValues(job.name).Inc()
+		logger.Error(errors.Wrapf(err, "backup attempts exhausted"))
+		logger.Warn("Failed to run backup")
+	} else {
+		job.lastBackupSuccessful.Store(true)
+		logger.Info("Backup successful")
+	}
+
+	logger.WithField("next", job.schedule.Next(time.Now())).Info("Next scheduled run")
+}
+
+func (cmd *CronCmd) startOpListener(ctx context.Context, c *cli.Context) {
+	status := op.NewStatus(c.App.Name, c.App.Usage).
+		AddOwner("partner@uw", "#partner-platform").
+		AddOwner("telecom", "#telecom-support").
+		SetRevision(c.App.Version).
+		ReadyAlways().
+		WithInstrumentedChecks().
+		AddMetrics(metrics...)
+	checked := map[string]bool{}
+	for _, job := range cmd.jobs {
+		// Every schedule of a job connects to the same server and storage
+		if !checked[job.job] {
+			checked[job.job] = true
+			status.AddChecker(checkName("db-connection", job.job), job.dbHealthCheck())
+			status.AddChecker(checkName("storage", job.job), job.storageCheck())
+		}
+		// Schedule overrides back up different databases
+		status.AddChecker(checkName("db-privileges", job.name), job.privilegesCheck())
+		status.AddChecker(checkName("last-backup-successful", job.name), job.lastBackupCheck())
+		if job.maxAge > 0 {
+			status.AddChecker(checkName("backup-freshness", job.name), job.freshnessCheck())
+		}
+	}
+	http.Handle("/__/", op.NewHandler(status))
+
+	if token := c.String("api-token"); token != "" {
+		cmd.api = &api{ctx: ctx, token: token, jobs: cmd.jobs, runs: cmd.runs}
+		http.Handle("/api/", cmd.api)
+		log.Info("Backup api enabled")
+	}
 
 	go func() {
 		log.Infof("Operational server started on port %v", c.Int("operational-port"))
@@ -198,13 +467,84 @@ func (cmd *CronCmd) startOpListener(c *cli.Context) {
 	}()
 }
 
-func (cmd *CronCmd) dbHealthCheck(*cli.Context) func(cr *op.CheckResponse) {
+// checkName returns the name of a health check for a job, leaving those of
+// the job configured by flags as they've always been
+func checkName(check string, job string) string {
+	if job == defaultJobName {
+		return check
+	}
+	return check + "-" + job
+}
+
+func (job *cronJob) dbHealthCheck() func(cr *op.CheckResponse) {
 	return func(cr *op.CheckResponse) {
-		if err := cmd.once.Dumper.Validate(); err != nil {
-			cr.Unhealthy(err.Error(), "Check db is running", "Database backups are not running")
+		if err := job.once.Validate(); err != nil {
+			cr.Unhealthy(err.Error(), "Check db is running and the credentials are valid", "Database backups are not running")
 			return
 		}
 
 		cr.Healthy("Connected to db")
 	}
 }
+
+// checkCacheTTL is how long the results of checks that do real work are
+// reused for, so frequent health requests don't load the server or storage
+const checkCacheTTL = time.Minute
+
+// checkTimeout bounds how long such checks may take
+const checkTimeout = 30 * time.Second
+
+// cachedCheck runs check at most once every checkCacheTTL, returning the
+// last result in between
+type cachedCheck struct {
+	check func(ctx context.Context) error
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (c *cachedCheck) run() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < checkCacheTTL {
+		return c.err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	c.err = c.check(ctx)
+	c.checked = time.Now()
+	return c.err
+}
+
+func (job *cronJob) privilegesCheck() func(cr *op.CheckResponse) {
+	cached := &cachedCheck{check: job.once.CheckPrivileges}
+	return func(cr *op.CheckResponse) {
+		if err := cached.run(); err != nil {
+			cr.Unhealthy(err.Error(), "Grant the backup user CONNECT on the databases and SELECT on everything in them", "Database backups will fail")
+			return
+		}
+		cr.Healthy("Can read every database")
+	}
+}
+
+func (job *cronJob) storageCheck() func(cr *op.CheckResponse) {
+	cached := &cachedCheck{check: job.once.CheckStorage}
+	return func(cr *op.CheckResponse) {
+		if err := cached.run(); err != nil {
+			cr.Unhealthy(err.Error(), "Check the backup destinations exist and can be written to and deleted from", "Backups can't be stored")
+			return
+		}
+		cr.Healthy("Wrote and deleted a probe file")
+	}
+}
+
+func (job *cronJob) lastBackupCheck() func(cr *op.CheckResponse) {
+	return func(cr *op.CheckResponse) {
+		if !job.lastBackupSuccessful.Load() {
+			cr.Degraded("Last backup attempt failed", "Verify db is running & wait until next schedule backup")
+			return
+		}
+		cr.Healthy("Last backup successful")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/robfig/cron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/lock"
+	"github.com/utilitywarehouse/sql-backup/internal/pool"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+// blockingDumper blocks every dump until release is closed or the dump is
+// cancelled
+type blockingDumper struct {
+	started chan struct{}
+	release chan struct{}
+	dumps   atomic.Int32
+}
+
+func newBlockingDumper() *blockingDumper {
+	return &blockingDumper{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (d *blockingDumper) Validate() error {
+	return nil
+}
+
+func (d *blockingDumper) Dump(ctx context.Context, db string, w io.Writer) error {
+	d.dumps.Add(1)
+	d.started <- struct{}{}
+	select {
+	case <-d.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newTestCronJob(name, overlapPolicy string, dumper *blockingDumper) *cronJob {
+	job := &cronJob{
+		job:             name,
+		name:            name,
+		schedule:        cron.Every(time.Hour),
+		backoffStrategy: &backoff.StopBackOff{},
+		overlapPolicy:   overlapPolicy,
+		once: &once{
+			Retriever:          stubRetriever{"users"},
+			Dumper:             dumper,
+			Pool:               pool.SizablePool{Size: 1},
+			Store:              newMemStore(),
+			BackupFormat:       "%s.sql",
+			DisableCompression: true,
+		},
+	}
+	job.lastBackupSuccessful.Store(true)
+	return job
+}
+
+// waitFor waits for a tick to reach a state, failing the test if it doesn't
+func waitFor(t *testing.T, job *cronJob, cond func() bool) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		return cond()
+	}, time.Second, time.Millisecond)
+}
+
+func TestCronJobTick_Skip(t *testing.T) {
+	dumper := newBlockingDumper()
+	skipped := testutil.ToFloat64(skippedRuns.WithLabelValues("overlap-skip"))
+	job := newTestCronJob("overlap-skip", overlapSkip, dumper)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		job.tick(ctx, time.Now())
+	}()
+	<-dumper.started
+
+	job.tick(ctx, time.Now())
+	assert.Equal(t, float64(1), testutil.ToFloat64(skippedRuns.WithLabelValues("overlap-skip"))-skipped)
+
+	close(dumper.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), dumper.dumps.Load())
+	assert.True(t, job.lastBackupSuccessful.Load())
+}
+
+func TestCronJobTick_Queue(t *testing.T) {
+	dumper := newBlockingDumper()
+	skipped := testutil.ToFloat64(skippedRuns.WithLabelValues("overlap-queue"))
+	job := newTestCronJob("overlap-queue", overlapQueue, dumper)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		job.tick(ctx, time.Now())
+	}()
+	<-dumper.started
+	go func() {
+		defer wg.Done()
+		job.tick(ctx, time.Now())
+	}()
+	waitFor(t, job, func() bool { return job.waiting })
+
+	// Only one run is queued
+	job.tick(ctx, time.Now())
+	assert.Equal(t, float64(1), testutil.ToFloat64(skippedRuns.WithLabelValues("overlap-queue"))-skipped)
+
+	close(dumper.release)
+	wg.Wait()
+	assert.Equal(t, int32(2), dumper.dumps.Load())
+	assert.True(t, job.lastBackupSuccessful.Load())
+}
+
+func TestCronJobTick_CancelPrevious(t *testing.T) {
+	dumper := newBlockingDumper()
+	skipped := testutil.ToFloat64(skippedRuns.WithLabelValues("overlap-cancel"))
+	job := newTestCronJob("overlap-cancel", overlapCancelPrevious, dumper)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		job.tick(ctx, time.Now())
+	}()
+	<-dumper.started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		job.tick(ctx, time.Now())
+	}()
+	// The first run is cancelled, so the second starts without release
+	<-dumper.started
+	wg.Wait()
+
+	close(dumper.release)
+	<-done
+	assert.Equal(t, int32(2), dumper.dumps.Load())
+	assert.Equal(t, float64(0), testutil.ToFloat64(skippedRuns.WithLabelValues("overlap-cancel"))-skipped)
+	assert.True(t, job.lastBackupSuccessful.Load())
+}
+
+func TestCronJobMissed(t *testing.T) {
+	ctx := context.Background()
+	job := newTestCronJob("misfire", overlapSkip, newBlockingDumper())
+	s := job.once.Store.(*memStore)
+
+	// Never backed up
+	_, ok := job.missed(ctx)
+	assert.True(t, ok)
+
+	s.objects["users.sql"] = []byte("dump")
+	s.modTimes["users.sql"] = time.Now().Add(-30 * time.Minute)
+	_, ok = job.missed(ctx)
+	assert.False(t, ok)
+
+	last := time.Now().Add(-2 * time.Hour)
+	s.modTimes["users.sql"] = last
+	at, ok := job.missed(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, job.schedule.Next(last), at)
+}
+
+func TestScheduledAt(t *testing.T) {
+	hourly, err := cron.Parse("0 0 * * * *")
+	require.Nil(t, err)
+	everySecond, err := cron.Parse("* * * * * *")
+	require.Nil(t, err)
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, at, scheduledAt(hourly, at.Add(15*time.Millisecond)))
+	assert.Equal(t, at, scheduledAt(hourly, at.Add(20*time.Second)))
+	assert.Equal(t, at.Add(20*time.Second), scheduledAt(everySecond, at.Add(20*time.Second+15*time.Millisecond)))
+	// Long overdue
+	assert.Equal(t, at.Add(10*time.Minute), scheduledAt(hourly, at.Add(10*time.Minute+15*time.Millisecond)))
+}
+
+func TestCronJobTick_Locked(t *testing.T) {
+	ctx := context.Background()
+	locks := store.File{Dir: t.TempDir()}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	contended := testutil.ToFloat64(lockContended.WithLabelValues("locked"))
+
+	// Two replicas running the same job
+	var dumpers []*blockingDumper
+	for i := 0; i < 2; i++ {
+		dumper := newBlockingDumper()
+		close(dumper.release)
+		dumpers = append(dumpers, dumper)
+
+		locker, err := lock.NewObjectLocker(locks, "locks")
+		require.Nil(t, err)
+		job := newTestCronJob("locked", overlapSkip, dumper)
+		job.locker = locker
+		job.tick(ctx, at)
+	}
+
+	assert.Equal(t, int32(1), dumpers[0].dumps.Load())
+	assert.Equal(t, int32(0), dumpers[1].dumps.Load())
+	assert.Equal(t, float64(1), testutil.ToFloat64(lockContended.WithLabelValues("locked"))-contended)
+}
+
+type failingLocker struct{}
+
+func (failingLocker) TryLock(ctx context.Context, key string) (func(), bool, error) {
+	return nil, false, errors.New("lock server unreachable")
+}
+
+func TestCronJobTick_LockFailed(t *testing.T) {
+	dumper := newBlockingDumper()
+	close(dumper.release)
+	job := newTestCronJob("lock-failed", overlapSkip, dumper)
+	job.locker = failingLocker{}
+	skipped := testutil.ToFloat64(skippedRuns.WithLabelValues("lock-failed"))
+
+	job.tick(context.Background(), time.Now())
+
+	assert.Equal(t, int32(0), dumper.dumps.Load())
+	assert.Equal(t, float64(1), testutil.ToFloat64(skippedRuns.WithLabelValues("lock-failed"))-skipped)
+}
+
+func TestNewCronJob_AlignedSchedule(t *testing.T) {
+	j := jobConfig{
+		Name:         "aligned",
+		Schedule:     "@every 1h",
+		DSN:          "localhost/postgres",
+		Dumper:       dumperConfig{Binary: "/bin/true"},
+		Destinations: []destinationConfig{{Driver: "file", Dir: t.TempDir()}},
+	}
+	job, err := newCronJob("aligned", j)
+	require.Nil(t, err)
+	assert.IsType(t, cron.ConstantDelaySchedule{}, job.schedule)
+
+	// Replicas started at different times agree on when runs are due
+	j.Lock = lockConfig{Backend: "object"}
+	job, err = newCronJob("aligned", j)
+	require.Nil(t, err)
+	at := time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)
+	assert.Equal(t, at, job.schedule.Next(at.Add(-59*time.Minute)))
+	assert.Equal(t, at, job.schedule.Next(at.Add(-time.Second)))
+	assert.Equal(t, at.Add(time.Hour), job.schedule.Next(at))
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	c := &cachedCheck{check: func(ctx context.Context) error {
+		calls++
+		return errors.New("unreadable")
+	}}
+
+	assert.EqualError(t, c.run(), "unreadable")
+	assert.EqualError(t, c.run(), "unreadable")
+	assert.Equal(t, 1, calls)
+
+	c.checked = time.Now().Add(-checkCacheTTL)
+	assert.Error(t, c.run())
+	assert.Equal(t, 2, calls)
+}
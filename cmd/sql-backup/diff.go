@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+	"github.com/utilitywarehouse/sql-backup/internal/schema"
+)
+
+const (
+	textOutput = "text"
+	jsonOutput = "json"
+)
+
+// DiffCmd compares the schemas of the newest backups in storage, to find DDL
+// run between them
+type DiffCmd struct{}
+
+// Run compares the two newest backups of each database of every job, failing
+// if any schema changed
+func (cmd *DiffCmd) Run(c *cli.Context) error {
+	output := c.String("output")
+	if output != textOutput && output != jsonOutput {
+		return errors.Errorf("unknown output: %s", output)
+	}
+	match := func(string) bool { return true }
+	if c.NArg() > 0 {
+		var err error
+		match, err = db.Matcher(c.Args())
+		if err != nil {
+			return err
+		}
+	}
+
+	jobs, err := jobsFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var drifts []*schemaDrift
+	for _, j := range jobs {
+		onces, err := diffOnces(j)
+		if err != nil {
+			return errors.Wrapf(err, "job %s", j.Name)
+		}
+		for _, o := range onces {
+			d, err := o.schemaDrifts(ctx, match)
+			if err != nil {
+				return errors.Wrapf(err, "job %s", j.Name)
+			}
+			drifts = append(drifts, d...)
+		}
+	}
+
+	var changed []string
+	for _, d := range drifts {
+		if len(d.Changes) > 0 {
+			changed = append(changed, d.Job+"/"+d.Database)
+		}
+	}
+
+	if output == jsonOutput {
+		enc := json.NewEncoder(c.App.Writer)
+		enc.SetIndent("", "  ")
+		if drifts == nil {
+			drifts = []*schemaDrift{}
+		}
+		if err := enc.Encode(drifts); err != nil {
+			return err
+		}
+	} else {
+		for _, d := range drifts {
+			d.print(c)
+		}
+	}
+
+	if len(changed) > 0 {
+		return cli.NewExitError(fmt.Sprintf("schema changes: %s", strings.Join(changed, ",")), 1)
+	}
+	return nil
+}
+
+// diffOnces returns a once for each kind of backup the job takes that has a
+// schema, as schedule overrides may take backups of other kinds
+func diffOnces(j jobConfig) ([]*once, error) {
+	if j.Mode == physicalMode {
+		return nil, errors.New("schema diffs are only supported for logical backups")
+	}
+	entries, err := expandSchedules(j)
+	if err != nil {
+		return nil, err
+	}
+	var onces []*once
+	seen := map[string]bool{}
+	for _, e := range entries {
+		kind := e.Kind
+		if kind == "" {
+			kind = dbcli.FullDump
+		}
+		if kind == dbcli.DataDump || seen[kind] {
+			continue
+		}
+		seen[kind] = true
+		e.Name = j.Name
+		o, err := onceFromJob(e)
+		if err != nil {
+			return nil, err
+		}
+		onces = append(onces, o)
+	}
+	if len(onces) == 0 {
+		return nil, errors.New("data backups have no schema to diff")
+	}
+	return onces, nil
+}
+
+// schemaDrift is what changed in the schema of a database between two of its
+// backups
+type schemaDrift struct {
+	Job      string `json:"job"`
+	Database string `json:"database"`
+	Kind     string `json:"kind,omitempty"`
+	// Before is empty if the database has only been backed up once
+	Before  string          `json:"before,omitempty"`
+	After   string          `json:"after"`
+	Changes []schema.Change `json:"changes"`
+}
+
+func (d *schemaDrift) print(c *cli.Context) {
+	name := d.Job + "/" + d.Database
+	switch {
+	case d.Before == "":
+		fmt.Fprintf(c.App.Writer, "NEW\t%s\tonly backup is %s\n", name, d.After)
+	case len(d.Changes) == 0:
+		fmt.Fprintf(c.App.Writer, "OK\t%s\tno changes from %s to %s\n", name, d.Before, d.After)
+	default:
+		fmt.Fprintf(c.App.Writer, "CHANGED\t%s\t%d changes from %s to %s\n", name, len(d.Changes), d.Before, d.After)
+		for _, ch := range d.Changes {
+			fmt.Fprintf(c.App.Writer, "\t%s\t%s %s\n", ch.Action, ch.Type, ch.Name)
+		}
+	}
+}
+
+// schemaDrifts compares the schemas of the two newest backups in storage of
+// each database match accepts
+func (o *once) schemaDrifts(ctx context.Context, match func(string) bool) ([]*schemaDrift, error) {
+	backups, err := o.storedBackups(ctx, o.BackupFormat)
+	if err != nil {
+		return nil, err
+	}
+	byDB := map[string][]*storedBackup{}
+	var names []string
+	for _, b := range backups {
+		if !match(b.db) || b.incomplete {
+			continue
+		}
+		if _, ok := byDB[b.db]; !ok {
+			names = append(names, b.db)
+		}
+		byDB[b.db] = append(byDB[b.db], b)
+	}
+	sort.Strings(names)
+
+	var drifts []*schemaDrift
+	for _, name := range names {
+		dbBackups := byDB[name]
+		sort.Slice(dbBackups, func(i, j int) bool {
+			return dbBackups[i].modTime.After(dbBackups[j].modTime)
+		})
+		d := &schemaDrift{Job: o.Job, Database: name, Kind: o.Kind, After: dbBackups[0].name}
+		if len(dbBackups) > 1 {
+			d.Before = dbBackups[1].name
+			d.Changes, err = o.compareBackups(ctx, dbBackups[1], dbBackups[0])
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to diff %s", name)
+			}
+		}
+		drifts = append(drifts, d)
+	}
+	return drifts, nil
+}
+
+// compareBackups returns the changes from the schema of one backup to that of
+// another
+func (o *once) compareBackups(ctx context.Context, before, after *storedBackup) ([]schema.Change, error) {
+	b, err := o.readSchema(ctx, before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := o.readSchema(ctx, after)
+	if err != nil {
+		return nil, err
+	}
+	return schema.Compare(b, a), nil
+}
+
+// readSchema reads the objects defined by a stored backup. Only the schema
+// parts of split backups are read.
+func (o *once) readSchema(ctx context.Context, b *storedBackup) (*schema.Schema, error) {
+	files := b.files
+	if index, ok := splitIndexFile(b); ok {
+		var err error
+		files, err = o.splitSchemaFiles(ctx, index)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(files) != 1 {
+		return nil, errors.Errorf("backup %s isn't a single file", b.name)
+	}
+
+	var readers []io.Reader
+	for _, f := range files {
+		r, err := o.openBackup(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	s, err := schema.Parse(io.MultiReader(readers...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", b.name)
+	}
+	return s, nil
+}
+
+// diffSchemas records in run what changed in the schema of each database it
+// backed up since the previous backup. Failing to do so is logged rather than
+// failing the run.
+func (o *once) diffSchemas(ctx context.Context, run *report.Run) {
+	backedUp := map[string]report.Database{}
+	for _, d := range run.Snapshot().Databases {
+		// An unchanged schema wasn't uploaded, so it has nothing to compare
+		if d.Status == report.StatusSucceeded && !d.Unchanged {
+			backedUp[d.Name] = d
+		}
+	}
+	if len(backedUp) == 0 {
+		return
+	}
+
+	drifts, err := o.schemaDrifts(ctx, func(name string) bool {
+		_, ok := backedUp[name]
+		return ok
+	})
+	if err != nil {
+		log.WithContext(ctx).WithField("job", o.Job).WithError(err).Error("Failed to diff schemas")
+		return
+	}
+	for _, d := range drifts {
+		if len(d.Changes) == 0 {
+			continue
+		}
+		result := backedUp[d.Database]
+		result.SchemaChanges = d.Changes
+		run.AddDatabase(result)
+		schemaChanges.With(prometheus.Labels{"backup_job": o.Job, "database": d.Database}).Add(float64(len(d.Changes)))
+
+		log.WithContext(ctx).WithFields(log.Fields{
+			"job":     o.Job,
+			"db":      d.Database,
+			"before":  d.Before,
+			"after":   d.After,
+			"changes": len(d.Changes),
+		}).Warn("Schema changed since the previous backup")
+	}
+}
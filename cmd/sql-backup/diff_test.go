@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/pool"
+	"github.com/utilitywarehouse/sql-backup/internal/schema"
+)
+
+const usersTable = `--
+-- Name: users; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.users (
+    id integer NOT NULL%s
+);
+`
+
+func TestSchemaDrifts(t *testing.T) {
+	s := newMemStore()
+	o := &once{Job: "default", Store: s, BackupFormat: "%s_2006-01-02.sql"}
+	now := time.Now()
+	for name, backup := range map[string]struct {
+		dump    string
+		modTime time.Time
+	}{
+		"users_2024-03-01.sql":   {usersTable, now.Add(-72 * time.Hour)},
+		"users_2024-03-02.sql":   {usersTable, now.Add(-48 * time.Hour)},
+		"users_2024-03-03.sql":   {usersTable + "\nCREATE INDEX users_id ON public.users (id);\n", now.Add(-time.Hour)},
+		"billing_2024-03-03.sql": {usersTable, now.Add(-time.Hour)},
+	} {
+		s.objects[name] = []byte(backup.dump)
+		s.modTimes[name] = backup.modTime
+	}
+
+	drifts, err := o.schemaDrifts(context.Background(), func(string) bool { return true })
+	require.Nil(t, err)
+	require.Len(t, drifts, 2)
+
+	assert.Equal(t, "billing", drifts[0].Database)
+	assert.Equal(t, "", drifts[0].Before)
+	assert.Empty(t, drifts[0].Changes)
+
+	assert.Equal(t, "users", drifts[1].Database)
+	assert.Equal(t, "users_2024-03-02.sql", drifts[1].Before)
+	assert.Equal(t, "users_2024-03-03.sql", drifts[1].After)
+	// The index has no header of its own, so it's part of the table
+	require.Len(t, drifts[1].Changes, 1)
+	assert.Equal(t, schema.Changed, drifts[1].Changes[0].Action)
+	assert.Equal(t, "public.users", drifts[1].Changes[0].Name)
+
+	drifts, err = o.schemaDrifts(context.Background(), func(name string) bool { return name == "billing" })
+	require.Nil(t, err)
+	assert.Len(t, drifts, 1)
+}
+
+func TestBackup_DiffSchema(t *testing.T) {
+	s := newMemStore()
+	var previous bytes.Buffer
+	gzW := gzip.NewWriter(&previous)
+	_, err := gzW.Write([]byte(usersTable))
+	require.Nil(t, err)
+	require.Nil(t, gzW.Close())
+	s.objects["users_2024-03-01_000000.schema.sql.gz"] = previous.Bytes()
+	s.modTimes["users_2024-03-01_000000.schema.sql.gz"] = time.Now().Add(-time.Hour)
+
+	dump := usersTable[:len(usersTable)-4] + ",\n    email text\n);\n"
+	o := &once{
+		Job:          "drifted",
+		Retriever:    stubRetriever{"users"},
+		Dumper:       schemaDumper{&dump},
+		Pool:         pool.SizablePool{Size: 1},
+		Store:        s,
+		Kind:         dbcli.SchemaDump,
+		DiffSchema:   true,
+		BackupFormat: "%s_2006-01-02_150405.schema.sql",
+	}
+	run, err := o.Backup(context.Background())
+	require.Nil(t, err)
+
+	assert.Equal(t, []schema.Change{{
+		Action: schema.Added,
+		Type:   schema.Column,
+		Name:   "public.users.email",
+		After:  "email text",
+	}}, run.Databases[0].SchemaChanges)
+	assert.Equal(t, float64(1), testutil.ToFloat64(schemaChanges.WithLabelValues("drifted", "users")))
+}
@@ -9,6 +9,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/pool"
 )
 
 const (
@@ -22,6 +24,39 @@ var (
 	buildStamp = "replaced by `make build`"
 )
 
+var walFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "wal-prefix",
+		Usage:  "Directory within the storage location to archive WAL segments in",
+		EnvVar: "WAL_PREFIX",
+		Value:  "wal",
+	},
+	cli.StringFlag{
+		Name:   "wal-encryption-key",
+		Usage:  "Hex or base64 encoded 32 byte key to encrypt WAL segments with. If not provided, segments are not encrypted",
+		EnvVar: "WAL_ENCRYPTION_KEY",
+	},
+}
+
+// publishFlags configure where commands that exit once done publish metrics
+var publishFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "pushgateway-url",
+		Usage:  "Prometheus Pushgateway to push metrics to once done, eg. http://pushgateway:9091",
+		EnvVar: "PUSHGATEWAY_URL",
+	},
+	cli.StringFlag{
+		Name:   "metrics-instance",
+		Usage:  "Instance to group pushed metrics by. Defaults to the host of the DSN",
+		EnvVar: "METRICS_INSTANCE",
+	},
+	cli.StringFlag{
+		Name:   "metrics-textfile",
+		Usage:  "File to write metrics to for node-exporter's textfile collector once done, eg. /var/lib/node_exporter/sql_backup.prom",
+		EnvVar: "METRICS_TEXTFILE",
+	},
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = appName
@@ -50,6 +85,46 @@ func main() {
 			EnvVar: "BACKUP_FORMAT",
 			Value:  "%s_2006-01-02_150405.sql",
 		},
+		cli.StringFlag{
+			Name:   "backup-mode",
+			Usage:  "One of 'logical' (pg_dump each database) or 'physical' (pg_basebackup the whole cluster)",
+			EnvVar: "BACKUP_MODE",
+			Value:  logicalMode,
+		},
+		cli.StringFlag{
+			Name:   "backup-kind",
+			Usage:  "One of 'full', 'schema' (schema only) or 'data' (data only). Schema and data backups get the kind added to their filenames, eg. users_2006-01-02_150405.schema.sql",
+			EnvVar: "BACKUP_KIND",
+			Value:  dbcli.FullDump,
+		},
+		cli.BoolFlag{
+			Name:   "skip-unchanged-schema",
+			Usage:  "Don't upload a schema backup identical to the newest one in storage",
+			EnvVar: "SKIP_UNCHANGED_SCHEMA",
+		},
+		cli.StringFlag{
+			Name:   "basebackup-format",
+			Usage:  "Prefix physical backups are stored under. Passed through time.Format & fmt.Sprintf with the db host",
+			EnvVar: "BASEBACKUP_FORMAT",
+			Value:  "%s_basebackup_2006-01-02_150405",
+		},
+		cli.StringFlag{
+			Name:   "basebackup-binary",
+			Usage:  "Path to the pg_basebackup binary. For backup mode 'physical'",
+			EnvVar: "BASEBACKUP_PATH",
+			Value:  "pg_basebackup",
+		},
+		cli.StringFlag{
+			Name:   "basebackup-tmp-dir",
+			Usage:  "Directory physical backups are staged in before upload. Defaults to the system temp dir",
+			EnvVar: "BASEBACKUP_TMP_DIR",
+		},
+		cli.StringFlag{
+			Name:   "basebackup-wal-method",
+			Usage:  "One of 'stream' (stream WAL alongside the backup, staged on disk before upload) or 'fetch' (upload the backup as it's taken, with the WAL fetched at its end)",
+			EnvVar: "BASEBACKUP_WAL_METHOD",
+			Value:  walStream,
+		},
 		cli.StringFlag{
 			Name:   "dbcli-binary",
 			Usage:  "Path to the db cli binary, eg. pg_dump",
@@ -73,6 +148,59 @@ func main() {
 			Usage:  "Timeout when calling `db dump`",
 			EnvVar: "DBCLI_TIMEOUT",
 		},
+		cli.StringFlag{
+			Name:   "engine",
+			Usage:  "Database engine, used to pick the default --system-databases. One of 'postgres' or 'cockroach'",
+			EnvVar: "ENGINE",
+			Value:  "postgres",
+		},
+		cli.StringSliceFlag{
+			Name:   "system-databases",
+			Usage:  "Comma-separated list of databases that are never backed up, as system never is. Defaults depend on --engine",
+			EnvVar: "SYSTEM_DATABASES",
+		},
+		cli.DurationFlag{
+			Name:   "discovery-timeout",
+			Usage:  "Timeout when listing the databases to backup",
+			EnvVar: "DISCOVERY_TIMEOUT",
+			Value:  1 * time.Minute,
+		},
+		cli.IntFlag{
+			Name:   "dbcli-nice",
+			Usage:  "Niceness to give dump processes, from -20 to 19, eg. 10",
+			EnvVar: "DBCLI_NICE",
+		},
+		cli.StringFlag{
+			Name:   "dbcli-ionice-class",
+			Usage:  "IO scheduling class for dump processes. One of 'idle', 'best-effort' or 'realtime'",
+			EnvVar: "DBCLI_IONICE_CLASS",
+		},
+		cli.IntFlag{
+			Name:   "dbcli-ionice-level",
+			Usage:  "IO scheduling priority for dump processes within --dbcli-ionice-class, 0 (highest) to 7",
+			EnvVar: "DBCLI_IONICE_LEVEL",
+			Value:  4,
+		},
+		cli.StringFlag{
+			Name:   "dump-rate-limit",
+			Usage:  "Maximum rate to read dumps at across all databases, eg. 20MB/s",
+			EnvVar: "DUMP_RATE_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "db-dump-rate-limit",
+			Usage:  "Maximum rate to read each database's dump at, eg. 5MB/s",
+			EnvVar: "DB_DUMP_RATE_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "upload-rate-limit",
+			Usage:  "Maximum rate to write to storage at across all databases, eg. 10MB/s",
+			EnvVar: "UPLOAD_RATE_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "db-upload-rate-limit",
+			Usage:  "Maximum rate to write each database's backup to storage at, eg. 2MB/s",
+			EnvVar: "DB_UPLOAD_RATE_LIMIT",
+		},
 		cli.IntFlag{
 			Name:   "pool",
 			Usage:  "Number of databases to concurrently dump",
@@ -80,6 +208,22 @@ func main() {
 			Value:  5,
 			Hidden: true,
 		},
+		cli.StringFlag{
+			Name:   "pool-strategy",
+			Usage:  "Order to backup databases in. One of 'fifo', 'largest-first' or 'smallest-first'",
+			EnvVar: "POOL_STRATEGY",
+			Value:  string(pool.FIFO),
+		},
+		cli.StringSliceFlag{
+			Name:   "pool-priority",
+			Usage:  "Comma-separated list of databases to backup before all others, in order",
+			EnvVar: "POOL_PRIORITY",
+		},
+		cli.StringFlag{
+			Name:   "pool-slot-size",
+			Usage:  "Database size that uses one --pool slot, eg. 50GB. Larger databases use more slots so fewer run alongside them",
+			EnvVar: "POOL_SLOT_SIZE",
+		},
 		cli.BoolFlag{
 			Name:   "disable-compression",
 			Usage:  "Disable compressing the backed up SQL file",
@@ -87,14 +231,19 @@ func main() {
 		},
 		cli.StringSliceFlag{
 			Name:   "only",
-			Usage:  "Comma-separated list of databses to backup. If not provided, all are backed up",
+			Usage:  "Comma-separated list of databses to backup. If not provided, all are backed up. Accepts globs (tenant_*) and /regexps/",
 			EnvVar: "DBS",
 		},
 		cli.StringSliceFlag{
 			Name:   "exclude",
-			Usage:  "Comma-separated list of databses to filter when backing up all",
+			Usage:  "Comma-separated list of databses to filter. Accepts globs (*_tmp) and /regexps/. Takes precedence over --only",
 			EnvVar: "FILTER_DBS",
 		},
+		cli.BoolFlag{
+			Name:   "strict-only",
+			Usage:  "Fail the backup if any database in --only does not exist. Other databases are still backed up",
+			EnvVar: "STRICT_ONLY",
+		},
 		cli.StringFlag{
 			Name:   "driver",
 			Usage:  "Storage driver. One of 'file' or 'aws' or 'gcp'",
@@ -111,7 +260,129 @@ func main() {
 			Usage:  "Name of the S3/GCS bucket to upload files into. For driver 'aws' or 'gcp'",
 			EnvVar: "BACKUP_BUCKET",
 		},
+		cli.DurationFlag{
+			Name:   "retention",
+			Usage:  "How long backups are kept for. The newest backup of each database is always kept. If not provided, backups are never removed",
+			EnvVar: "RETENTION",
+		},
+		cli.DurationFlag{
+			Name:   "max-age",
+			Usage:  "How old the newest backup of a database in storage may be before it's stale, eg. 26h. Checked by 'check', and by 'cron' if set",
+			EnvVar: "MAX_AGE",
+		},
+		cli.BoolFlag{
+			Name:   "diff-schema",
+			Usage:  "After each run, compare the schema of every database backed up with its previous backup and report what changed. For schema backups",
+			EnvVar: "DIFF_SCHEMA",
+		},
+		cli.StringFlag{
+			Name:   "subset-rules",
+			Usage:  "Path to a YAML file of rules selecting a referentially consistent subset of rows. If set, logical backups only have those rows",
+			EnvVar: "SUBSET_RULES",
+		},
+		cli.BoolFlag{
+			Name:   "split-tables",
+			Usage:  "Store each logical backup as a part per table, or group of small tables, under a prefix per database, along with an index.json listing the parts in restore order",
+			EnvVar: "SPLIT_TABLES",
+		},
+		cli.StringFlag{
+			Name:   "split-group-size",
+			Usage:  "Size, eg. 1GB, that tables smaller than it are grouped up to in split backups. If not provided, every table gets a part of its own",
+			EnvVar: "SPLIT_GROUP_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "split-parallel",
+			Usage:  "How many parts of a database split backups dump at once",
+			EnvVar: "SPLIT_PARALLEL",
+			Value:  defaultSplitParallel,
+		},
+		cli.StringFlag{
+			Name:   "mask-rules",
+			Usage:  "Path to a YAML file of column masking rules. If set, a masked variant of each logical backup is written",
+			EnvVar: "MASK_RULES",
+		},
+		cli.StringFlag{
+			Name:   "mask-mode",
+			Usage:  "One of 'alongside' (write the masked variant as well as the raw backup) or 'instead' (write only the masked variant, under --backup-format)",
+			EnvVar: "MASK_MODE",
+			Value:  maskAlongside,
+		},
+		cli.StringFlag{
+			Name:   "masked-backup-format",
+			Usage:  "Filename format of masked backups in mask mode 'alongside'. Passed through time.Format & fmt.Sprintf",
+			EnvVar: "MASKED_BACKUP_FORMAT",
+			Value:  "%s_2006-01-02_150405.masked.sql",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "Path to a YAML file describing the backup jobs to run. Jobs default to the values of the other flags",
+			EnvVar: "CONFIG_FILE",
+		},
+		cli.StringFlag{
+			Name:   "notify-webhook-url",
+			Usage:  "URL to post a JSON report of finished runs to",
+			EnvVar: "NOTIFY_WEBHOOK_URL",
+		},
+		cli.StringFlag{
+			Name:   "notify-slack-url",
+			Usage:  "Slack incoming webhook URL to notify about finished runs",
+			EnvVar: "NOTIFY_SLACK_URL",
+		},
+		cli.StringFlag{
+			Name:   "notify-smtp-addr",
+			Usage:  "host:port of an SMTP server to email notifications about finished runs through",
+			EnvVar: "NOTIFY_SMTP_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "notify-smtp-username",
+			Usage:  "Username to authenticate to the SMTP server with. If not provided, no auth is used",
+			EnvVar: "NOTIFY_SMTP_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "notify-smtp-password",
+			Usage:  "Password to authenticate to the SMTP server with",
+			EnvVar: "NOTIFY_SMTP_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "notify-email-from",
+			Usage:  "Address notification emails are sent from",
+			EnvVar: "NOTIFY_EMAIL_FROM",
+		},
+		cli.StringSliceFlag{
+			Name:   "notify-email-to",
+			Usage:  "Addresses notification emails are sent to",
+			EnvVar: "NOTIFY_EMAIL_TO",
+		},
+		cli.StringFlag{
+			Name:   "notify-on",
+			Usage:  "Runs to notify about: 'failure', 'recovery' (failures and the first success after one) or 'always'",
+			EnvVar: "NOTIFY_ON",
+			Value:  "failure",
+		},
+		cli.BoolFlag{
+			Name:   "notify-on-schema-change",
+			Usage:  "Also notify about runs that found schema changes, see --diff-schema",
+			EnvVar: "NOTIFY_ON_SCHEMA_CHANGE",
+		},
+		cli.StringFlag{
+			Name:   "notify-template",
+			Usage:  "Go template of notification messages, executed with .Job, .Status, .Run, .Failed and .Changed",
+			EnvVar: "NOTIFY_TEMPLATE",
+		},
+		cli.DurationFlag{
+			Name:   "notify-min-interval",
+			Usage:  "Least time between notifications about the same job. Recoveries are always sent",
+			EnvVar: "NOTIFY_MIN_INTERVAL",
+			Value:  30 * time.Minute,
+		},
+		cli.StringFlag{
+			Name:   "tracing-exporter",
+			Usage:  "Where to export traces of backups to: 'none', 'otlp' (configured by the OTEL_EXPORTER_OTLP_* vars) or 'stdout'",
+			EnvVar: "TRACING_EXPORTER",
+			Value:  "none",
+		},
 	}
+	var shutdownTracing func(context.Context) error
 	app.Before = func(c *cli.Context) error {
 		lvl, err := log.ParseLevel(c.GlobalString("log-level"))
 		if err != nil {
@@ -126,13 +397,24 @@ func main() {
 			log.SetFormatter(&log.JSONFormatter{})
 		}
 
-		return nil
+		shutdownTracing, err = setupTracing(c)
+		return err
+	}
+	app.After = func(c *cli.Context) error {
+		if shutdownTracing == nil {
+			return nil
+		}
+		// Flush the spans of the last backup
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return shutdownTracing(ctx)
 	}
 
 	app.Commands = cli.Commands{
 		cli.Command{
 			Name:  "once",
 			Usage: "Backup databases once and then stop.",
+			Flags: publishFlags,
 			Action: func(c *cli.Context) error {
 				log.Info("Performing backup once...")
 				cmd := &OnceCmd{}
@@ -154,6 +436,11 @@ func main() {
 					Usage:  "Cron schedule to perform backups on",
 					EnvVar: "SCHEDULE",
 				},
+				cli.StringFlag{
+					Name:   "schedule-overrides",
+					Usage:  "Schedules for some databases, eg. 'billing=@hourly;tenant_*,audit=0 0 */6 * * *'. Remaining databases are backed up on --schedule",
+					EnvVar: "SCHEDULE_OVERRIDES",
+				},
 				cli.IntFlag{
 					Name:   "retries",
 					Usage:  "Number of times to retry on failure. After this the process will exit",
@@ -166,12 +453,53 @@ func main() {
 					EnvVar: "RETRY_BACKOFF",
 					Value:  1 * time.Minute,
 				},
+				cli.StringFlag{
+					Name:   "overlap-policy",
+					Usage:  "What to do when a backup is due while the previous one is running. One of 'skip', 'queue' or 'cancel-previous'",
+					EnvVar: "OVERLAP_POLICY",
+					Value:  overlapSkip,
+				},
+				cli.StringFlag{
+					Name:   "misfire-policy",
+					Usage:  "What to do on startup when a scheduled backup was missed since the last backup in storage. One of 'skip' or 'run-once'",
+					EnvVar: "MISFIRE_POLICY",
+					Value:  misfireSkip,
+				},
+				cli.StringFlag{
+					Name:   "lock",
+					Usage:  "Lock scheduled runs so only one replica runs each. One of 'none', 'postgres' (an advisory lock on the db server) or 'object' (a lease file in storage)",
+					EnvVar: "LOCK",
+					Value:  noLock,
+				},
+				cli.StringFlag{
+					Name:   "lock-prefix",
+					Usage:  "Directory within the storage location to create leases in. For lock 'object'",
+					EnvVar: "LOCK_PREFIX",
+					Value:  "locks",
+				},
+				cli.DurationFlag{
+					Name:   "lock-min-hold",
+					Usage:  "Least time an advisory lock is held for, to cover clock differences between replicas. For lock 'postgres'",
+					EnvVar: "LOCK_MIN_HOLD",
+					Value:  1 * time.Minute,
+				},
 				cli.IntFlag{
 					Name:   "operational-port",
 					Usage:  "Port to serve HTTP operational endpoints on",
 					EnvVar: "OPERATIONAL_PORT",
 					Value:  8081,
 				},
+				cli.DurationFlag{
+					Name:   "freshness-interval",
+					Usage:  "How often to check the newest backups in storage against --max-age",
+					EnvVar: "FRESHNESS_INTERVAL",
+					Value:  5 * time.Minute,
+				},
+				cli.StringFlag{
+					Name:   "api-token",
+					Usage:  "Bearer token for the /api/ endpoints on the operational port, to trigger, inspect and cancel backups. If not provided, the api is disabled",
+					EnvVar: "API_TOKEN",
+				},
 			},
 			Action: func(c *cli.Context) error {
 				cmd := &CronCmd{}
@@ -183,6 +511,52 @@ func main() {
 				return nil
 			},
 		},
+		cli.Command{
+			Name:  "check",
+			Usage: "Check the newest backup of each database in storage is no older than --max-age.",
+			Flags: publishFlags,
+			Action: func(c *cli.Context) error {
+				cmd := &CheckCmd{}
+				return cmd.Run(c)
+			},
+		},
+		cli.Command{
+			Name:      "diff",
+			Usage:     "Compare the schemas of the two newest backups of each database in storage. Exits with 1 if any changed.",
+			ArgsUsage: "[database...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "output",
+					Usage:  "One of 'text' or 'json'",
+					EnvVar: "DIFF_OUTPUT",
+					Value:  textOutput,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cmd := &DiffCmd{}
+				return cmd.Run(c)
+			},
+		},
+		cli.Command{
+			Name:      "archive-wal",
+			Usage:     "Archive a WAL segment. For use as the postgres archive_command.",
+			ArgsUsage: "<path> <name>",
+			Flags:     walFlags,
+			Action: func(c *cli.Context) error {
+				cmd := &ArchiveWALCmd{}
+				return cmd.Run(c)
+			},
+		},
+		cli.Command{
+			Name:      "restore-wal",
+			Usage:     "Restore an archived WAL segment. For use as the postgres restore_command.",
+			ArgsUsage: "<name> <path>",
+			Flags:     walFlags,
+			Action: func(c *cli.Context) error {
+				cmd := &RestoreWALCmd{}
+				return cmd.Run(c)
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+var (
+	errorsSeen = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "errors_seen",
+		Help:      "Count of errors seen",
+	}, []string{"backup_job"})
+	retryAttempted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "retries_attempted",
+		Help:      "Count of retries after a failed backup",
+	}, []string{"backup_job"})
+	backupTimer = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "backup_timer",
+		Help:      "Time taken to run backup",
+	}, []string{"backup_job"})
+	databaseBackupFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "database_backup_failed",
+		Help:      "Count of failed database backups to storage",
+	}, []string{"backup_job", "database"})
+	databaseBackupSuccessful = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "database_backup_successful",
+		Help:      "Count of successful database backups to storage",
+	}, []string{"backup_job", "database"})
+	skippedRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "skipped_runs",
+		Help:      "Count of scheduled backups skipped because the previous one was still running, or their lock couldn't be taken",
+	}, []string{"backup_job"})
+	lockContended = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "lock_contended",
+		Help:      "Count of scheduled backups left to another replica that claimed them first",
+	}, []string{"backup_job"})
+	missingDatabases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "missing_databases",
+		Help:      "Number of databases requested with --only that were not found in the last backup",
+	}, []string{"backup_job"})
+
+	databaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "db_backup",
+		Name:      "database_duration_seconds",
+		Help:      "Time taken to back up a database",
+		// From a second to about 9 hours
+		Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+	}, []string{"backup_job", "database"})
+	databaseCompressedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "database_compressed_bytes",
+		Help:      "Size of the last successful backup of a database, as written to storage",
+	}, []string{"backup_job", "database"})
+	databaseUncompressedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "database_uncompressed_bytes",
+		Help:      "Size of the last successful backup of a database before compression",
+	}, []string{"backup_job", "database"})
+	databaseLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "database_last_success_timestamp_seconds",
+		Help:      "Unix time the last successful backup of a database finished",
+	}, []string{"backup_job", "database"})
+	databaseLastAttempt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "database_last_attempt_timestamp_seconds",
+		Help:      "Unix time the last backup attempt of a database finished",
+	}, []string{"backup_job", "database"})
+	databaseLastAttemptSuccessful = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "database_last_attempt_successful",
+		Help:      "Whether the last backup attempt of a database succeeded (1) or failed (0)",
+	}, []string{"backup_job", "database"})
+
+	databaseNewestBackup = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "database_newest_backup_timestamp_seconds",
+		Help:      "Unix time of the newest backup of a database in storage, or 0 if it has none",
+	}, []string{"backup_job", "database"})
+	staleDatabases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "stale_databases",
+		Help:      "Number of databases whose newest backup in storage is older than the max age",
+	}, []string{"backup_job"})
+	schemaChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "schema_changes",
+		Help:      "Count of schema changes found between a database's backups",
+	}, []string{"backup_job", "database"})
+
+	destinationWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "destination_written_bytes",
+		Help:      "Count of bytes written to a storage destination",
+	}, []string{"backup_job", "destination"})
+	destinationWriteFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "db_backup",
+		Name:      "destination_write_failures",
+		Help:      "Count of files that failed to be written to a storage destination",
+	}, []string{"backup_job", "destination"})
+	destinationLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "db_backup",
+		Name:      "destination_last_success_timestamp_seconds",
+		Help:      "Unix time a file was last written to a storage destination successfully",
+	}, []string{"backup_job", "destination"})
+)
+
+// metrics are the metrics exposed by the operational server, or published
+// at the end of a one time run
+var metrics = []prometheus.Collector{
+	errorsSeen,
+	retryAttempted,
+	backupTimer,
+	databaseBackupFailed,
+	databaseBackupSuccessful,
+	skippedRuns,
+	lockContended,
+	missingDatabases,
+	databaseDuration,
+	databaseCompressedBytes,
+	databaseUncompressedBytes,
+	databaseLastSuccess,
+	databaseLastAttempt,
+	databaseLastAttemptSuccessful,
+	databaseNewestBackup,
+	staleDatabases,
+	schemaChanges,
+	destinationWritten,
+	destinationWriteFailed,
+	destinationLastSuccess,
+}
+
+// observeRun records the outcome of a finished run and of each database it
+// backed up. Databases the run didn't get to are left alone.
+func observeRun(run *report.Run) {
+	snapshot := run.Snapshot()
+	backupTimer.WithLabelValues(snapshot.Job).Set(snapshot.Finished.Sub(snapshot.Started).Seconds())
+	missingDatabases.WithLabelValues(snapshot.Job).Set(float64(len(snapshot.Missing)))
+	for _, d := range snapshot.Databases {
+		if d.Finished.IsZero() {
+			continue
+		}
+		labels := prometheus.Labels{"backup_job": snapshot.Job, "database": d.Name}
+		databaseDuration.With(labels).Observe(d.Finished.Sub(d.Started).Seconds())
+		databaseLastAttempt.With(labels).Set(float64(d.Finished.Unix()))
+
+		if d.Status != report.StatusSucceeded {
+			databaseBackupFailed.With(labels).Inc()
+			databaseLastAttemptSuccessful.With(labels).Set(0)
+			continue
+		}
+		databaseBackupSuccessful.With(labels).Inc()
+		databaseLastAttemptSuccessful.With(labels).Set(1)
+		databaseLastSuccess.With(labels).Set(float64(d.Finished.Unix()))
+		databaseCompressedBytes.With(labels).Set(float64(d.Written))
+		databaseUncompressedBytes.With(labels).Set(float64(d.Uncompressed))
+	}
+}
+
+// observeFreshness records what storage says about the job's backups
+func observeFreshness(job string, f *freshness) {
+	for name, last := range f.last {
+		var ts float64
+		if !last.IsZero() {
+			ts = float64(last.Unix())
+		}
+		databaseNewestBackup.WithLabelValues(job, name).Set(ts)
+	}
+	staleDatabases.WithLabelValues(job).Set(float64(len(f.stale)))
+}
+
+// metricsRegistry returns a registry of the metrics, for publishing them
+// outside of the operational server
+func metricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(metrics...)
+	return reg
+}
+
+// pushMetrics pushes the metrics of job to a Pushgateway, grouped by job and
+// instance. They replace whatever was pushed for the group before.
+func pushMetrics(ctx context.Context, url, job, instance string) error {
+	return push.New(url, job).
+		Grouping("instance", instance).
+		Gatherer(jobGatherer(metricsRegistry(), job)).
+		PushContext(ctx)
+}
+
+// jobGatherer gathers the metrics of job from g
+func jobGatherer(g prometheus.Gatherer, job string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		if err != nil {
+			return nil, err
+		}
+		var filtered []*dto.MetricFamily
+		for _, f := range families {
+			var ms []*dto.Metric
+			for _, m := range f.Metric {
+				if metricJob(m.Label) == job {
+					ms = append(ms, m)
+				}
+			}
+			if len(ms) > 0 {
+				f.Metric = ms
+				filtered = append(filtered, f)
+			}
+		}
+		return filtered, nil
+	})
+}
+
+// metricJob returns the value of the backup_job label in labels
+func metricJob(labels []*dto.LabelPair) string {
+	for _, l := range labels {
+		if l.GetName() == "backup_job" {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// meteredStorerFromJob returns the Storer for a job's destinations, recording
+// what is written to each of them
+func meteredStorerFromJob(j jobConfig) store.Storer {
+	if len(j.Destinations) == 1 {
+		d := j.Destinations[0]
+		return meteredStore{Storer: storerFromDestination(d), job: j.Name, destination: d.String()}
+	}
+	var m store.Multi
+	for _, d := range j.Destinations {
+		m = append(m, meteredStore{Storer: storerFromDestination(d), job: j.Name, destination: d.String()})
+	}
+	return m
+}
+
+// meteredStore records the bytes written to a destination and the files that
+// failed to be written
+type meteredStore struct {
+	store.Storer
+	job         string
+	destination string
+}
+
+func (s meteredStore) Writer(ctx context.Context, filename string) (io.WriteCloser, error) {
+	w, err := s.Storer.Writer(ctx, filename)
+	if err != nil {
+		destinationWriteFailed.WithLabelValues(s.job, s.destination).Inc()
+		return nil, err
+	}
+	return &meteredWriter{w: w, s: s, ctx: ctx}, nil
+}
+
+type meteredWriter struct {
+	w      io.WriteCloser
+	s      meteredStore
+	ctx    context.Context
+	failed bool
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	destinationWritten.WithLabelValues(w.s.job, w.s.destination).Add(float64(n))
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+func (w *meteredWriter) Close() error {
+	err := w.w.Close()
+	if err != nil && w.ctx.Err() != nil {
+		// The write was abandoned, not failed by the destination
+		return err
+	}
+	if err != nil || w.failed {
+		destinationWriteFailed.WithLabelValues(w.s.job, w.s.destination).Inc()
+		return err
+	}
+	destinationLastSuccess.WithLabelValues(w.s.job, w.s.destination).Set(float64(time.Now().Unix()))
+	return nil
+}
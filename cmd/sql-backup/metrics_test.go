@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+	"github.com/utilitywarehouse/sql-backup/internal/pool"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+// failingDumper fails to dump the databases in fail
+type failingDumper struct {
+	fail map[string]bool
+}
+
+func (d failingDumper) Validate() error {
+	return nil
+}
+
+func (d failingDumper) Dump(ctx context.Context, db string, w io.Writer) error {
+	if d.fail[db] {
+		return errors.New("dump failed")
+	}
+	return stubDumper{}.Dump(ctx, db, w)
+}
+
+func TestObserveRun(t *testing.T) {
+	s := newMemStore()
+	o := &once{
+		Job:          "observed",
+		Retriever:    stubRetriever{"users", "billing"},
+		Dumper:       failingDumper{fail: map[string]bool{"billing": true}},
+		Pool:         pool.SizablePool{Size: 1},
+		Store:        s,
+		BackupFormat: "%s.sql",
+	}
+	failed := testutil.ToFloat64(databaseBackupFailed.WithLabelValues("observed", "billing"))
+	succeeded := testutil.ToFloat64(databaseBackupSuccessful.WithLabelValues("observed", "users"))
+
+	start := time.Now().Unix()
+	_, err := o.Backup(context.Background())
+	assert.Error(t, err)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(databaseBackupSuccessful.WithLabelValues("observed", "users"))-succeeded)
+	assert.Equal(t, float64(1), testutil.ToFloat64(databaseLastAttemptSuccessful.WithLabelValues("observed", "users")))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(databaseLastSuccess.WithLabelValues("observed", "users")), float64(start))
+	assert.Equal(t, float64(len("dump of users")), testutil.ToFloat64(databaseUncompressedBytes.WithLabelValues("observed", "users")))
+	assert.Equal(t, float64(len(s.objects["users.sql.gz"])), testutil.ToFloat64(databaseCompressedBytes.WithLabelValues("observed", "users")))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(databaseBackupFailed.WithLabelValues("observed", "billing"))-failed)
+	assert.Equal(t, float64(0), testutil.ToFloat64(databaseLastAttemptSuccessful.WithLabelValues("observed", "billing")))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(databaseLastAttempt.WithLabelValues("observed", "billing")), float64(start))
+	assert.Equal(t, float64(0), testutil.ToFloat64(databaseLastSuccess.WithLabelValues("observed", "billing")))
+}
+
+// flakyDumper fails the first dump of each database in fail
+type flakyDumper struct {
+	mu     sync.Mutex
+	fail   map[string]bool
+	failed map[string]bool
+}
+
+func (d *flakyDumper) Validate() error {
+	return nil
+}
+
+func (d *flakyDumper) Dump(ctx context.Context, db string, w io.Writer) error {
+	d.mu.Lock()
+	fail := d.fail[db] && !d.failed[db]
+	d.failed[db] = true
+	d.mu.Unlock()
+	if fail {
+		return errors.New("dump failed")
+	}
+	return stubDumper{}.Dump(ctx, db, w)
+}
+
+func TestObserveRun_Retried(t *testing.T) {
+	job := newTestCronJob("retried", overlapSkip, newBlockingDumper())
+	job.once.Job = "retried"
+	job.once.Retriever = stubRetriever{"users", "billing"}
+	job.once.Dumper = &flakyDumper{fail: map[string]bool{"billing": true}, failed: map[string]bool{}}
+	job.backoffStrategy = backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 1)
+	failed := testutil.ToFloat64(databaseBackupFailed.WithLabelValues("retried", "billing"))
+	succeeded := testutil.ToFloat64(databaseBackupSuccessful.WithLabelValues("retried", "users"))
+
+	job.run(context.Background())
+
+	// Only the attempt that succeeded is counted
+	assert.True(t, job.lastBackupSuccessful.Load())
+	assert.Equal(t, float64(0), testutil.ToFloat64(databaseBackupFailed.WithLabelValues("retried", "billing"))-failed)
+	assert.Equal(t, float64(1), testutil.ToFloat64(databaseBackupSuccessful.WithLabelValues("retried", "users"))-succeeded)
+	assert.Equal(t, float64(1), testutil.ToFloat64(databaseLastAttemptSuccessful.WithLabelValues("retried", "billing")))
+}
+
+func TestMeteredStore(t *testing.T) {
+	ctx := context.Background()
+	written := testutil.ToFloat64(destinationWritten.WithLabelValues("metered", "/backups"))
+	failed := testutil.ToFloat64(destinationWriteFailed.WithLabelValues("metered", "/backups"))
+
+	s := meteredStore{Storer: store.File{Dir: t.TempDir()}, job: "metered", destination: "/backups"}
+	w, err := s.Writer(ctx, "users.sql")
+	require.Nil(t, err)
+	_, err = w.Write([]byte("dump of users"))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+
+	assert.Equal(t, float64(len("dump of users")), testutil.ToFloat64(destinationWritten.WithLabelValues("metered", "/backups"))-written)
+	assert.Equal(t, float64(0), testutil.ToFloat64(destinationWriteFailed.WithLabelValues("metered", "/backups"))-failed)
+	assert.NotZero(t, testutil.ToFloat64(destinationLastSuccess.WithLabelValues("metered", "/backups")))
+
+	// A file where the directory should be
+	s.Storer = store.File{Dir: "/dev/null"}
+	_, err = s.Writer(ctx, "users.sql")
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(destinationWriteFailed.WithLabelValues("metered", "/backups"))-failed)
+}
+
+func TestCheckStorage_Unmetered(t *testing.T) {
+	j := jobConfig{
+		Name:         "probed",
+		Mode:         physicalMode,
+		DSN:          "postgres@primary:5432/postgres",
+		BaseBackup:   baseBackupConfig{Binary: "/bin/true"},
+		Destinations: []destinationConfig{{Dir: t.TempDir()}},
+	}
+	o, err := onceFromJob(j)
+	require.Nil(t, err)
+
+	require.Nil(t, o.CheckStorage(context.Background()))
+	// Probes aren't backups
+	assert.Equal(t, float64(0), testutil.ToFloat64(destinationWritten.WithLabelValues("probed", j.Destinations[0].String())))
+	assert.Equal(t, float64(0), testutil.ToFloat64(destinationLastSuccess.WithLabelValues("probed", j.Destinations[0].String())))
+}
+
+func TestMeteredStorerFromJob(t *testing.T) {
+	j := jobConfig{
+		Name: "metered",
+		Destinations: []destinationConfig{
+			{Driver: "aws", Bucket: "backups", Dir: "sql"},
+			{Driver: "gcp", Bucket: "backups"},
+			{Driver: "file", Dir: "/backups"},
+		},
+	}
+	m, ok := meteredStorerFromJob(j).(store.Multi)
+	require.True(t, ok)
+	var destinations []string
+	for _, s := range m {
+		destinations = append(destinations, s.(meteredStore).destination)
+	}
+	assert.Equal(t, []string{"s3://backups/sql", "gs://backups", "/backups"}, destinations)
+
+	j.Destinations = j.Destinations[2:]
+	assert.IsType(t, meteredStore{}, meteredStorerFromJob(j))
+}
+
+func TestPushMetrics(t *testing.T) {
+	databaseBackupSuccessful.WithLabelValues("pushed", "users").Inc()
+	databaseBackupSuccessful.WithLabelValues("not-pushed", "users").Inc()
+
+	var method, path string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	require.Nil(t, pushMetrics(context.Background(), srv.URL, "pushed", "db.example.com"))
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, "/metrics/job/pushed/instance/db.example.com", path)
+
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(bytes.NewReader(protoToText(t, body)))
+	require.Nil(t, err)
+	f, ok := families["db_backup_database_backup_successful"]
+	require.True(t, ok)
+	require.Len(t, f.Metric, 1)
+	// backup_job doesn't clash with the job label of the grouping key
+	assert.Equal(t, "pushed", metricJob(f.Metric[0].Label))
+}
+
+func TestPublishMetrics_NoInstance(t *testing.T) {
+	pushed := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	set := &flag.FlagSet{}
+	set.String("pushgateway-url", srv.URL, "")
+	set.String("metrics-instance", "", "")
+	publishMetrics(cli.NewContext(&cli.App{}, set, nil), []jobConfig{
+		{Name: "unparseable", DSN: "postgres@%zz/postgres"},
+		{Name: "socket", DSN: "/postgres?host=/var/run/postgresql"},
+		{Name: "pushed", DSN: "postgres@db.example.com/postgres"},
+	})
+
+	// Without an instance to group them by, jobs aren't pushed over each other
+	assert.Equal(t, 1, pushed)
+}
+
+func TestPublishMetrics_Textfile(t *testing.T) {
+	databaseBackupSuccessful.WithLabelValues("textfile", "users").Inc()
+	path := filepath.Join(t.TempDir(), "sql_backup.prom")
+
+	set := &flag.FlagSet{}
+	set.String("metrics-textfile", path, "")
+	publishMetrics(cli.NewContext(&cli.App{}, set, nil), []jobConfig{{Name: "textfile"}})
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Contains(t, string(data), `db_backup_database_backup_successful{backup_job="textfile",database="users"}`)
+}
+
+// protoToText converts delimited protobuf metric families, as pushed, to the
+// text format
+func protoToText(t *testing.T, body []byte) []byte {
+	var buf bytes.Buffer
+	dec := expfmt.NewDecoder(bytes.NewReader(body), expfmt.NewFormat(expfmt.TypeProtoDelim))
+	for {
+		var f dto.MetricFamily
+		if err := dec.Decode(&f); err == io.EOF {
+			break
+		} else {
+			require.Nil(t, err)
+		}
+		_, err := expfmt.MetricFamilyToText(&buf, &f)
+		require.Nil(t, err)
+	}
+	return buf.Bytes()
+}
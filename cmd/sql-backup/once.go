@@ -1,20 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"io"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"github.com/utilitywarehouse/sql-backup/internal/db"
 	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/mask"
+	"github.com/utilitywarehouse/sql-backup/internal/notify"
 	"github.com/utilitywarehouse/sql-backup/internal/pool"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
 	"github.com/utilitywarehouse/sql-backup/internal/store"
+	"github.com/utilitywarehouse/sql-backup/internal/throttle"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 // OnceCmd is used to have a one time run of a backup
@@ -33,95 +49,1155 @@ func (cmd *OnceCmd) Run(c *cli.Context) error {
 		cancel()
 	}()
 
-	o, err := onceFromFlags(c)
+	jobs, err := jobsFromFlags(c)
 	if err != nil {
 		return err
 	}
+	var onces []*once
+	for _, j := range jobs {
+		o, err := onceFromJob(j)
+		if err != nil {
+			return errors.Wrapf(err, "job %s", j.Name)
+		}
+		onces = append(onces, o)
+	}
+
+	// Every job is run even if an earlier one failed
+	var failed []string
+	var lastErr error
+	for _, o := range onces {
+		if ctx.Err() != nil {
+			break
+		}
+		run, err := o.Backup(ctx)
+		if ctx.Err() == nil {
+			o.notify(ctx, run)
+		}
+		if err != nil {
+			if len(onces) > 1 {
+				log.WithField("job", o.Job).Error(err)
+			}
+			errorsSeen.WithLabelValues(o.Job).Inc()
+			failed = append(failed, o.Job)
+			lastErr = err
+		}
+	}
+	publishMetrics(c, jobs)
 
-	return o.Backup(ctx)
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case len(onces) == 1:
+		return lastErr
+	case len(failed) > 0:
+		return errors.Errorf("backup failed for jobs: %s", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// publishMetrics pushes the metrics of each job to a Pushgateway and writes
+// them to a textfile for node-exporter, as configured. Failing to do so is
+// logged rather than failing the run.
+func publishMetrics(c *cli.Context, jobs []jobConfig) {
+	if url := c.String("pushgateway-url"); url != "" {
+		for _, j := range jobs {
+			instance := c.String("metrics-instance")
+			if instance == "" {
+				// The server backed up stays the same across runs, unlike
+				// the pod or host the run happens on
+				var err error
+				if instance, err = dsnHost(j.DSN); err == nil && instance == "" {
+					err = errors.New("the dsn has no host, set --metrics-instance")
+				}
+				if err != nil {
+					log.WithField("job", j.Name).WithError(err).Error("Failed to push metrics")
+					continue
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := pushMetrics(ctx, url, j.Name, instance)
+			cancel()
+			if err != nil {
+				log.WithField("job", j.Name).WithError(err).Error("Failed to push metrics")
+			}
+		}
+	}
+	if path := c.String("metrics-textfile"); path != "" {
+		if err := prometheus.WriteToTextfile(path, metricsRegistry()); err != nil {
+			log.WithError(err).Error("Failed to write metrics textfile")
+		}
+	}
 }
 
+const (
+	logicalMode  = "logical"
+	physicalMode = "physical"
+)
+
 type once struct {
-	Retriever          db.Retriever
-	Dumper             dbcli.Dumper
-	Pool               pool.Pooler
-	Store              store.Storer
-	BackupFormat       string
-	DisableCompression bool
+	// Job names the job the backup is for
+	Job string
+	// DSN points at the server being backed up
+	DSN  string
+	Mode string
+	// Kind is the kind of dump logical backups are, a full one if empty
+	Kind string
+	// SkipUnchangedSchema skips uploading schema backups identical to the
+	// newest one in storage
+	SkipUnchangedSchema bool
+	Retriever           db.Retriever
+	Dumper              dbcli.Dumper
+	BaseBackuper        dbcli.BaseBackuper
+	Pool                pool.Pooler
+	Store               store.Storer
+	BackupFormat        string
+	BaseBackupFormat    string
+	BaseBackupHost      string
+	BaseBackupTmpDir    string
+	BaseBackupStream    bool
+	DisableCompression  bool
+	StrictOnly          bool
+	// ProbeStore is Store without the metrics, so health checks don't count
+	// as backups. Store is probed if it's nil.
+	ProbeStore store.Storer
+	// Limits in bytes per second on reading dumps and writing to storage,
+	// shared across all databases and for each database. Zero is unlimited.
+	DumpRate     int64
+	DBDumpRate   int64
+	UploadRate   int64
+	DBUploadRate int64
+	// Selects reports whether a database is one the job backs up. Backups
+	// of others in storage, eg. those of other jobs, are left alone.
+	Selects func(name string) bool
+	// Retention is how long backups are kept for. Zero keeps them forever.
+	Retention time.Duration
+	// DiffSchema compares the schema of each database backed up with its
+	// previous backup after every run
+	DiffSchema bool
+	// Splitter, if set, dumps logical backups in parts stored under a
+	// prefix per database, alongside an index of the order to restore them
+	// in. SplitParallel parts of a database are dumped at once.
+	Splitter      dbcli.Splitter
+	SplitParallel int
+	// Notifiers are told about finished runs
+	Notifiers []*notify.Notifier
+	// Mask, if set, masks logical backups. The masked variant is written
+	// instead of the raw backup in MaskMode instead, or else alongside it
+	// under MaskedBackupFormat.
+	Mask               *mask.Rules
+	MaskMode           string
+	MaskedBackupFormat string
+
+	// throughput is shared by copies of a once, whose runs may happen
+	// alongside each other
+	throughput *throughput
+}
+
+// throughput is the rate in bytes per second at which the last successful run
+// backed up databases, used to estimate run time. A nil throughput estimates
+// nothing.
+type throughput struct {
+	mu   sync.Mutex
+	rate float64
+}
+
+// estimate returns how long backing up size bytes should take, or zero if
+// there's nothing to go by
+func (t *throughput) estimate(size int64) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / t.rate * float64(time.Second)).Round(time.Second)
+}
+
+// record records that size bytes were backed up in elapsed
+func (t *throughput) record(size int64, elapsed time.Duration) {
+	if t == nil || size <= 0 || elapsed <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate = float64(size) / elapsed.Seconds()
 }
 
 func onceFromFlags(c *cli.Context) (*once, error) {
-	o := &once{}
+	return onceFromJob(jobFromFlags(c))
+}
+
+func onceFromJob(j jobConfig) (*once, error) {
+	o := &once{Job: j.Name, DSN: j.DSN, throughput: &throughput{}}
 
 	var err error
-	o.Retriever, err = retrieverFromFlags(c)
+	switch o.Mode = j.Mode; o.Mode {
+	case logicalMode, "":
+		o.Retriever, err = retrieverFromJob(j)
+		if err != nil {
+			return nil, err
+		}
+		o.Selects, err = selectorFromJob(j)
+		if err != nil {
+			return nil, err
+		}
+		o.Dumper, err = dumperFromJob(j)
+		if err != nil {
+			return nil, err
+		}
+	case physicalMode:
+		o.BaseBackuper, err = baseBackuperFromJob(j)
+		if err != nil {
+			return nil, err
+		}
+		o.BaseBackupHost, err = dsnHost(j.DSN)
+		if err != nil {
+			return nil, err
+		}
+		o.Selects = func(name string) bool { return name == o.BaseBackupHost }
+	default:
+		return nil, errors.Errorf("unknown backup mode: %s", o.Mode)
+	}
+	o.Pool, err = poolFromJob(j)
 	if err != nil {
 		return nil, err
 	}
-	o.Dumper, err = dumperFromFlags(c)
+	if len(j.Destinations) == 0 {
+		return nil, errors.New("no backup destinations")
+	}
+	o.Store = meteredStorerFromJob(j)
+	o.ProbeStore = storerFromJob(j)
+	o.Notifiers, err = notifiersFromJob(j)
 	if err != nil {
 		return nil, err
 	}
-	o.Pool = poolFromFlags(c)
-	o.Store = storerFromFlags(c)
-	o.BackupFormat = c.GlobalString("backup-format")
-	o.DisableCompression = c.GlobalBool("disable-compression")
+	o.BackupFormat = j.BackupFormat
+	o.BaseBackupFormat = j.BaseBackup.Format
+	o.BaseBackupTmpDir = j.BaseBackup.TmpDir
+	switch j.BaseBackup.WALMethod {
+	case walStream, "":
+	case walFetch:
+		o.BaseBackupStream = true
+	default:
+		return nil, errors.Errorf("unknown basebackup WAL method: %s", j.BaseBackup.WALMethod)
+	}
+	switch j.Compression {
+	case gzipCompression, "":
+	case noCompression:
+		o.DisableCompression = true
+	default:
+		return nil, errors.Errorf("unknown compression: %s", j.Compression)
+	}
+	o.StrictOnly = j.StrictOnly
+	o.Retention = j.Retention
+	if j.Mask.Rules != "" {
+		if o.Mode == physicalMode {
+			return nil, errors.New("masking is only supported for logical backups")
+		}
+		switch o.MaskMode = j.Mask.Mode; o.MaskMode {
+		case maskAlongside, maskInstead:
+		case "":
+			o.MaskMode = maskAlongside
+		default:
+			return nil, errors.Errorf("unknown mask mode: %s", o.MaskMode)
+		}
+		o.Mask, err = mask.LoadFile(j.Mask.Rules)
+		if err != nil {
+			return nil, err
+		}
+		o.MaskedBackupFormat = j.Mask.BackupFormat
+	}
+	switch o.Kind = j.Kind; o.Kind {
+	case dbcli.FullDump, "":
+	case dbcli.SchemaDump, dbcli.DataDump:
+		if o.Mode == physicalMode {
+			return nil, errors.Errorf("%s backups are only supported in logical mode", o.Kind)
+		}
+		// Each kind gets names of its own, so retention and freshness
+		// apply to each separately
+		o.BackupFormat = store.KindFormat(o.BackupFormat, o.Kind)
+		o.MaskedBackupFormat = store.KindFormat(o.MaskedBackupFormat, o.Kind)
+		if o.Kind == dbcli.SchemaDump {
+			// There's no data to mask
+			o.Mask = nil
+		}
+	default:
+		return nil, errors.Errorf("unknown backup kind: %s", o.Kind)
+	}
+	if j.Split.Tables {
+		engine, _, err := systemDatabases(j)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case o.Mode == physicalMode:
+			return nil, errors.New("split backups are only supported in logical mode")
+		case engine != "postgres":
+			return nil, errors.Errorf("split backups aren't supported for %s", engine)
+		case o.Kind == dbcli.SchemaDump:
+			// There's no data to split the schema around
+		case o.Mask != nil:
+			return nil, errors.New("masked backups can't be split")
+		case j.Subset.Rules != "":
+			return nil, errors.New("subset backups can't be split")
+		case !store.Timestamped(o.BackupFormat):
+			// Parts of a later backup would be stored among those of an
+			// earlier one under the same prefix
+			return nil, errors.Errorf("split backups need a backup format down to the second, %s isn't", o.BackupFormat)
+		default:
+			o.Splitter, err = splitterFromJob(j)
+			if err != nil {
+				return nil, err
+			}
+			o.SplitParallel = j.Split.Parallel
+		}
+	}
+	o.SkipUnchangedSchema = j.SkipUnchangedSchema
+	if o.DiffSchema = j.DiffSchema; o.DiffSchema {
+		if o.Mode == physicalMode {
+			return nil, errors.New("schema diffs are only supported for logical backups")
+		}
+		if o.Kind == dbcli.DataDump {
+			return nil, errors.New("data backups have no schema to diff")
+		}
+		// Diffing reads both backups back from storage, which for full
+		// backups means the data as well
+		if o.Kind != dbcli.SchemaDump {
+			return nil, errors.New("schema diffs need schema backups, set the backup kind to schema")
+		}
+	}
+	for _, limit := range []struct {
+		s    string
+		rate *int64
+	}{
+		{j.Throttle.Dump, &o.DumpRate},
+		{j.Throttle.DBDump, &o.DBDumpRate},
+		{j.Throttle.Upload, &o.UploadRate},
+		{j.Throttle.DBUpload, &o.DBUploadRate},
+	} {
+		*limit.rate, err = parseRate(limit.s)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return o, nil
 }
 
 func (o *once) filename(database string) string {
 	name := store.Filename(database, o.BackupFormat)
+	if o.Splitter != nil {
+		// The prefix the parts are stored under
+		return name
+	}
+	return o.compressedName(name)
+}
+
+func (o *once) maskedFilename(database string) string {
+	return o.compressedName(store.Filename(database, o.MaskedBackupFormat))
+}
+
+func (o *once) compressedName(name string) string {
 	if !o.DisableCompression && !strings.HasSuffix(name, ".gz") {
 		name = name + ".gz"
 	}
 	return name
 }
 
-func (o *once) Backup(ctx context.Context) error {
-	dbs, err := o.Retriever.Retrieve(ctx)
-	if err != nil {
+// Validate checks the database server being backed up accepts connections
+func (o *once) Validate() error {
+	if o.Mode == physicalMode {
+		return o.BaseBackuper.Validate()
+	}
+	return o.Dumper.Validate()
+}
+
+// CheckPrivileges checks the user backups are taken as can read every
+// database that would be backed up, or take base backups in physical mode
+func (o *once) CheckPrivileges(ctx context.Context) error {
+	if o.Mode == physicalMode {
+		return db.CheckReplication(ctx, o.DSN)
+	}
+	found, err := o.Retriever.Retrieve(ctx)
+	var missingErr *db.MissingDatabasesError
+	if err != nil && !errors.As(err, &missingErr) {
 		return errors.Wrap(err, "failed to retrieve databases")
 	}
-	if len(dbs) == 0 {
-		log.Warn("No databases to backup")
-		return nil
+	var names []string
+	for _, d := range found {
+		if d.AllowConn {
+			names = append(names, d.Name)
+		}
+	}
+	return db.CheckPrivileges(ctx, o.DSN, names)
+}
+
+// CheckStorage checks backups can be written to and deleted from storage
+func (o *once) CheckStorage(ctx context.Context) error {
+	if o.ProbeStore != nil {
+		return store.Probe(ctx, o.ProbeStore)
 	}
-	log.WithField("dbs", strings.Join(dbs, ",")).Debug("Backing up databases")
+	return store.Probe(ctx, o.Store)
+}
 
-	return o.Pool.Start(ctx, dbs, func(cbCtx context.Context, db string) error {
-		filename := o.filename(db)
+// Backup runs a single backup and records it in the metrics. The returned
+// report describes what was backed up, even if the backup failed.
+func (o *once) Backup(ctx context.Context) (*report.Run, error) {
+	run := report.New()
+	err := o.backupRun(ctx, run)
+	observeRun(run)
+	return run, err
+}
 
-		log.WithFields(log.Fields{
-			"db":       db,
-			"filename": filename,
-		}).Debug("Starting database backup")
+// backupRun runs a single backup, recording its progress in run. It's up to
+// the caller to record the run in the metrics once it's done retrying.
+func (o *once) backupRun(ctx context.Context, run *report.Run) error {
+	ctx, span := tracer.Start(ctx, "backup run", trace.WithAttributes(
+		attribute.String("job", o.Job),
+		attribute.String("run.id", run.ID),
+		attribute.String("run.trigger", run.Trigger),
+	))
+	run.Update(func(r *report.Run) {
+		if r.Job == "" {
+			r.Job = o.Job
+		}
+		r.Kind = o.Kind
+		if sc := span.SpanContext(); sc.IsValid() {
+			r.TraceID = sc.TraceID().String()
+		}
+	})
+	err := o.backup(ctx, run)
+	if o.DiffSchema && ctx.Err() == nil {
+		o.diffSchemas(ctx, run)
+	}
+	run.Finish(err)
+
+	if err == nil && o.Retention > 0 {
+		if pErr := o.prune(ctx); pErr != nil {
+			log.WithContext(ctx).WithError(pErr).Error("Failed to remove expired backups")
+		}
+	}
+	endSpan(span, err)
+
+	log.WithContext(ctx).WithFields(log.Fields{
+		"job":       o.Job,
+		"databases": len(run.Databases),
+		"failed":    run.Failed(),
+		"missing":   strings.Join(run.Missing, ","),
+		"duration":  run.Finished.Sub(run.Started).String(),
+	}).Info("Backup run finished")
+
+	return err
+}
+
+// notify tells the notifiers about a finished run. Failing to notify is
+// logged rather than failing the run.
+func (o *once) notify(ctx context.Context, run *report.Run) {
+	for _, n := range o.Notifiers {
+		if err := n.Notify(ctx, run.Snapshot().Job, run); err != nil {
+			log.WithField("job", o.Job).WithError(err).Error("Failed to send notification")
+		}
+	}
+}
+
+func (o *once) backup(ctx context.Context, run *report.Run) error {
+	// Shared limits cover a single run, so each run starts with a full bucket
+	runLimits := limits{
+		dump:   throttle.NewLimiter(o.DumpRate),
+		upload: throttle.NewLimiter(o.UploadRate),
+	}
+
+	if o.Mode == physicalMode {
+		return o.physicalBackup(ctx, run, o.dbLimits(runLimits))
+	}
+
+	retrieveCtx, span := tracer.Start(ctx, "retrieve databases")
+	found, err := o.Retriever.Retrieve(retrieveCtx)
+	span.SetAttributes(attribute.Int("databases", len(found)))
+	var missingErr *db.MissingDatabasesError
+	spanErr := err
+	if errors.As(err, &missingErr) {
+		span.SetAttributes(attribute.StringSlice("missing", missingErr.DBs))
+		spanErr = nil
+	}
+	endSpan(span, spanErr)
+	if missingErr != nil {
+		run.Update(func(r *report.Run) { r.Missing = missingErr.DBs })
+		log.WithContext(ctx).WithField("missing", strings.Join(missingErr.DBs, ",")).Warn("Requested databases not found")
+	} else if err != nil {
+		return errors.Wrap(err, "failed to retrieve databases")
+	}
+
+	dbs := map[string]db.Database{}
+	var names []string
+	var items []pool.Item
+	var size int64
+	for _, d := range found {
+		if !d.AllowConn {
+			log.WithContext(ctx).WithFields(log.Fields{
+				"db":   d.Name,
+				"rule": "datallowconn",
+			}).Debug("Skipping database")
+			continue
+		}
+		dbs[d.Name] = d
+		names = append(names, d.Name)
+		items = append(items, pool.Item{Name: d.Name, Size: d.Size})
+		if d.Size > 0 {
+			size += d.Size
+		}
+		run.AddDatabase(report.Database{Name: d.Name, Size: d.Size, Status: report.StatusPending})
+	}
+
+	if len(names) == 0 {
+		log.WithContext(ctx).Warn("No databases to backup")
+	} else {
+		estimate := o.throughput.estimate(size)
+		run.Update(func(r *report.Run) {
+			r.Size = size
+			r.Estimate = estimate
+		})
+		log.WithContext(ctx).WithFields(log.Fields{
+			"dbs":      strings.Join(names, ","),
+			"size":     size,
+			"estimate": estimate.String(),
+		}).Debug("Backing up databases")
 
-		storeW, err := o.Store.Writer(cbCtx, filename)
+		err = o.Pool.Start(ctx, items, func(cbCtx context.Context, name string) error {
+			filename := o.filename(name)
+			cbCtx, span := tracer.Start(cbCtx, "backup database", trace.WithAttributes(
+				attribute.String("db.name", name),
+				attribute.String("filename", filename),
+			))
+			d := dbs[name]
+			result := report.Database{
+				Name:      name,
+				Filename:  filename,
+				Size:      d.Size,
+				Owner:     d.Owner,
+				Encoding:  d.Encoding,
+				Collation: d.Collation,
+				Status:    report.StatusRunning,
+				Started:   time.Now(),
+			}
+			if !d.LastActivity.IsZero() {
+				result.LastActivity = &d.LastActivity
+			}
+			run.AddDatabase(result)
+
+			log.WithContext(cbCtx).WithFields(log.Fields{
+				"db":       name,
+				"filename": filename,
+			}).Debug("Starting database backup")
+
+			progress := func(n int64) { run.AddWritten(name, n) }
+			l := o.dbLimits(runLimits)
+			dump := func(w io.Writer) error {
+				w = throttle.NewWriter(cbCtx, w, l.dump, l.dbDump)
+				return o.Dumper.Dump(cbCtx, name, w)
+			}
+			var uncompressed int64
+			var wErr error
+			switch {
+			case o.Splitter != nil:
+				result.Parts, uncompressed, wErr = o.writeSplit(cbCtx, name, filename, l, progress)
+			case o.Kind == dbcli.SchemaDump && o.SkipUnchangedSchema:
+				var previous string
+				uncompressed, previous, wErr = o.writeSchema(cbCtx, name, filename, l, progress, dump)
+				if previous != "" {
+					result.Filename = previous
+					result.Unchanged = true
+				}
+			case o.Mask == nil:
+				uncompressed, wErr = o.write(cbCtx, filename, l, progress, dump)
+			case o.MaskMode == maskInstead:
+				uncompressed, wErr = o.write(cbCtx, filename, l, progress, o.masked(name, dump))
+			default:
+				result.MaskedFilename = o.maskedFilename(name)
+				run.AddDatabase(result)
+				uncompressed, wErr = o.writeAlongside(cbCtx, filename, result.MaskedFilename, name, l, progress, dump)
+			}
+			result.Uncompressed = uncompressed
+			if wErr == nil {
+				log.WithContext(cbCtx).WithField("db", name).Debug("Database backup complete")
+				result.Status = report.StatusSucceeded
+			} else {
+				wErr = errors.Wrap(wErr, "dumping failed")
+				result.Error = wErr.Error()
+				result.Status = report.StatusFailed
+			}
+			result.Finished = time.Now()
+			run.AddDatabase(result)
+			endSpan(span, wErr)
+
+			return wErr
+		})
 		if err != nil {
-			return errors.Wrap(err, "failed to get main writer")
+			return err
 		}
 
-		var wErr error
-		if o.DisableCompression {
-			wErr = o.Dumper.Dump(cbCtx, db, storeW)
-		} else {
-			gzW := gzip.NewWriter(storeW)
-			wErr = o.Dumper.Dump(cbCtx, db, gzW)
-			if err := gzW.Close(); err != nil {
-				return errors.Wrap(err, "failed to close gzip writer")
+		o.throughput.record(size, time.Since(run.Started))
+	}
+
+	if missingErr != nil && o.StrictOnly {
+		return missingErr
+	}
+	return nil
+}
+
+// physicalBackup takes a base backup of the whole cluster and uploads it under
+// a common prefix: streamed as a single tar if BaseBackupStream is set, or
+// else staged in a directory and uploaded file by file.
+func (o *once) physicalBackup(ctx context.Context, run *report.Run, l limits) error {
+	prefix := store.Filename(o.BaseBackupHost, o.BaseBackupFormat)
+
+	log.WithFields(log.Fields{
+		"host":   o.BaseBackupHost,
+		"prefix": prefix,
+	}).Debug("Starting base backup")
+
+	result := report.Database{
+		Name:     o.BaseBackupHost,
+		Filename: prefix,
+		Status:   report.StatusRunning,
+		Started:  time.Now(),
+	}
+	run.AddDatabase(result)
+	defer func() {
+		result.Status = report.StatusSucceeded
+		if result.Error != "" {
+			result.Status = report.StatusFailed
+		}
+		result.Finished = time.Now()
+		run.AddDatabase(result)
+	}()
+
+	var err error
+	if o.BaseBackupStream {
+		result.Uncompressed, err = o.streamBaseBackup(ctx, run, prefix, l)
+	} else {
+		result.Uncompressed, err = o.stagedBaseBackup(ctx, run, prefix, l)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return err
+	}
+
+	log.WithField("prefix", prefix).Debug("Base backup complete")
+	return nil
+}
+
+// streamBaseBackup uploads a base backup as it's taken, as base.tar under
+// prefix. It returns the number of bytes uploaded, before compression.
+func (o *once) streamBaseBackup(ctx context.Context, run *report.Run, prefix string, l limits) (int64, error) {
+	filename := o.compressedName(path.Join(prefix, "base.tar"))
+	progress := func(n int64) { run.AddWritten(o.BaseBackupHost, n) }
+	return o.write(ctx, filename, l, progress, func(w io.Writer) error {
+		bbCtx, span := tracer.Start(ctx, "basebackup", trace.WithAttributes(attribute.String("host", o.BaseBackupHost)))
+		err := o.BaseBackuper.StreamBaseBackup(bbCtx, w)
+		endSpan(span, err)
+		return err
+	})
+}
+
+// stagedBaseBackup takes a base backup into a staging directory and uploads
+// each of the resulting files under prefix. It returns the number of bytes
+// uploaded, before compression.
+func (o *once) stagedBaseBackup(ctx context.Context, run *report.Run, prefix string, l limits) (int64, error) {
+	tmpDir, err := os.MkdirTemp(o.BaseBackupTmpDir, "sql-backup-")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create staging directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// pg_basebackup insists on creating the target directory itself
+	dir := filepath.Join(tmpDir, "base")
+	bbCtx, span := tracer.Start(ctx, "basebackup", trace.WithAttributes(attribute.String("host", o.BaseBackupHost)))
+	err = o.BaseBackuper.BaseBackup(bbCtx, dir)
+	endSpan(span, err)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read base backup")
+	}
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		filename := o.compressedName(path.Join(prefix, entry.Name()))
+		progress := func(n int64) { run.AddWritten(o.BaseBackupHost, n) }
+		uncompressed, err := o.write(ctx, filename, l, progress, func(w io.Writer) error {
+			f, err := os.Open(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
 			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		})
+		total += uncompressed
+		if err != nil {
+			return total, errors.Wrapf(err, "failed to upload %s", entry.Name())
 		}
+		log.WithField("filename", filename).Debug("Uploaded base backup file")
+	}
+	return total, nil
+}
 
-		if err := storeW.Close(); err != nil {
-			return errors.Wrap(err, "failed to close main writer")
+// prune deletes backups older than the retention period. The newest backup of
+// each database is always kept, however old it is. Backups are only pruned
+// after a successful run, so a failing job never eats into its history.
+func (o *once) prune(ctx context.Context) error {
+	formats := []string{o.backupFormat()}
+	if o.Mask != nil && o.MaskMode == maskAlongside {
+		formats = append(formats, o.MaskedBackupFormat)
+	}
+	for _, format := range formats {
+		if err := o.pruneFormat(ctx, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneFormat deletes the expired backups matching format
+func (o *once) pruneFormat(ctx context.Context, format string) error {
+	backups, err := o.storedBackups(ctx, format)
+	if err != nil {
+		return err
+	}
+	newest := newestBackups(backups)
+
+	cutoff := time.Now().Add(-o.Retention)
+	for _, b := range backups {
+		if newest[b.db] == b || !b.modTime.Before(cutoff) {
+			continue
+		}
+		for _, f := range b.files {
+			if err := o.Store.Delete(ctx, f); err != nil {
+				return errors.Wrapf(err, "failed to delete %s", f)
+			}
 		}
-		if wErr == nil {
-			log.WithField("db", db).Debug("Database backup complete")
+		log.WithFields(log.Fields{
+			"backup": b.name,
+			"age":    time.Since(b.modTime).Round(time.Second).String(),
+		}).Info("Removed expired backup")
+	}
+	return nil
+}
+
+// lastBackups returns when each database that would be backed up was last
+// backed up, going by what's in storage. Databases with no backup map to the
+// zero time.
+func (o *once) lastBackups(ctx context.Context) (map[string]time.Time, error) {
+	var names []string
+	if o.Mode == physicalMode {
+		names = []string{o.BaseBackupHost}
+	} else {
+		found, err := o.Retriever.Retrieve(ctx)
+		var missingErr *db.MissingDatabasesError
+		if err != nil && !errors.As(err, &missingErr) {
+			return nil, errors.Wrap(err, "failed to retrieve databases")
+		}
+		for _, d := range found {
+			if d.AllowConn {
+				names = append(names, d.Name)
+			}
+		}
+	}
+
+	backups, err := o.storedBackups(ctx, o.backupFormat())
+	if err != nil {
+		return nil, err
+	}
+	newest := newestBackups(backups)
+
+	last := map[string]time.Time{}
+	for _, name := range names {
+		if b, ok := newest[name]; ok {
+			last[name] = b.modTime
 		} else {
-			wErr = errors.Wrap(wErr, "dumping failed")
+			last[name] = time.Time{}
+		}
+	}
+	return last, nil
+}
+
+// storedBackup is every file under the name Filename generated for a backup.
+// It is as old as the newest of them.
+type storedBackup struct {
+	name    string
+	db      string
+	files   []string
+	modTime time.Time
+	// incomplete is set on the parts of a split backup with no index,
+	// which is either still being stored or failed and wasn't cleaned up.
+	// It's never the newest backup, but is pruned like any other.
+	incomplete bool
+}
+
+// backupFormat is the format backups are stored under in the job's mode
+func (o *once) backupFormat() string {
+	if o.Mode == physicalMode {
+		return o.BaseBackupFormat
+	}
+	return o.BackupFormat
+}
+
+// storedBackups lists the backups in storage matching format of the databases
+// the job selects
+func (o *once) storedBackups(ctx context.Context, format string) ([]*storedBackup, error) {
+	re, err := store.FilenamePattern(format)
+	if err != nil {
+		return nil, err
+	}
+
+	// Backups of other kinds are named after the same format, eg. %s.sql and
+	// %s.schema.sql, so the first would match the second for database
+	// x.schema without telling them apart
+	var others []*regexp.Regexp
+	for _, kind := range []string{dbcli.SchemaDump, dbcli.DataDump} {
+		other, err := store.FilenamePattern(store.KindFormat(format, kind))
+		if err != nil {
+			return nil, err
 		}
+		others = append(others, other)
+	}
 
-		return wErr
+	objects, err := o.Store.List(ctx, store.FilenamePrefix(format))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list backups")
+	}
+
+	var backups []*storedBackup
+	byName := map[string]*storedBackup{}
+	for _, obj := range objects {
+		m := re.FindStringSubmatch(obj.Name)
+		if m == nil || (o.Selects != nil && !o.Selects(m[re.SubexpIndex("db")])) || matchesAny(others, obj.Name) {
+			continue
+		}
+		name := m[re.SubexpIndex("backup")]
+		b, ok := byName[name]
+		if !ok {
+			b = &storedBackup{name: name, db: m[re.SubexpIndex("db")]}
+			byName[name] = b
+			backups = append(backups, b)
+		}
+		b.files = append(b.files, obj.Name)
+		if obj.ModTime.After(b.modTime) {
+			b.modTime = obj.ModTime
+		}
+	}
+	if o.Mode != physicalMode {
+		for _, b := range backups {
+			b.incomplete = incompleteSplit(b)
+		}
+	}
+	return backups, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, name string) bool {
+	for _, re := range patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newestBackups returns the newest complete backup of each database
+func newestBackups(backups []*storedBackup) map[string]*storedBackup {
+	newest := map[string]*storedBackup{}
+	for _, b := range backups {
+		if b.incomplete {
+			continue
+		}
+		if n, ok := newest[b.db]; !ok || b.modTime.After(n.modTime) {
+			newest[b.db] = b
+		}
+	}
+	return newest
+}
+
+// limits are the rate limiters of a run: those shared by every database and
+// those of the database being backed up. Nil limiters don't limit.
+type limits struct {
+	dump, upload     *rate.Limiter
+	dbDump, dbUpload *rate.Limiter
+}
+
+// dbLimits returns l with limiters of its own for another database
+func (o *once) dbLimits(l limits) limits {
+	l.dbDump = throttle.NewLimiter(o.DBDumpRate)
+	l.dbUpload = throttle.NewLimiter(o.DBUploadRate)
+	return l
+}
+
+// write stores the output of fn as filename, compressing it unless
+// compression has been disabled, with uploads limited by l. progress, if not
+// nil, is called with the number of bytes written to storage as they are
+// written. It returns the number of bytes fn wrote, before compression. If fn
+// fails the write is abandoned, so nothing is stored as filename.
+func (o *once) write(ctx context.Context, filename string, l limits, progress func(int64), fn func(w io.Writer) error) (int64, error) {
+	// The stages are pipelined, so each span covers the whole write and
+	// records the time spent on the stage's own work
+	uploadCtx, uploadSpan := tracer.Start(ctx, "upload", trace.WithAttributes(attribute.String("filename", filename)))
+	uploadCtx, abort := context.WithCancel(uploadCtx)
+	defer abort()
+	storeW, err := o.Store.Writer(uploadCtx, filename)
+	if err != nil {
+		err = errors.Wrap(err, "failed to get main writer")
+		endSpan(uploadSpan, err)
+		return 0, err
+	}
+	stored := &timedWriter{w: storeW}
+	uploadW := &timedWriter{w: throttle.NewWriter(ctx, progressWriter{stored, progress}, l.upload, l.dbUpload)}
+	// closeStore stores what was written, unless the write failed, in
+	// which case it's abandoned rather than stored truncated
+	closeStore := func(failed error) error {
+		uploadSpan.SetAttributes(attribute.Float64("throttled_seconds", (uploadW.busy - stored.busy).Seconds()))
+		if failed != nil {
+			abort()
+		}
+		start := time.Now()
+		err := storeW.Close()
+		stored.busy += time.Since(start)
+		uploadSpan.SetAttributes(stageAttributes(stored.n, stored.busy)...)
+		if failed != nil {
+			err = failed
+		}
+		endSpan(uploadSpan, err)
+		return err
+	}
+
+	dump := func(w io.Writer) (*timedWriter, error) {
+		_, span := tracer.Start(ctx, "dump")
+		start := time.Now()
+		dumped := &timedWriter{w: w}
+		err := fn(dumped)
+		span.SetAttributes(stageAttributes(dumped.n, time.Since(start)-dumped.busy)...)
+		endSpan(span, err)
+		return dumped, err
+	}
+
+	var dumped *timedWriter
+	var wErr error
+	if o.DisableCompression {
+		dumped, wErr = dump(uploadW)
+	} else {
+		_, compressSpan := tracer.Start(ctx, "compress")
+		gzW := gzip.NewWriter(uploadW)
+		dumped, wErr = dump(gzW)
+		start := time.Now()
+		err := gzW.Close()
+		compressBusy := dumped.busy + time.Since(start) - uploadW.busy
+		compressSpan.SetAttributes(stageAttributes(uploadW.n, compressBusy)...)
+		endSpan(compressSpan, err)
+		if err != nil && wErr == nil {
+			wErr = errors.Wrap(err, "failed to close gzip writer")
+		}
+	}
+
+	if wErr != nil {
+		closeStore(wErr)
+		return dumped.n, wErr
+	}
+	if err := closeStore(nil); err != nil {
+		return dumped.n, errors.Wrap(err, "failed to close main writer")
+	}
+	return dumped.n, nil
+}
+
+// writeSchema stores the schema fn dumps as filename, unless it is the same as
+// the newest schema backup of database in storage, which is rewritten in place
+// instead so its age says when the schema was last backed up. It returns the
+// number of bytes fn wrote and, if the upload was skipped, the name of that
+// backup.
+func (o *once) writeSchema(ctx context.Context, database, filename string, l limits, progress func(int64), fn func(w io.Writer) error) (int64, string, error) {
+	// Schemas are small enough to hold in memory while comparing them
+	var schema bytes.Buffer
+	if err := fn(&schema); err != nil {
+		return int64(schema.Len()), "", err
+	}
+
+	previous, digest, err := o.newestSchema(ctx, database)
+	if err != nil {
+		log.WithContext(ctx).WithField("db", database).WithError(err).Warn("Failed to read the previous schema backup, uploading")
+	} else if previous != "" && bytes.Equal(digest, schemaDigest(schema.Bytes())) {
+		err := o.touch(ctx, previous, l, progress)
+		if err == nil {
+			log.WithContext(ctx).WithFields(log.Fields{
+				"db":       database,
+				"previous": previous,
+			}).Debug("Schema unchanged, skipping upload")
+			return int64(schema.Len()), previous, nil
+		}
+		log.WithContext(ctx).WithField("db", database).WithError(err).Warn("Failed to refresh the previous schema backup, uploading")
+	}
+
+	n, err := o.write(ctx, filename, l, progress, func(w io.Writer) error {
+		_, err := w.Write(schema.Bytes())
+		return err
 	})
+	return n, "", err
+}
+
+// newestSchema returns the name and digest of the newest backup of database in
+// storage, or no name if there is none
+func (o *once) newestSchema(ctx context.Context, database string) (string, []byte, error) {
+	backups, err := o.storedBackups(ctx, o.BackupFormat)
+	if err != nil {
+		return "", nil, err
+	}
+	b, ok := newestBackups(backups)[database]
+	if !ok || len(b.files) != 1 {
+		return "", nil, nil
+	}
+	name := b.files[0]
+
+	r, err := o.openBackup(ctx, name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	schema, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to read %s", name)
+	}
+	return name, schemaDigest(schema), nil
+}
+
+// touch rewrites the stored file name as it is, so it's as new as a backup
+// just taken. Only meant for files small enough to hold in memory.
+func (o *once) touch(ctx context.Context, name string, l limits, progress func(int64)) error {
+	r, err := o.Store.Reader(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", name)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", name)
+	}
+
+	// A failed write is abandoned, leaving the file as it was
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	w, err := o.Store.Writer(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", name)
+	}
+	if _, err := throttle.NewWriter(ctx, progressWriter{w, progress}, l.upload, l.dbUpload).Write(data); err != nil {
+		abort()
+		w.Close()
+		return errors.Wrapf(err, "failed to write %s", name)
+	}
+	return errors.Wrapf(w.Close(), "failed to write %s", name)
+}
+
+// openBackup opens the stored backup file name, decompressing it if it's
+// gzipped
+func (o *once) openBackup(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := o.Store.Reader(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", name)
+	}
+	if !strings.HasSuffix(name, ".gz") {
+		return r, nil
+	}
+	gzR, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrapf(err, "failed to decompress %s", name)
+	}
+	return gzipReadCloser{gzR, r}, nil
+}
+
+// gzipReadCloser closes the file it decompresses along with itself
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (r gzipReadCloser) Close() error {
+	err := r.Reader.Close()
+	if fErr := r.file.Close(); err == nil {
+		err = fErr
+	}
+	return err
+}
+
+// schemaDigest hashes a schema dump, leaving out the \restrict and
+// \unrestrict lines recent versions of pg_dump add, whose keys are random
+func schemaDigest(schema []byte) []byte {
+	h := sha256.New()
+	for _, line := range bytes.SplitAfter(schema, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte(`\restrict `)) || bytes.HasPrefix(line, []byte(`\unrestrict `)) {
+			continue
+		}
+		h.Write(line)
+	}
+	return h.Sum(nil)
+}
+
+// masked returns fn with its output masked for database
+func (o *once) masked(database string, fn func(w io.Writer) error) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		mw := mask.NewWriter(w, o.Mask, database)
+		if err := fn(mw); err != nil {
+			return err
+		}
+		return mw.Close()
+	}
+}
+
+// writeAlongside stores the output of fn as filename and, masked for
+// database, as maskedFilename. fn is only run once, its output going to both.
+// progress is only told about the raw backup, which is what the run reports.
+// It returns the number of bytes fn wrote.
+func (o *once) writeAlongside(ctx context.Context, filename, maskedFilename, database string, l limits, progress func(int64), fn func(w io.Writer) error) (int64, error) {
+	pr, pw := io.Pipe()
+	maskedErr := make(chan error, 1)
+	go func() {
+		_, err := o.write(ctx, maskedFilename, l, nil, o.masked(database, func(w io.Writer) error {
+			_, err := io.Copy(w, pr)
+			return err
+		}))
+		// A failed masked backup mustn't fail the raw one, which may still
+		// be writing the rest of the dump
+		io.Copy(io.Discard, pr) // nolint:errcheck
+		maskedErr <- err
+	}()
+
+	n, err := o.write(ctx, filename, l, progress, func(w io.Writer) error {
+		err := fn(io.MultiWriter(w, pw))
+		pw.CloseWithError(err)
+		return err
+	})
+	// fn isn't run at all if storage couldn't be written to
+	pw.CloseWithError(err)
+	if mErr := <-maskedErr; err == nil && mErr != nil {
+		err = errors.Wrap(mErr, "masked backup failed")
+	}
+	return n, err
+}
+
+// progressWriter reports the number of bytes written through it
+type progressWriter struct {
+	w        io.Writer
+	progress func(int64)
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if w.progress != nil {
+		w.progress(int64(n))
+	}
+	return n, err
 }
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/mask"
+	"github.com/utilitywarehouse/sql-backup/internal/pool"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
 )
 
 func TestFilename(t *testing.T) {
@@ -44,3 +57,433 @@ func TestFilename(t *testing.T) {
 		assert.Equal(t, input.expected, filename)
 	}
 }
+
+func TestBackup_MissingDatabases(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		s := newMemStore()
+		o := &once{
+			Retriever: db.FilteredRetriever{
+				R:      stubRetriever{"users", "billing"},
+				Filter: db.OnlyFilterType,
+				DBs:    []string{"users", "bilings"},
+			},
+			Dumper:             stubDumper{},
+			Pool:               pool.SizablePool{Size: 1},
+			Store:              s,
+			BackupFormat:       "%s.sql",
+			DisableCompression: true,
+			StrictOnly:         strict,
+		}
+
+		run, err := o.Backup(context.Background())
+		if strict {
+			assert.Error(t, err)
+			assert.Equal(t, err.Error(), run.Error)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, []string{"bilings"}, run.Missing)
+		assert.Len(t, run.Databases, 1)
+		assert.Equal(t, "dump of users", string(s.objects["users.sql"]))
+	}
+}
+
+func TestBackup_Metadata(t *testing.T) {
+	s := newMemStore()
+	active := time.Now().Add(-time.Minute)
+	o := &once{
+		Retriever: metadataRetriever{
+			{Name: "users", Owner: "app", Encoding: "UTF8", Size: 1024, AllowConn: true, LastActivity: active},
+			{Name: "rdsadmin", Size: -1, AllowConn: false},
+		},
+		Dumper:             stubDumper{},
+		Pool:               pool.SizablePool{Size: 1},
+		Store:              s,
+		BackupFormat:       "%s.sql",
+		DisableCompression: true,
+	}
+
+	run, err := o.Backup(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), run.Size)
+	assert.Len(t, run.Databases, 1)
+	assert.Equal(t, "users", run.Databases[0].Name)
+	assert.Equal(t, "app", run.Databases[0].Owner)
+	assert.Equal(t, int64(1024), run.Databases[0].Size)
+	require.NotNil(t, run.Databases[0].LastActivity)
+	assert.Equal(t, active, *run.Databases[0].LastActivity)
+	assert.NotContains(t, s.objects, "rdsadmin.sql")
+}
+
+func TestThroughput(t *testing.T) {
+	var none *throughput
+	assert.Zero(t, none.estimate(1024))
+	none.record(1024, time.Second)
+
+	tp := &throughput{}
+	assert.Zero(t, tp.estimate(1024))
+	tp.record(1024, 2*time.Second)
+	assert.Equal(t, 4*time.Second, tp.estimate(2048))
+	// Nothing backed up says nothing about the rate
+	tp.record(0, time.Second)
+	assert.Equal(t, 4*time.Second, tp.estimate(2048))
+}
+
+type metadataRetriever []db.Database
+
+func (r metadataRetriever) Retrieve(ctx context.Context) ([]db.Database, error) {
+	return r, nil
+}
+
+type stubRetriever []string
+
+func (r stubRetriever) Retrieve(ctx context.Context) ([]db.Database, error) {
+	var dbs []db.Database
+	for _, name := range r {
+		dbs = append(dbs, db.Database{Name: name, AllowConn: true})
+	}
+	return dbs, nil
+}
+
+type stubDumper struct{}
+
+func (stubDumper) Validate() error {
+	return nil
+}
+
+func (stubDumper) Dump(ctx context.Context, db string, w io.Writer) error {
+	_, err := fmt.Fprintf(w, "dump of %s", db)
+	return err
+}
+
+// truncatedDumper fails part way through a dump
+type truncatedDumper struct{}
+
+func (truncatedDumper) Validate() error {
+	return nil
+}
+
+func (truncatedDumper) Dump(ctx context.Context, db string, w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "partial dump of %s", db); err != nil {
+		return err
+	}
+	return errors.New("connection reset")
+}
+
+func TestBackup_FailedDumpNotStored(t *testing.T) {
+	for _, disableCompression := range []bool{false, true} {
+		dir := t.TempDir()
+		o := &once{
+			Retriever:          stubRetriever{"users"},
+			Dumper:             truncatedDumper{},
+			Pool:               pool.SizablePool{Size: 1},
+			Store:              store.File{Dir: dir},
+			BackupFormat:       "%s.sql",
+			DisableCompression: disableCompression,
+		}
+		_, err := o.Backup(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection reset")
+
+		// Nothing is left to be taken for a backup, not even a temporary file
+		entries, err := os.ReadDir(dir)
+		require.Nil(t, err)
+		assert.Empty(t, entries)
+		last, err := o.lastBackups(context.Background())
+		require.Nil(t, err)
+		assert.True(t, last["users"].IsZero())
+	}
+}
+
+func TestBackup_Retention(t *testing.T) {
+	s := newMemStore()
+	old := time.Now().Add(-48 * time.Hour)
+	for name, modTime := range map[string]time.Time{
+		"users_2020-01-01.sql":   old,
+		"billing_2020-01-01.sql": old,
+		"users_old.sql":          old,
+		"unrelated.txt":          old,
+	} {
+		s.objects[name] = []byte("old dump")
+		s.modTimes[name] = modTime
+	}
+
+	o := &once{
+		Retriever:          stubRetriever{"users"},
+		Dumper:             stubDumper{},
+		Pool:               pool.SizablePool{Size: 1},
+		Store:              s,
+		BackupFormat:       "%s_2006-01-02.sql",
+		DisableCompression: true,
+		Retention:          24 * time.Hour,
+	}
+
+	_, err := o.Backup(context.Background())
+	assert.Nil(t, err)
+
+	// The old users backup has been superseded, but the old billing backup
+	// is still the newest one of billing
+	assert.NotContains(t, s.objects, "users_2020-01-01.sql")
+	assert.Contains(t, s.objects, "billing_2020-01-01.sql")
+	assert.Contains(t, s.objects, "users_old.sql")
+	assert.Contains(t, s.objects, "unrelated.txt")
+	assert.Len(t, s.objects, 4)
+}
+
+func TestBackup_RetentionSharedStore(t *testing.T) {
+	s := newMemStore()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{
+		"users_2020-01-01.sql",
+		"users_2020-01-02.sql",
+		"billing_2020-01-01.sql",
+		"billing_2020-01-02.sql",
+	} {
+		s.objects[name] = []byte("old dump")
+		s.modTimes[name] = old
+	}
+
+	job := func(name string) *once {
+		return &once{
+			Job:                name,
+			Retriever:          stubRetriever{name},
+			Selects:            func(db string) bool { return db == name },
+			Dumper:             stubDumper{},
+			Pool:               pool.SizablePool{Size: 1},
+			Store:              s,
+			BackupFormat:       "%s_2006-01-02.sql",
+			DisableCompression: true,
+			Retention:          24 * time.Hour,
+		}
+	}
+	users, billing := job("users"), job("billing")
+
+	_, err := users.Backup(context.Background())
+	require.Nil(t, err)
+
+	// The users job leaves the backups of billing, which it doesn't select,
+	// alone however old they are
+	assert.NotContains(t, s.objects, "users_2020-01-01.sql")
+	assert.NotContains(t, s.objects, "users_2020-01-02.sql")
+	assert.Contains(t, s.objects, "billing_2020-01-01.sql")
+	assert.Contains(t, s.objects, "billing_2020-01-02.sql")
+
+	_, err = billing.Backup(context.Background())
+	require.Nil(t, err)
+	assert.NotContains(t, s.objects, "billing_2020-01-01.sql")
+	assert.NotContains(t, s.objects, "billing_2020-01-02.sql")
+	assert.Len(t, s.objects, 2)
+}
+
+func TestBackup_RetentionOtherKinds(t *testing.T) {
+	s := newMemStore()
+	old := time.Now().Add(-48 * time.Hour)
+	names := []string{
+		"2020-01-01/users.schema.sql",
+		"2020-01-02/users.schema.sql",
+		"2020-01-01/users.data.sql",
+		"2020-01-02/users.data.sql",
+	}
+	for _, name := range names {
+		s.objects[name] = []byte("old dump")
+		s.modTimes[name] = old
+	}
+	o := &once{
+		Retriever:          stubRetriever{"users"},
+		Dumper:             stubDumper{},
+		Pool:               pool.SizablePool{Size: 1},
+		Store:              s,
+		BackupFormat:       "2006-01-02/%s.sql",
+		DisableCompression: true,
+		Retention:          24 * time.Hour,
+	}
+
+	// users.schema.sql looks like a full backup of the database
+	// users.schema, but isn't one
+	_, err := o.Backup(context.Background())
+	require.Nil(t, err)
+	for _, name := range names {
+		assert.Contains(t, s.objects, name)
+	}
+}
+
+type copyDumper struct{}
+
+func (copyDumper) Validate() error {
+	return nil
+}
+
+func (copyDumper) Dump(ctx context.Context, db string, w io.Writer) error {
+	_, err := io.WriteString(w, "COPY public.users (id, email) FROM stdin;\n1\tjane@example.org\n\\.\n")
+	return err
+}
+
+func TestBackup_Mask(t *testing.T) {
+	rules, err := mask.Load(strings.NewReader("tables: [{name: users, columns: {email: hash:8}}]"))
+	require.Nil(t, err)
+
+	for _, mode := range []string{maskAlongside, maskInstead} {
+		s := newMemStore()
+		o := &once{
+			Retriever:          stubRetriever{"users"},
+			Dumper:             copyDumper{},
+			Pool:               pool.SizablePool{Size: 1},
+			Store:              s,
+			BackupFormat:       "%s.sql",
+			DisableCompression: true,
+			Mask:               rules,
+			MaskMode:           mode,
+			MaskedBackupFormat: "%s.masked.sql",
+		}
+
+		run, err := o.Backup(context.Background())
+		require.Nil(t, err, mode)
+
+		masked := "users.masked.sql"
+		if mode == maskInstead {
+			masked = "users.sql"
+			assert.NotContains(t, s.objects, "users.masked.sql")
+		} else {
+			assert.Contains(t, string(s.objects["users.sql"]), "jane@example.org")
+			assert.Equal(t, masked, run.Databases[0].MaskedFilename)
+		}
+		// Only what's written of the backup itself is reported
+		assert.Equal(t, int64(len(s.objects["users.sql"])), run.Databases[0].Written, mode)
+		assert.Regexp(t, `(?m)^1\t[0-9a-f]{8}$`, string(s.objects[masked]), mode)
+		assert.NotContains(t, string(s.objects[masked]), "jane@example.org", mode)
+	}
+}
+
+func TestBackup_MaskMissingColumn(t *testing.T) {
+	rules, err := mask.Load(strings.NewReader("tables: [{name: users, columns: {mail: hash:8}}]"))
+	require.Nil(t, err)
+
+	s := newMemStore()
+	o := &once{
+		Retriever:          stubRetriever{"users"},
+		Dumper:             copyDumper{},
+		Pool:               pool.SizablePool{Size: 1},
+		Store:              s,
+		BackupFormat:       "%s.sql",
+		DisableCompression: true,
+		Mask:               rules,
+		MaskMode:           maskInstead,
+	}
+
+	_, err = o.Backup(context.Background())
+	assert.Error(t, err)
+	assert.NotContains(t, string(s.objects["users.sql"]), "jane@example.org")
+}
+
+// schemaDumper dumps a schema with a random \restrict key, like recent
+// versions of pg_dump
+type schemaDumper struct {
+	schema *string
+}
+
+func (schemaDumper) Validate() error {
+	return nil
+}
+
+func (d schemaDumper) Dump(ctx context.Context, db string, w io.Writer) error {
+	_, err := fmt.Fprintf(w, "\\restrict %d\n%s\n\\unrestrict %d\n", time.Now().UnixNano(), *d.schema, time.Now().UnixNano())
+	return err
+}
+
+func TestBackup_SkipUnchangedSchema(t *testing.T) {
+	s := newMemStore()
+	schema := "CREATE TABLE users (id int);"
+	o := &once{
+		Retriever:           stubRetriever{"users"},
+		Dumper:              schemaDumper{&schema},
+		Pool:                pool.SizablePool{Size: 1},
+		Store:               s,
+		Kind:                dbcli.SchemaDump,
+		SkipUnchangedSchema: true,
+		BackupFormat:        "%s_2006-01-02_150405.schema.sql",
+	}
+
+	run, err := o.Backup(context.Background())
+	require.Nil(t, err)
+	snapshot := run.Snapshot()
+	assert.Equal(t, "schema", snapshot.Kind)
+	assert.False(t, snapshot.Databases[0].Unchanged)
+	require.Len(t, s.objects, 1)
+	first := snapshot.Databases[0].Filename
+	s.modTimes[first] = time.Now().Add(-time.Hour)
+
+	// Only the \restrict keys differ
+	run, err = o.Backup(context.Background())
+	require.Nil(t, err)
+	snapshot = run.Snapshot()
+	assert.True(t, snapshot.Databases[0].Unchanged)
+	assert.Equal(t, first, snapshot.Databases[0].Filename)
+	require.Len(t, s.objects, 1)
+	// The previous backup is rewritten, so it's as fresh as this run
+	assert.WithinDuration(t, time.Now(), s.modTimes[first], time.Minute)
+	assert.Equal(t, int64(len(s.objects[first])), snapshot.Databases[0].Written)
+
+	schema = "CREATE TABLE users (id int, email text);"
+	run, err = o.Backup(context.Background())
+	require.Nil(t, err)
+	snapshot = run.Snapshot()
+	assert.False(t, snapshot.Databases[0].Unchanged)
+	assert.NotZero(t, snapshot.Databases[0].Written)
+}
+
+// stubBaseBackuper takes base backups of a tar and a manifest
+type stubBaseBackuper struct{}
+
+func (stubBaseBackuper) Validate() error {
+	return nil
+}
+
+func (stubBaseBackuper) BaseBackup(ctx context.Context, dir string) error {
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "base.tar"), []byte("base"), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "backup_manifest"), []byte("manifest"), 0o600)
+}
+
+func (stubBaseBackuper) StreamBaseBackup(ctx context.Context, w io.Writer) error {
+	_, err := io.WriteString(w, "base and manifest")
+	return err
+}
+
+func TestBackup_Physical(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		s := newMemStore()
+		o := &once{
+			Job:                "physical",
+			Mode:               physicalMode,
+			BaseBackuper:       stubBaseBackuper{},
+			BaseBackupHost:     "db.example.com",
+			BaseBackupFormat:   "%s_basebackup",
+			BaseBackupTmpDir:   t.TempDir(),
+			BaseBackupStream:   stream,
+			DisableCompression: true,
+			Store:              s,
+		}
+		run, err := o.Backup(context.Background())
+		require.Nil(t, err)
+		require.Len(t, run.Databases, 1)
+		assert.Equal(t, "db.example.com_basebackup", run.Databases[0].Filename)
+
+		if stream {
+			assert.Equal(t, map[string][]byte{
+				"db.example.com_basebackup/base.tar": []byte("base and manifest"),
+			}, s.objects)
+			assert.Equal(t, int64(17), run.Databases[0].Uncompressed)
+		} else {
+			assert.Equal(t, map[string][]byte{
+				"db.example.com_basebackup/base.tar":        []byte("base"),
+				"db.example.com_basebackup/backup_manifest": []byte("manifest"),
+			}, s.objects)
+			assert.Equal(t, int64(12), run.Databases[0].Uncompressed)
+		}
+		assert.Equal(t, report.StatusSucceeded, run.Databases[0].Status)
+	}
+}
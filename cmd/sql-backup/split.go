@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/pool"
+	"github.com/utilitywarehouse/sql-backup/internal/throttle"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// splitIndexName is the name, under the prefix of a split backup, of the
+// index describing its parts. It is written last, once every part is stored.
+const splitIndexName = "index.json"
+
+// splitIndex describes a split backup
+type splitIndex struct {
+	Database string    `json:"database"`
+	Kind     string    `json:"kind,omitempty"`
+	Created  time.Time `json:"created"`
+	// Parts are listed in restore order: the pre-data part, then the data
+	// parts, which can be restored in any order or in parallel, and then
+	// the post-data part
+	Parts []splitPart `json:"parts"`
+}
+
+// splitPart is a part of a split backup
+type splitPart struct {
+	// File is relative to the prefix the backup is stored under
+	File    string   `json:"file"`
+	Section string   `json:"section"`
+	Tables  []string `json:"tables,omitempty"`
+	// LargeObjects is set on the part holding the contents of the large
+	// objects
+	LargeObjects bool `json:"large_objects,omitempty"`
+	// Size is the size of the tables on disk
+	Size         int64 `json:"size,omitempty"`
+	Uncompressed int64 `json:"uncompressed"`
+}
+
+// writeSplit dumps database in parts, storing each under prefix along with an
+// index listing them in restore order. It returns the number of parts and the
+// number of bytes dumped, before compression. Every part is subject to the
+// limits of the database, l. The parts already stored are deleted if any
+// fails.
+func (o *once) writeSplit(ctx context.Context, database, prefix string, l limits, progress func(int64)) (int, int64, error) {
+	splitCtx, span := tracer.Start(ctx, "split")
+	split, err := o.Splitter.Split(splitCtx, database)
+	if err == nil {
+		span.SetAttributes(attribute.Int("parts", len(split.Parts())))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer split.Close()
+
+	parts := split.Parts()
+	index := splitIndex{
+		Database: database,
+		Kind:     o.Kind,
+		Created:  time.Now().UTC(),
+		Parts:    make([]splitPart, len(parts)),
+	}
+	byName := map[string]int{}
+	items := make([]pool.Item, len(parts))
+	for i, p := range parts {
+		byName[p.Name] = i
+		items[i] = pool.Item{Name: p.Name, Size: p.Size}
+		index.Parts[i] = splitPart{
+			File:         o.compressedName(p.Name + ".sql"),
+			Section:      p.Section,
+			Tables:       p.Tables,
+			LargeObjects: p.LargeObjects,
+			Size:         p.Size,
+		}
+	}
+
+	if len(items) > 0 {
+		parallel := pool.SizablePool{Size: o.SplitParallel, Strategy: pool.LargestFirst}
+		err = parallel.Start(ctx, items, func(partCtx context.Context, name string) error {
+			i := byName[name]
+			filename := path.Join(prefix, index.Parts[i].File)
+			n, err := o.write(partCtx, filename, l, progress, func(w io.Writer) error {
+				w = throttle.NewWriter(partCtx, w, l.dump, l.dbDump)
+				return split.DumpPart(partCtx, parts[i], w)
+			})
+			index.Parts[i].Uncompressed = n
+			if err != nil {
+				return errors.Wrapf(err, "part %s", name)
+			}
+			log.WithContext(partCtx).WithFields(log.Fields{
+				"db":       database,
+				"filename": filename,
+			}).Debug("Stored backup part")
+			return nil
+		})
+	}
+	var uncompressed int64
+	for _, p := range index.Parts {
+		uncompressed += p.Uncompressed
+	}
+	if err == nil {
+		err = o.writeSplitIndex(ctx, prefix, index)
+	}
+	if err != nil {
+		o.deleteSplit(ctx, prefix)
+		return len(parts), uncompressed, err
+	}
+	return len(parts), uncompressed, nil
+}
+
+// writeSplitIndex stores index under prefix, uncompressed so it's easy to read
+func (o *once) writeSplitIndex(ctx context.Context, prefix string, index splitIndex) error {
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := path.Join(prefix, splitIndexName)
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	w, err := o.Store.Writer(ctx, filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", filename)
+	}
+	if _, err := w.Write(b); err != nil {
+		abort()
+		w.Close()
+		return errors.Wrapf(err, "failed to write %s", filename)
+	}
+	return errors.Wrapf(w.Close(), "failed to write %s", filename)
+}
+
+// deleteSplit deletes the parts of a failed split backup, so they aren't
+// mistaken for a complete one. Failing to do so is logged.
+func (o *once) deleteSplit(ctx context.Context, prefix string) {
+	// The backup may have failed because ctx was cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	objects, err := o.Store.List(ctx, prefix+"/")
+	if err == nil {
+		for _, obj := range objects {
+			if err = o.Store.Delete(ctx, obj.Name); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.WithContext(ctx).WithField("prefix", prefix).WithError(err).Warn("Failed to delete the parts of a failed backup")
+	}
+}
+
+// readSplitIndex reads the index of a split backup
+func (o *once) readSplitIndex(ctx context.Context, filename string) (*splitIndex, error) {
+	r, err := o.Store.Reader(ctx, filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filename)
+	}
+	defer r.Close()
+	var index splitIndex
+	if err := json.NewDecoder(r).Decode(&index); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", filename)
+	}
+	return &index, nil
+}
+
+// splitIndexFile returns the index of b if it's a split backup
+func splitIndexFile(b *storedBackup) (string, bool) {
+	for _, f := range b.files {
+		if strings.HasSuffix(f, "/"+splitIndexName) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// incompleteSplit reports whether b is made of parts stored under its name but
+// has no index to say they are all there
+func incompleteSplit(b *storedBackup) bool {
+	if _, ok := splitIndexFile(b); ok {
+		return false
+	}
+	for _, f := range b.files {
+		if strings.HasPrefix(f, b.name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSchemaFiles returns the files of the split backup indexed by filename
+// that hold its schema, in restore order
+func (o *once) splitSchemaFiles(ctx context.Context, filename string) ([]string, error) {
+	index, err := o.readSplitIndex(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, p := range index.Parts {
+		if p.Section != dbcli.Data {
+			files = append(files, path.Join(path.Dir(filename), p.File))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/dbcli"
+	"github.com/utilitywarehouse/sql-backup/internal/pool"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+	"github.com/utilitywarehouse/sql-backup/internal/schema"
+)
+
+// stubSplitter splits databases into a part per table, failing to dump the
+// table named fail
+type stubSplitter struct {
+	schema string
+	tables []string
+	fail   string
+}
+
+func (s stubSplitter) Split(ctx context.Context, database string) (dbcli.Split, error) {
+	parts := []dbcli.Part{{Name: dbcli.PreData, Section: dbcli.PreData}}
+	for i, t := range s.tables {
+		parts = append(parts, dbcli.Part{Name: fmt.Sprintf("data/%04d", i+1), Section: dbcli.Data, Tables: []string{t}, Size: int64(i)})
+	}
+	parts = append(parts, dbcli.Part{Name: dbcli.PostData, Section: dbcli.PostData})
+	return stubSplit{s, parts}, nil
+}
+
+type stubSplit struct {
+	s     stubSplitter
+	parts []dbcli.Part
+}
+
+func (s stubSplit) Parts() []dbcli.Part {
+	return s.parts
+}
+
+func (s stubSplit) DumpPart(ctx context.Context, p dbcli.Part, w io.Writer) error {
+	if p.Section == dbcli.PreData {
+		_, err := io.WriteString(w, s.s.schema)
+		return err
+	}
+	for _, t := range p.Tables {
+		if t == s.s.fail {
+			return errors.New("table locked")
+		}
+		if _, err := fmt.Fprintf(w, "COPY %s FROM stdin;\n\\.\n", t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s stubSplit) Close() error {
+	return nil
+}
+
+func TestBackup_Split(t *testing.T) {
+	s := newMemStore()
+	o := &once{
+		Job:           "split",
+		Retriever:     stubRetriever{"users"},
+		Pool:          pool.SizablePool{Size: 1},
+		Store:         s,
+		Splitter:      stubSplitter{schema: usersTable, tables: []string{"public.users", "public.audit"}},
+		SplitParallel: 2,
+		BackupFormat:  "%s_2006-01-02_150405.sql",
+	}
+	run, err := o.Backup(context.Background())
+	require.Nil(t, err)
+	require.Len(t, run.Databases, 1)
+	result := run.Databases[0]
+	assert.Equal(t, report.StatusSucceeded, result.Status)
+	assert.Equal(t, 4, result.Parts)
+
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	prefix := result.Filename
+	assert.Equal(t, []string{
+		prefix + "/data/0001.sql.gz",
+		prefix + "/data/0002.sql.gz",
+		prefix + "/index.json",
+		prefix + "/post-data.sql.gz",
+		prefix + "/pre-data.sql.gz",
+	}, names)
+
+	var index splitIndex
+	require.Nil(t, json.Unmarshal(s.objects[prefix+"/index.json"], &index))
+	assert.Equal(t, "users", index.Database)
+	var files []string
+	var uncompressed int64
+	for _, p := range index.Parts {
+		files = append(files, p.File)
+		uncompressed += p.Uncompressed
+	}
+	assert.Equal(t, []string{"pre-data.sql.gz", "data/0001.sql.gz", "data/0002.sql.gz", "post-data.sql.gz"}, files)
+	assert.Equal(t, []string{"public.audit"}, index.Parts[2].Tables)
+	assert.Equal(t, result.Uncompressed, uncompressed)
+
+	// The whole prefix is a single backup, whose schema can be diffed
+	backups, err := o.storedBackups(context.Background(), o.BackupFormat)
+	require.Nil(t, err)
+	require.Len(t, backups, 1)
+	sch, err := o.readSchema(context.Background(), backups[0])
+	require.Nil(t, err)
+	want, err := schema.Parse(strings.NewReader(usersTable))
+	require.Nil(t, err)
+	assert.Empty(t, schema.Compare(want, sch))
+}
+
+func TestBackup_SplitFailure(t *testing.T) {
+	s := newMemStore()
+	o := &once{
+		Job:           "split",
+		Retriever:     stubRetriever{"users"},
+		Pool:          pool.SizablePool{Size: 1},
+		Store:         s,
+		Splitter:      stubSplitter{schema: usersTable, tables: []string{"public.users", "public.audit"}, fail: "public.audit"},
+		SplitParallel: 1,
+		BackupFormat:  "%s_2006-01-02_150405.sql",
+	}
+	run, err := o.Backup(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "table locked")
+	assert.Equal(t, report.StatusFailed, run.Databases[0].Status)
+	// No parts are left behind to be taken for a backup
+	assert.Empty(t, s.objects)
+}
+
+func TestSchemaDrifts_Split(t *testing.T) {
+	s := newMemStore()
+	o := &once{
+		Job:           "split",
+		Retriever:     stubRetriever{"users"},
+		Pool:          pool.SizablePool{Size: 1},
+		Store:         s,
+		Splitter:      stubSplitter{schema: usersTable, tables: []string{"public.users"}},
+		SplitParallel: 1,
+		BackupFormat:  "%s_2006-01-02_150405.000000000.sql",
+	}
+	_, err := o.Backup(context.Background())
+	require.Nil(t, err)
+	// Backdate the first backup, so it's the older one
+	for name := range s.objects {
+		s.modTimes[name] = time.Now().Add(-time.Hour)
+	}
+	o.Splitter = stubSplitter{schema: usersTable[:len(usersTable)-4] + ",\n    email text\n);\n", tables: []string{"public.users"}}
+	_, err = o.Backup(context.Background())
+	require.Nil(t, err)
+
+	drifts, err := o.schemaDrifts(context.Background(), func(string) bool { return true })
+	require.Nil(t, err)
+	require.Len(t, drifts, 1)
+	require.Len(t, drifts[0].Changes, 1)
+	assert.Equal(t, "public.users.email", drifts[0].Changes[0].Name)
+}
+
+func TestStoredBackups_SplitIncomplete(t *testing.T) {
+	s := newMemStore()
+	o := &once{
+		Retriever:    stubRetriever{"users"},
+		Store:        s,
+		BackupFormat: "%s_2006-01-02_150405.sql",
+		Retention:    24 * time.Hour,
+	}
+	now := time.Now()
+	for name, modTime := range map[string]time.Time{
+		// Complete, but past retention
+		"users_2024-03-01_120000.sql/pre-data.sql.gz": now.Add(-48 * time.Hour),
+		"users_2024-03-01_120000.sql/index.json":      now.Add(-48 * time.Hour),
+		// Failed and left behind
+		"users_2024-02-28_120000.sql/pre-data.sql.gz": now.Add(-72 * time.Hour),
+		// Still being stored
+		"users_2024-03-02_120000.sql/pre-data.sql.gz": now.Add(-time.Hour),
+	} {
+		s.objects[name] = []byte("dump")
+		s.modTimes[name] = modTime
+	}
+
+	last, err := o.lastBackups(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, now.Add(-48*time.Hour), last["users"])
+
+	require.Nil(t, o.pruneFormat(context.Background(), o.BackupFormat))
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{
+		"users_2024-03-01_120000.sql/index.json",
+		"users_2024-03-01_120000.sql/pre-data.sql.gz",
+		"users_2024-03-02_120000.sql/pre-data.sql.gz",
+	}, names)
+
+	drifts, err := o.schemaDrifts(context.Background(), func(string) bool { return true })
+	require.Nil(t, err)
+	require.Len(t, drifts, 1)
+	assert.Equal(t, "users_2024-03-01_120000.sql", drifts[0].After)
+}
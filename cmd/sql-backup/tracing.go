@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	noTracing     = "none"
+	otlpTracing   = "otlp"
+	stdoutTracing = "stdout"
+)
+
+// tracer starts the spans of backups. Until setupTracing installs a
+// provider they are no-ops.
+var tracer = otel.Tracer("github.com/utilitywarehouse/sql-backup")
+
+// setupTracing installs the exporter chosen by --tracing-exporter. The
+// returned func flushes spans not yet exported.
+func setupTracing(c *cli.Context) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.GlobalString("tracing-exporter") {
+	case noTracing, "":
+		return func(context.Context) error { return nil }, nil
+	case otlpTracing:
+		// Configured by the standard OTEL_EXPORTER_OTLP_* variables
+		exporter, err = otlptracehttp.New(context.Background())
+	case stdoutTracing:
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", c.GlobalString("tracing-exporter"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(c.App.Name),
+		semconv.ServiceVersion(c.App.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	log.AddHook(traceHook{})
+	return provider.Shutdown, nil
+}
+
+// traceHook adds the ids of the span in a log entry's context to its fields,
+// so log lines can be matched up with traces
+type traceHook struct{}
+
+func (traceHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (traceHook) Fire(e *log.Entry) error {
+	if e.Context == nil {
+		return nil
+	}
+	sc := trace.SpanContextFromContext(e.Context)
+	if !sc.IsValid() {
+		return nil
+	}
+	e.Data["trace_id"] = sc.TraceID().String()
+	e.Data["span_id"] = sc.SpanID().String()
+	return nil
+}
+
+// endSpan ends span, recording err if there was one
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// timedWriter records the bytes written through it and the time spent
+// writing them, ie. waiting on w
+type timedWriter struct {
+	w    io.Writer
+	n    int64
+	busy time.Duration
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.w.Write(p)
+	w.busy += time.Since(start)
+	w.n += int64(n)
+	return n, err
+}
+
+// stageAttributes are the attributes of a span covering a stage of a
+// pipeline: the bytes it produced and the time spent on its own work, rather
+// than waiting on the stages after it
+func stageAttributes(n int64, busy time.Duration) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int64("bytes", n),
+		attribute.Float64("busy_seconds", busy.Seconds()),
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/pool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestBackup_Traced(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	// tracer delegates to the first provider set, so this is the only test
+	// that sets one
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	o := &once{
+		Job:          "traced",
+		Retriever:    stubRetriever{"users"},
+		Dumper:       stubDumper{},
+		Pool:         pool.SizablePool{Size: 1},
+		Store:        newMemStore(),
+		BackupFormat: "%s.sql",
+	}
+	run, err := o.Backup(context.Background())
+	require.Nil(t, err)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+	}
+	for _, name := range []string{"backup run", "retrieve databases", "backup database", "dump", "compress", "upload"} {
+		require.Contains(t, spans, name)
+		assert.Equal(t, run.TraceID, spans[name].SpanContext.TraceID().String(), name)
+	}
+	assert.Equal(t, spans["backup database"].SpanContext.SpanID(), spans["dump"].Parent.SpanID())
+	assert.Contains(t, spans["dump"].Attributes, attribute.Int64("bytes", int64(len("dump of users"))))
+	assert.Contains(t, spans["compress"].Attributes, attribute.Int64("bytes", run.Databases[0].Written))
+	assert.Contains(t, spans["upload"].Attributes, attribute.Int64("bytes", run.Databases[0].Written))
+}
+
+func TestTraceHook(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "test")
+	defer span.End()
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(traceHook{})
+
+	logger.WithContext(ctx).Info("traced")
+	assert.Contains(t, buf.String(), `"trace_id":"`+span.SpanContext().TraceID().String()+`"`)
+
+	buf.Reset()
+	logger.Info("not traced")
+	assert.NotContains(t, buf.String(), "trace_id")
+}
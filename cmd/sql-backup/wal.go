@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"github.com/utilitywarehouse/sql-backup/internal/encrypt"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+var errSegmentNotFound = errors.New("wal segment not found")
+
+// ArchiveWALCmd uploads a single WAL segment. It is intended to be used as
+// the postgres archive_command, eg. `sql-backup archive-wal %p %f`
+type ArchiveWALCmd struct{}
+
+// Run archives the WAL segment at path under name
+func (cmd *ArchiveWALCmd) Run(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.New("usage: archive-wal <path> <name>")
+	}
+	segmentPath, name := c.Args().Get(0), c.Args().Get(1)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	a, err := walArchiveFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(segmentPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to read wal segment")
+	}
+
+	return a.Archive(ctx, name, data)
+}
+
+// RestoreWALCmd downloads a single WAL segment. It is intended to be used as
+// the postgres restore_command, eg. `sql-backup restore-wal %f %p`
+type RestoreWALCmd struct{}
+
+// Run restores the WAL segment name to path
+func (cmd *RestoreWALCmd) Run(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.New("usage: restore-wal <name> <path>")
+	}
+	name, segmentPath := c.Args().Get(0), c.Args().Get(1)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	a, err := walArchiveFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := a.Restore(ctx, name)
+	if err == errSegmentNotFound {
+		// Postgres asks for segments that were never archived as part of
+		// normal recovery, so this isn't worth more than a non-zero exit
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(segmentPath, data, 0600)
+}
+
+type walArchive struct {
+	Store              store.Storer
+	Prefix             string
+	DisableCompression bool
+	Key                []byte
+}
+
+func walArchiveFromFlags(c *cli.Context) (*walArchive, error) {
+	a := &walArchive{
+		Store:              storerFromFlags(c),
+		Prefix:             c.String("wal-prefix"),
+		DisableCompression: c.GlobalBool("disable-compression"),
+	}
+	if key := c.String("wal-encryption-key"); key != "" {
+		var err error
+		a.Key, err = encrypt.ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// objectName is where the segment name is stored. The suffixes reflect how
+// the segment was encoded so archives with different settings don't collide.
+func (a *walArchive) objectName(name string) string {
+	name = path.Join(a.Prefix, name)
+	if !a.DisableCompression {
+		name = name + ".gz"
+	}
+	if a.Key != nil {
+		name = name + ".enc"
+	}
+	return name
+}
+
+func (a *walArchive) checksumName(name string) string {
+	return path.Join(a.Prefix, name) + ".sha256"
+}
+
+// Archive stores data as the WAL segment name, along with a checksum of the
+// stored object. Archiving the same segment twice is a no-op, but archiving
+// different contents under an existing name fails.
+func (a *walArchive) Archive(ctx context.Context, name string, data []byte) error {
+	logger := log.WithField("segment", name)
+
+	exists, err := a.Store.Exists(ctx, a.objectName(name))
+	if err != nil {
+		return errors.Wrap(err, "failed to check for existing segment")
+	}
+	if exists {
+		archived, err := a.archived(ctx, name, data)
+		if err != nil {
+			return err
+		}
+		if archived {
+			logger.Info("WAL segment already archived")
+			return nil
+		}
+	}
+
+	encoded, err := a.encode(data)
+	if err != nil {
+		return err
+	}
+	if err := a.writeObject(ctx, a.objectName(name), encoded); err != nil {
+		return errors.Wrap(err, "failed to upload wal segment")
+	}
+	if err := a.writeObject(ctx, a.checksumName(name), []byte(sha256Hex(encoded))); err != nil {
+		return errors.Wrap(err, "failed to upload wal segment checksum")
+	}
+
+	logger.WithField("checksum", sha256Hex(encoded)).Info("WAL segment archived")
+	return nil
+}
+
+// archived reports whether the segment name is already archived with data as
+// its contents, failing if it's archived with different contents. The
+// checksum is written last, so a segment without one is what an interrupted
+// attempt left behind, and is archived again if it can't be read back.
+func (a *walArchive) archived(ctx context.Context, name string, data []byte) (bool, error) {
+	hasChecksum, err := a.Store.Exists(ctx, a.checksumName(name))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check for segment checksum")
+	}
+	encoded, err := a.readObject(ctx, a.objectName(name))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to download wal segment")
+	}
+	existing, err := a.decode(encoded)
+	switch {
+	case err != nil && hasChecksum:
+		return false, err
+	case err != nil:
+		log.WithField("segment", name).WithError(err).Warn("Archived WAL segment is unreadable, archiving it again")
+		return false, nil
+	case !bytes.Equal(existing, data):
+		return false, errors.Errorf("wal segment %s already archived with different contents", name)
+	case !hasChecksum:
+		// The checksum may be what was missing from the last attempt
+		if err := a.writeObject(ctx, a.checksumName(name), []byte(sha256Hex(encoded))); err != nil {
+			return false, errors.Wrap(err, "failed to upload wal segment checksum")
+		}
+	}
+	return true, nil
+}
+
+// Restore fetches the WAL segment name, verifying it against its checksum
+func (a *walArchive) Restore(ctx context.Context, name string) ([]byte, error) {
+	exists, err := a.Store.Exists(ctx, a.objectName(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check for segment")
+	}
+	if !exists {
+		return nil, errSegmentNotFound
+	}
+
+	encoded, err := a.readObject(ctx, a.objectName(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to download wal segment")
+	}
+	data, err := a.decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err = a.Store.Exists(ctx, a.checksumName(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check for segment checksum")
+	}
+	if exists {
+		checksum, err := a.readObject(ctx, a.checksumName(name))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read segment checksum")
+		}
+		if strings.TrimSpace(string(checksum)) != sha256Hex(encoded) {
+			return nil, errors.Errorf("wal segment %s does not match its checksum", name)
+		}
+	} else {
+		log.WithField("segment", name).Warn("WAL segment has no checksum, skipping verification")
+	}
+
+	log.WithField("segment", name).Info("WAL segment restored")
+	return data, nil
+}
+
+func (a *walArchive) encode(data []byte) ([]byte, error) {
+	if !a.DisableCompression {
+		buf := &bytes.Buffer{}
+		gzW := gzip.NewWriter(buf)
+		if _, err := gzW.Write(data); err != nil {
+			return nil, errors.Wrap(err, "failed to compress wal segment")
+		}
+		if err := gzW.Close(); err != nil {
+			return nil, errors.Wrap(err, "failed to close gzip writer")
+		}
+		data = buf.Bytes()
+	}
+	if a.Key != nil {
+		return encrypt.Encrypt(a.Key, data)
+	}
+	return data, nil
+}
+
+func (a *walArchive) decode(data []byte) ([]byte, error) {
+	var err error
+	if a.Key != nil {
+		data, err = encrypt.Decrypt(a.Key, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !a.DisableCompression {
+		gzR, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress wal segment")
+		}
+		defer gzR.Close()
+		data, err = io.ReadAll(gzR)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress wal segment")
+		}
+	}
+	return data, nil
+}
+
+func (a *walArchive) readObject(ctx context.Context, name string) ([]byte, error) {
+	r, err := a.Store.Reader(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (a *walArchive) writeObject(ctx context.Context, name string, data []byte) error {
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	w, err := a.Store.Writer(ctx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		abort()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/sql-backup/internal/encrypt"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+func TestWALArchive_RoundTrip(t *testing.T) {
+	inputs := []struct {
+		disableCompression bool
+		key                []byte
+		expectedObject     string
+	}{
+		{false, nil, "wal/000000010000000000000001.gz"},
+		{true, nil, "wal/000000010000000000000001"},
+		{false, bytes.Repeat([]byte{0x01}, encrypt.KeySize), "wal/000000010000000000000001.gz.enc"},
+	}
+
+	for _, input := range inputs {
+		s := newMemStore()
+		a := &walArchive{
+			Store:              s,
+			Prefix:             "wal",
+			DisableCompression: input.disableCompression,
+			Key:                input.key,
+		}
+		segment := []byte("segment contents")
+
+		assert.Nil(t, a.Archive(context.Background(), "000000010000000000000001", segment))
+		assert.Contains(t, s.objects, input.expectedObject)
+		assert.Contains(t, s.objects, "wal/000000010000000000000001.sha256")
+
+		restored, err := a.Restore(context.Background(), "000000010000000000000001")
+		assert.Nil(t, err)
+		assert.Equal(t, segment, restored)
+	}
+}
+
+func TestWALArchive_Idempotent(t *testing.T) {
+	a := &walArchive{Store: newMemStore(), Prefix: "wal"}
+	segment := []byte("segment contents")
+
+	assert.Nil(t, a.Archive(context.Background(), "000000010000000000000001", segment))
+	assert.Nil(t, a.Archive(context.Background(), "000000010000000000000001", segment))
+}
+
+func TestWALArchive_RefusesDifferentContents(t *testing.T) {
+	a := &walArchive{Store: newMemStore(), Prefix: "wal"}
+
+	assert.Nil(t, a.Archive(context.Background(), "000000010000000000000001", []byte("one")))
+	assert.Error(t, a.Archive(context.Background(), "000000010000000000000001", []byte("two")))
+
+	restored, err := a.Restore(context.Background(), "000000010000000000000001")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("one"), restored)
+}
+
+func TestWALArchive_ReplacesInterruptedUpload(t *testing.T) {
+	s := newMemStore()
+	a := &walArchive{Store: s, Prefix: "wal"}
+	// A truncated segment, with no checksum as the upload never finished
+	s.objects["wal/000000010000000000000001.gz"] = []byte{0x1f}
+
+	assert.Nil(t, a.Archive(context.Background(), "000000010000000000000001", []byte("one")))
+	restored, err := a.Restore(context.Background(), "000000010000000000000001")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("one"), restored)
+}
+
+func TestWALArchive_ChecksumsStoredObject(t *testing.T) {
+	s := newMemStore()
+	key := bytes.Repeat([]byte{0x01}, encrypt.KeySize)
+	a := &walArchive{Store: s, Prefix: "wal", Key: key}
+	segment := []byte("segment contents")
+
+	assert.Nil(t, a.Archive(context.Background(), "000000010000000000000001", segment))
+	// The checksum says nothing about the contents of encrypted segments
+	assert.Equal(t, sha256Hex(s.objects["wal/000000010000000000000001.gz.enc"]), string(s.objects["wal/000000010000000000000001.sha256"]))
+	assert.NotEqual(t, sha256Hex(segment), string(s.objects["wal/000000010000000000000001.sha256"]))
+	// Archiving again is a no-op despite the random nonce
+	assert.Nil(t, a.Archive(context.Background(), "000000010000000000000001", segment))
+}
+
+func TestWALArchive_RestoreMissing(t *testing.T) {
+	a := &walArchive{Store: newMemStore(), Prefix: "wal"}
+
+	_, err := a.Restore(context.Background(), "00000002.history")
+	assert.Equal(t, errSegmentNotFound, err)
+}
+
+// memStore is an in memory store.Storer
+type memStore struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modTimes map[string]time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: map[string][]byte{}, modTimes: map[string]time.Time{}}
+}
+
+func (s *memStore) Writer(ctx context.Context, filename string) (io.WriteCloser, error) {
+	return &memWriter{s: s, ctx: ctx, name: filename}, nil
+}
+
+func (s *memStore) Reader(ctx context.Context, filename string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStore) Exists(ctx context.Context, filename string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[filename]
+	return ok, nil
+}
+
+func (s *memStore) List(ctx context.Context, prefix string) ([]store.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []store.Object
+	for name, data := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, store.Object{Name: name, Size: int64(len(data)), ModTime: s.modTimes[name]})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (s *memStore) Delete(ctx context.Context, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[filename]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.objects, filename)
+	delete(s.modTimes, filename)
+	return nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	s    *memStore
+	ctx  context.Context
+	name string
+}
+
+func (w *memWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.s.objects[w.name] = w.Bytes()
+	w.s.modTimes[w.name] = time.Now()
+	return nil
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxReported is how many unreadable objects a failed privilege check lists
+const maxReported = 5
+
+// Ping opens an authenticated connection to the database dsn points at
+func Ping(ctx context.Context, dsn string) error {
+	conn, err := open(dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.PingContext(ctx); err != nil {
+		return errors.Wrap(err, "failed to connect")
+	}
+	return nil
+}
+
+// unreadableQuery lists the tables, views and sequences in a database that
+// the current user can't read, which pg_dump would fail on
+const unreadableQuery = `
+SELECT n.nspname || '.' || c.relname
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p', 'v', 'm', 'S')
+AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+AND n.nspname NOT LIKE 'pg_toast%'
+AND NOT (has_schema_privilege(n.oid, 'USAGE') AND has_table_privilege(c.oid, 'SELECT'))
+ORDER BY 1
+LIMIT $1`
+
+// CheckPrivileges checks that the user dsn authenticates as can connect to
+// each of databases and read everything in them
+func CheckPrivileges(ctx context.Context, dsn string, databases []string) error {
+	var problems []string
+	for _, name := range databases {
+		unreadable, err := unreadableObjects(ctx, dsn, name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if len(unreadable) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: can't read %s", name, strings.Join(unreadable, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("insufficient privileges: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func unreadableObjects(ctx context.Context, dsn, database string) ([]string, error) {
+	conn, err := Open(dsn, database)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Connecting at all needs the CONNECT privilege
+	rows, err := conn.QueryContext(ctx, unreadableQuery, maxReported)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var unreadable []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		unreadable = append(unreadable, name)
+	}
+	return unreadable, rows.Err()
+}
+
+// CheckReplication checks that the user dsn authenticates as may take base
+// backups
+func CheckReplication(ctx context.Context, dsn string) error {
+	conn, err := open(dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var ok bool
+	err = conn.QueryRowContext(ctx, "SELECT rolreplication OR rolsuper FROM pg_roles WHERE rolname = current_user").Scan(&ok)
+	if err != nil {
+		return errors.Wrap(err, "failed to check replication privilege")
+	}
+	if !ok {
+		return errors.New("insufficient privileges: user lacks the REPLICATION attribute")
+	}
+	return nil
+}
+
+// Open returns a connection pool to database on the server dsn points at
+func Open(dsn, database string) (*sql.DB, error) {
+	u, err := dsnURL(dsn)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + database
+	return sql.Open("postgres", u.String())
+}
+
+func open(dsn string) (*sql.DB, error) {
+	u, err := dsnURL(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("postgres", u.String())
+}
+
+func dsnURL(dsn string) (*url.URL, error) {
+	if !strings.HasPrefix(dsn, "postgresql://") {
+		dsn = "postgresql://" + dsn
+	}
+	return url.Parse(dsn)
+}
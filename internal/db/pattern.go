@@ -0,0 +1,94 @@
+package db
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pattern matches database names. Patterns wrapped in slashes, eg.
+// `/^tenant_[0-9]+$/`, are regular expressions. Patterns containing any of
+// `*?[` are globs, eg. `tenant_*`. Anything else must match exactly.
+type pattern struct {
+	raw  string
+	re   *regexp.Regexp
+	glob bool
+}
+
+func compilePattern(raw string) (pattern, error) {
+	p := pattern{raw: raw}
+	switch {
+	case len(raw) > 1 && strings.HasPrefix(raw, "/") && strings.HasSuffix(raw, "/"):
+		re, err := regexp.Compile(raw[1 : len(raw)-1])
+		if err != nil {
+			return p, errors.Wrapf(err, "invalid database pattern %q", raw)
+		}
+		p.re = re
+	case strings.ContainsAny(raw, "*?["):
+		if _, err := path.Match(raw, ""); err != nil {
+			return p, errors.Wrapf(err, "invalid database pattern %q", raw)
+		}
+		p.glob = true
+	}
+	return p, nil
+}
+
+func (p pattern) match(name string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(name)
+	case p.glob:
+		matched, _ := path.Match(p.raw, name) // nolint:errcheck
+		return matched
+	default:
+		return p.raw == name
+	}
+}
+
+func compilePatterns(raw []string) ([]pattern, error) {
+	patterns := make([]pattern, 0, len(raw))
+	for _, r := range raw {
+		p, err := compilePattern(r)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// ValidatePatterns checks that every database pattern is well formed
+func ValidatePatterns(raw []string) error {
+	_, err := compilePatterns(raw)
+	return err
+}
+
+// Literals returns the patterns that only match the database named by them
+func Literals(raw []string) []string {
+	var names []string
+	for _, r := range raw {
+		if p, err := compilePattern(r); err == nil && p.re == nil && !p.glob {
+			names = append(names, r)
+		}
+	}
+	return names
+}
+
+// Matcher returns a func reporting whether a database name matches any of the
+// patterns
+func Matcher(raw []string) (func(name string) bool, error) {
+	patterns, err := compilePatterns(raw)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		for _, p := range patterns {
+			if p.match(name) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -3,10 +3,14 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
-	_ "github.com/lib/pq" // Imports Postgres SQL driver
+	"github.com/lib/pq" // Imports Postgres SQL driver
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -18,17 +22,78 @@ const (
 
 // Retriever is an interface to a Retriever function
 type Retriever interface {
-	Retrieve(context.Context) ([]string, error)
+	Retrieve(context.Context) ([]Database, error)
+}
+
+// Database describes a database on the server
+type Database struct {
+	Name      string
+	Owner     string
+	Encoding  string
+	Collation string
+	CType     string
+	// Size is the size on disk in bytes, or -1 if it couldn't be determined
+	Size int64
+	// ConnLimit is the maximum number of connections, or -1 for no limit
+	ConnLimit int
+	// AllowConn is false for databases nobody can connect to (and so dump)
+	AllowConn bool
+	// Backends is the number of connections open at the time of retrieval
+	Backends int
+	// LastActivity is when the most recently active of those connections
+	// last changed state, or zero if there are none. Postgres doesn't keep
+	// track of activity beyond the sessions connected.
+	LastActivity time.Time
+}
+
+// Names returns the names of dbs
+func Names(dbs []Database) []string {
+	names := make([]string, 0, len(dbs))
+	for _, db := range dbs {
+		names = append(names, db.Name)
+	}
+	return names
+}
+
+// SystemDatabase is never backed up, whatever the engine and whatever other
+// databases are excluded
+const SystemDatabase = "system"
+
+// DefaultExcluded lists, per engine, the databases that are never backed up
+// because they belong to the engine or hosting provider rather than the user.
+// Template databases are always skipped, as is SystemDatabase.
+var DefaultExcluded = map[string][]string{
+	"postgres":  {SystemDatabase, "rdsadmin", "cloudsqladmin", "azure_maintenance", "azure_sys"},
+	"cockroach": {SystemDatabase},
 }
 
 // SystemRetriever is an instance of a Retreiver
 type SystemRetriever struct {
 	Dsn string
+	// Engine is "postgres" if empty. Other engines only report names.
+	Engine string
+	// Excluded databases are never returned
+	Excluded []string
+	// Timeout bounds how long retrieval may take, if non-zero
+	Timeout time.Duration
+
+	conn *sql.DB
 }
 
 // FilterType is used as an enum of filter types
 type FilterType int
 
+// MissingDatabasesError is returned by a FilteredRetriever, alongside the
+// databases it did find, when databases requested with OnlyFilterType don't
+// exist on the server.
+type MissingDatabasesError struct {
+	DBs []string
+}
+
+func (e *MissingDatabasesError) Error() string {
+	return fmt.Sprintf("requested databases not found: %s", strings.Join(e.DBs, ","))
+}
+
 // FilteredRetriever is a retreiever with filters applied
 type FilteredRetriever struct {
 	R      Retriever
@@ -36,7 +101,8 @@ type FilteredRetriever struct {
 	DBs    []string
 }
 
-// NewSystemRetriever returns a popualted SystemRetriever
+// NewSystemRetriever returns a popualted SystemRetriever. Its connection pool
+// is reused by every call to Retrieve.
 func NewSystemRetriever(dsn string) (SystemRetriever, error) {
 	if !strings.HasPrefix(dsn, "postgresql://") {
 		dsn = "postgresql://" + dsn
@@ -46,49 +112,140 @@ func NewSystemRetriever(dsn string) (SystemRetriever, error) {
 	if err != nil {
 		return SystemRetriever{}, err
 	}
-	return SystemRetriever{Dsn: url.String()}, nil
+
+	conn, err := sql.Open("postgres", url.String())
+	if err != nil {
+		return SystemRetriever{}, err
+	}
+	// Retrieval is a single query per run, so there's no point holding more
+	// than one connection open
+	conn.SetMaxOpenConns(1)
+
+	return SystemRetriever{Dsn: url.String(), conn: conn}, nil
 }
 
+// databasesQuery lists databases along with their metadata. pg_database_size
+// errors without the CONNECT privilege, so the size is -1 in that case.
+const databasesQuery = `
+SELECT
+	d.datname,
+	pg_get_userbyid(d.datdba),
+	pg_encoding_to_char(d.encoding),
+	d.datcollate,
+	d.datctype,
+	CASE WHEN has_database_privilege(d.datname, 'CONNECT') THEN pg_database_size(d.datname) ELSE -1 END,
+	d.datconnlimit,
+	d.datallowconn,
+	COALESCE(s.numbackends, 0),
+	(SELECT max(a.state_change) FROM pg_stat_activity a WHERE a.datid = d.oid AND a.pid <> pg_backend_pid())
+FROM pg_database d
+LEFT JOIN pg_stat_database s ON s.datid = d.oid
+WHERE d.datistemplate = false AND NOT (d.datname = ANY($1))`
+
+// namesQuery lists databases on engines that speak the Postgres protocol but
+// lack the statistics databasesQuery relies on
+const namesQuery = `
+SELECT d.datname
+FROM pg_database d
+WHERE d.datistemplate = false AND NOT (d.datname = ANY($1))`
+
 // Retrieve retrieves the list of databases from a DB host.
-func (r SystemRetriever) Retrieve(ctx context.Context) ([]string, error) {
-	db, err := sql.Open("postgres", r.Dsn)
+func (r SystemRetriever) Retrieve(ctx context.Context) ([]Database, error) {
+	conn := r.conn
+	if conn == nil {
+		var err error
+		conn, err = sql.Open("postgres", r.Dsn)
+		if err != nil {
+			return []Database{}, err
+		}
+		defer conn.Close()
+	}
+
+	if r.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	excluded := r.Excluded
+	if excluded == nil {
+		excluded = []string{}
+	}
+	if r.Engine != "" && r.Engine != "postgres" {
+		return retrieveNames(ctx, conn, excluded)
+	}
+	rows, err := conn.QueryContext(ctx, databasesQuery, pq.Array(excluded))
 	if err != nil {
-		return []string{}, err
+		return []Database{}, err
+	}
+	defer rows.Close()
+
+	var dbs []Database
+	for rows.Next() {
+		var d Database
+		var lastActivity sql.NullTime
+		if err := rows.Scan(&d.Name, &d.Owner, &d.Encoding, &d.Collation, &d.CType, &d.Size, &d.ConnLimit, &d.AllowConn, &d.Backends, &lastActivity); err != nil {
+			return []Database{}, err
+		}
+		d.LastActivity = lastActivity.Time
+		dbs = append(dbs, d)
+	}
+	if err := rows.Err(); err != nil {
+		return []Database{}, err
 	}
-	defer db.Close()
 
-	rows, err := db.Query("SELECT datname FROM pg_database WHERE datistemplate = false AND datname != 'system'")
+	return dbs, nil
+}
+
+// retrieveNames lists databases by name only, assuming they can be connected
+// to and that their size is unknown
+func retrieveNames(ctx context.Context, conn *sql.DB, excluded []string) ([]Database, error) {
+	rows, err := conn.QueryContext(ctx, namesQuery, pq.Array(excluded))
 	if err != nil {
-		return []string{}, err
+		return []Database{}, err
 	}
 	defer rows.Close()
 
-	var dbs []string
+	var dbs []Database
 	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			return []string{}, err
+		d := Database{Size: -1, ConnLimit: -1, AllowConn: true}
+		if err := rows.Scan(&d.Name); err != nil {
+			return []Database{}, err
 		}
-		dbs = append(dbs, name)
+		dbs = append(dbs, d)
+	}
+	if err := rows.Err(); err != nil {
+		return []Database{}, err
 	}
 
 	return dbs, nil
 }
 
-// Retrieve is an isntance of a Retreiver with appllied filters
-func (r FilteredRetriever) Retrieve(ctx context.Context) ([]string, error) {
+// Retrieve is an isntance of a Retreiver with appllied filters. DBs may be
+// exact names, globs or regular expressions (see ValidatePatterns).
+func (r FilteredRetriever) Retrieve(ctx context.Context) ([]Database, error) {
 	found, err := r.R.Retrieve(ctx)
-	if err != nil {
+	var missingErr *MissingDatabasesError
+	if err != nil && !errors.As(err, &missingErr) {
 		return found, err
 	}
 
-	var filteredDBs []string
+	patterns, err := compilePatterns(r.DBs)
+	if err != nil {
+		return nil, err
+	}
+
+	var filteredDBs []Database
 	if r.Filter == ExcludeFilterType {
 		for _, db := range found {
 			var matched bool
 
-			for _, exclude := range r.DBs {
-				if db == exclude {
+			for _, exclude := range patterns {
+				if exclude.match(db.Name) {
+					log.WithContext(ctx).WithFields(log.Fields{
+						"db":   db.Name,
+						"rule": "exclude " + exclude.raw,
+					}).Debug("Skipping database")
 					matched = true
 					break
 				}
@@ -102,14 +259,37 @@ func (r FilteredRetriever) Retrieve(ctx context.Context) ([]string, error) {
 		}
 	}
 	if r.Filter == OnlyFilterType {
-		for _, only := range r.DBs {
+		included := map[string]bool{}
+		for _, only := range patterns {
+			var matched bool
 			for _, db := range found {
-				if db == only {
-					filteredDBs = append(filteredDBs, db)
+				if only.match(db.Name) {
+					matched = true
+					if !included[db.Name] {
+						included[db.Name] = true
+						filteredDBs = append(filteredDBs, db)
+					}
 				}
 			}
+			if !matched {
+				if missingErr == nil {
+					missingErr = &MissingDatabasesError{}
+				}
+				missingErr.DBs = append(missingErr.DBs, only.raw)
+			}
+		}
+		for _, db := range found {
+			if !included[db.Name] {
+				log.WithContext(ctx).WithFields(log.Fields{
+					"db":   db.Name,
+					"rule": "only",
+				}).Debug("Skipping database")
+			}
 		}
 	}
 
+	if missingErr != nil {
+		return filteredDBs, missingErr
+	}
 	return filteredDBs, nil
 }
@@ -1,3 +1,65 @@
+//go:build integration
 // +build integration
 
 package db_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+)
+
+func integrationDSN() string {
+	if dsn := os.Getenv("DBCLI_DSN"); dsn != "" {
+		return dsn
+	}
+	return "postgres@localhost:5432/postgres?sslmode=disable"
+}
+
+func TestSystemRetriever_Retrieve(t *testing.T) {
+	r, err := db.NewSystemRetriever(integrationDSN())
+	assert.Nil(t, err)
+	r.Excluded = []string{"postgres"}
+	r.Timeout = 10 * time.Second
+
+	// Twice, to exercise the reused connection pool
+	for i := 0; i < 2; i++ {
+		dbs, err := r.Retrieve(context.Background())
+		assert.Nil(t, err)
+		assert.NotContains(t, db.Names(dbs), "postgres")
+		assert.NotContains(t, db.Names(dbs), "template0")
+		assert.NotContains(t, db.Names(dbs), "template1")
+	}
+}
+
+func TestSystemRetriever_Cancelled(t *testing.T) {
+	r, err := db.NewSystemRetriever(integrationDSN())
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = r.Retrieve(ctx)
+	assert.Error(t, err)
+}
+
+func TestCheckPrivileges(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, db.Ping(ctx, integrationDSN()))
+	assert.Nil(t, db.CheckPrivileges(ctx, integrationDSN(), []string{"postgres"}))
+
+	err := db.CheckPrivileges(ctx, integrationDSN(), []string{"postgres", "does_not_exist"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does_not_exist")
+		assert.NotContains(t, err.Error(), "postgres:")
+	}
+}
+
+func TestCheckReplication(t *testing.T) {
+	// The integration tests connect as a superuser
+	assert.Nil(t, db.CheckReplication(context.Background(), integrationDSN()))
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/utilitywarehouse/sql-backup/internal/db"
 )
 
@@ -19,7 +20,7 @@ func TestFilteredRetriever_Exclude(t *testing.T) {
 
 	dbs, err := r.Retrieve(context.Background())
 	assert.Nil(t, err)
-	assert.Equal(t, expected, dbs)
+	assert.Equal(t, expected, db.Names(dbs))
 }
 
 func TestFilteredRetriever_Only(t *testing.T) {
@@ -31,15 +32,110 @@ func TestFilteredRetriever_Only(t *testing.T) {
 		DBs:    []string{"one", "two", "three", "four"},
 	}
 
+	dbs, err := r.Retrieve(context.Background())
+	assert.Equal(t, &db.MissingDatabasesError{DBs: []string{"two", "four"}}, err)
+	assert.Equal(t, expected, db.Names(dbs))
+}
+
+func TestFilteredRetriever_Patterns(t *testing.T) {
+	found := []string{"billing", "tenant_1", "tenant_2", "tenant_2_tmp", "users_tmp"}
+
+	inputs := []struct {
+		filter   db.FilterType
+		dbs      []string
+		expected []string
+	}{
+		{db.OnlyFilterType, []string{"tenant_*"}, []string{"tenant_1", "tenant_2", "tenant_2_tmp"}},
+		{db.OnlyFilterType, []string{"/^tenant_[0-9]+$/", "billing"}, []string{"tenant_1", "tenant_2", "billing"}},
+		{db.OnlyFilterType, []string{"tenant_?", "tenant_*"}, []string{"tenant_1", "tenant_2", "tenant_2_tmp"}},
+		{db.ExcludeFilterType, []string{"*_tmp"}, []string{"billing", "tenant_1", "tenant_2"}},
+		{db.ExcludeFilterType, []string{"/_[0-9]$/"}, []string{"billing", "tenant_2_tmp", "users_tmp"}},
+	}
+
+	for _, input := range inputs {
+		r := db.FilteredRetriever{
+			R:      StubbedRetriever{DBs: found},
+			Filter: input.filter,
+			DBs:    input.dbs,
+		}
+
+		dbs, err := r.Retrieve(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, input.expected, db.Names(dbs))
+	}
+}
+
+func TestFilteredRetriever_ExcludeTakesPrecedence(t *testing.T) {
+	expected := []string{"tenant_1", "tenant_2"}
+
+	r := db.FilteredRetriever{
+		R: db.FilteredRetriever{
+			R:      StubbedRetriever{DBs: []string{"billing", "tenant_1", "tenant_2", "tenant_2_tmp"}},
+			Filter: db.OnlyFilterType,
+			DBs:    []string{"tenant_*"},
+		},
+		Filter: db.ExcludeFilterType,
+		DBs:    []string{"*_tmp"},
+	}
+
 	dbs, err := r.Retrieve(context.Background())
 	assert.Nil(t, err)
-	assert.Equal(t, expected, dbs)
+	assert.Equal(t, expected, db.Names(dbs))
+}
+
+func TestFilteredRetriever_MissingPassesThroughExclude(t *testing.T) {
+	r := db.FilteredRetriever{
+		R: db.FilteredRetriever{
+			R:      StubbedRetriever{DBs: []string{"billing", "users", "users_tmp"}},
+			Filter: db.OnlyFilterType,
+			DBs:    []string{"users*", "bilings", "tenant_*"},
+		},
+		Filter: db.ExcludeFilterType,
+		DBs:    []string{"*_tmp"},
+	}
+
+	dbs, err := r.Retrieve(context.Background())
+	assert.Equal(t, &db.MissingDatabasesError{DBs: []string{"bilings", "tenant_*"}}, err)
+	assert.Equal(t, []string{"users"}, db.Names(dbs))
+}
+
+func TestValidatePatterns(t *testing.T) {
+	assert.Nil(t, db.ValidatePatterns([]string{"users", "tenant_*", "/^tenant_[0-9]+$/"}))
+	assert.Error(t, db.ValidatePatterns([]string{"tenant_["}))
+	assert.Error(t, db.ValidatePatterns([]string{"/tenant_(/"}))
+}
+
+func TestLiterals(t *testing.T) {
+	assert.Equal(t, []string{"users", "billing"}, db.Literals([]string{"users", "tenant_*", "/^audit_[0-9]+$/", "billing"}))
+	assert.Nil(t, db.Literals([]string{"tenant_?"}))
+}
+
+func TestMatcher(t *testing.T) {
+	match, err := db.Matcher([]string{"users", "tenant_*", "/^audit_[0-9]+$/", `back\slash`})
+	require.Nil(t, err)
+	for name, expected := range map[string]bool{
+		"users":      true,
+		"tenant_eu":  true,
+		"audit_12":   true,
+		"audit_x":    false,
+		"billing":    false,
+		`back\slash`: true,
+		"backslash":  false,
+	} {
+		assert.Equal(t, expected, match(name), name)
+	}
+	_, err = db.Matcher([]string{"tenant_["})
+	assert.Error(t, err)
 }
 
 type StubbedRetriever struct {
 	DBs []string
 }
 
-func (r StubbedRetriever) Retrieve(ctx context.Context) ([]string, error) {
-	return r.DBs, nil
+func (r StubbedRetriever) Retrieve(ctx context.Context) ([]db.Database, error) {
+	var dbs []db.Database
+	for _, name := range r.DBs {
+		dbs = append(dbs, db.Database{Name: name, AllowConn: true})
+	}
+	return dbs, nil
 }
@@ -0,0 +1,115 @@
+package dbcli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BaseBackuper is an interface for taking a physical backup of a whole cluster
+type BaseBackuper interface {
+	Validate() error
+	BaseBackup(ctx context.Context, dir string) error
+	StreamBaseBackup(ctx context.Context, w io.Writer) error
+}
+
+// CliBaseBackuper contains the required information to use pg_basebackup to
+// take a physical backup of a cluster.
+type CliBaseBackuper struct {
+	Cmd      string
+	DSN      string
+	Timeout  time.Duration
+	Priority Priority
+}
+
+// NewBaseBackuper returns a populated CliBaseBackuper
+func NewBaseBackuper(cmd, dsn string) (CliBaseBackuper, error) {
+	if _, err := os.Stat(cmd); os.IsNotExist(err) {
+		_, lookErr := exec.LookPath(cmd)
+		if lookErr != nil {
+			return CliBaseBackuper{}, errors.Wrapf(lookErr, "failed to find basebackup binary")
+		}
+	}
+	return CliBaseBackuper{Cmd: cmd, DSN: dsn}, nil
+}
+
+// Validate checks the connection to the cluster
+func (b CliBaseBackuper) Validate() error {
+	return validateConnection(b.DSN)
+}
+
+// BaseBackup takes a tar format backup of the cluster into dir, streaming the
+// WAL required to make it consistent alongside it. dir must not exist or be
+// empty. On success dir contains base.tar, pg_wal.tar, one tar per additional
+// tablespace and a SHA256 checksummed backup_manifest.
+func (b CliBaseBackuper) BaseBackup(ctx context.Context, dir string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	u, err := dsnToURL(b.DSN)
+	if err != nil {
+		return err
+	}
+
+	// #nosec G204
+	return b.run(ctx, u, exec.Command(b.Cmd, b.args(u, "-D", dir, "-X", "stream")...))
+}
+
+// StreamBaseBackup writes a tar format backup of the cluster to w, without
+// staging it on disk. pg_basebackup can't stream WAL alongside a backup written
+// to stdout, so the WAL required to make it consistent is fetched into the tar
+// at the end of the backup, and must still be on the server by then. The
+// backup_manifest is part of the tar. Clusters with additional tablespaces
+// can't be backed up this way.
+func (b CliBaseBackuper) StreamBaseBackup(ctx context.Context, w io.Writer) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	u, err := dsnToURL(b.DSN)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(w)
+	// #nosec G204
+	cmd := exec.Command(b.Cmd, b.args(u, "-D", "-", "-X", "fetch")...)
+	cmd.Stdout = buf
+	if err := b.run(ctx, u, cmd); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+func (b CliBaseBackuper) args(u *url.URL, extra ...string) []string {
+	args := append(extra,
+		"-F", "tar",
+		"--manifest-checksums=SHA256",
+		"--no-password",
+		"-h", u.Hostname(),
+		"-U", u.User.Username(),
+	)
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	return args
+}
+
+func (b CliBaseBackuper) run(ctx context.Context, u *url.URL, cmd *exec.Cmd) error {
+	cmd.Env = pgEnv(u)
+	if err := run(ctx, cmd, b.Timeout, b.Priority); err != nil {
+		if err == errTimeout {
+			return fmt.Errorf("timed out taking base backup of %s", u.Hostname())
+		}
+		return errors.Wrap(err, "base backup failed")
+	}
+	return nil
+}
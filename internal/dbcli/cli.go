@@ -14,20 +14,36 @@ import (
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
 )
 
+var errTimeout = errors.New("timed out")
+
 // Dumper is an interface for a Cli Dumper
 type Dumper interface {
 	Validate() error
 	Dump(ctx context.Context, db string, w io.Writer) error
 }
 
+// Kinds of dump
+const (
+	// FullDump dumps the schema and the data
+	FullDump = "full"
+	// SchemaDump dumps only the schema
+	SchemaDump = "schema"
+	// DataDump dumps only the data
+	DataDump = "data"
+)
+
 // CliDumper contains the required information to use a DB Cli tool to dump a DB.
 type CliDumper struct {
-	Cmd     string
-	Flags   string
-	DSN     string
-	Timeout time.Duration
+	Cmd      string
+	Flags    string
+	DSN      string
+	Timeout  time.Duration
+	Priority Priority
+	// Kind is FullDump if empty
+	Kind string
 }
 
 // NewDumper returns a populated CliDumper
@@ -45,19 +61,23 @@ func NewDumper(cmd, flags, dsn string) (CliDumper, error) {
 func (d CliDumper) Validate() error {
 	switch d.Cmd {
 	case "pg_dump":
-		u, err := dsnToURL(d.DSN)
-		if err != nil {
-			return err
-		}
-		// Lazy but assuming if pg_dump was found that pg_isready will also work
-		// #nosec G204
-		pgCmd := exec.Command("pg_isready", "-h", u.Hostname(), "-U", u.User.Username())
-		if err := pgCmd.Run(); err != nil {
-			return errors.Wrapf(err, "failed to validate db connection")
-		}
+		return validateConnection(d.DSN)
 	default:
 		return errors.New("unknown dbcli command")
 	}
+}
+
+// validateTimeout bounds how long validating a connection may take
+const validateTimeout = 10 * time.Second
+
+// validateConnection checks the postgres server referenced by dsn accepts an
+// authenticated connection
+func validateConnection(dsn string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+	if err := db.Ping(ctx, dsn); err != nil {
+		return errors.Wrapf(err, "failed to validate db connection")
+	}
 	return nil
 }
 
@@ -78,57 +98,92 @@ func (d CliDumper) Dump(ctx context.Context, db string, w io.Writer) error {
 		if err != nil {
 			return err
 		}
-		// #nosec G204
-		dumpCmd = exec.Command(d.Cmd, "-d", db, "-h", u.Hostname(), "-U", u.User.Username())
-		if pass, ok := u.User.Password(); ok {
-			dumpCmd.Env = []string{
-				fmt.Sprintf("PGPASSWORD=%s", pass),
-			}
+		args := []string{"-d", db, "-h", u.Hostname(), "-U", u.User.Username()}
+		switch d.Kind {
+		case SchemaDump:
+			args = append(args, "--schema-only")
+		case DataDump:
+			args = append(args, "--data-only")
 		}
+		// #nosec G204
+		dumpCmd = exec.Command(d.Cmd, args...)
+		dumpCmd.Env = pgEnv(u)
 	default:
 		return errors.New("unknown dbcli command")
 	}
 
 	buf := bufio.NewWriter(w)
-	errBuff := &bytes.Buffer{}
 	dumpCmd.Stdout = buf
-	dumpCmd.Stderr = errBuff
 
-	if err := dumpCmd.Start(); err != nil {
-		return errors.Wrap(err, "failed to start dumper")
+	if err := run(ctx, dumpCmd, d.Timeout, d.Priority); err != nil {
+		if err == errTimeout {
+			return fmt.Errorf("timed out dumping database: %s", db)
+		}
+		if ctx.Err() == nil {
+			log.WithField("db", db).WithError(err).Error("Failed to dump database")
+		}
+		return errors.Wrap(err, "dumper failed")
+	}
+	return buf.Flush()
+}
+
+// run starts cmd with priority and waits for it to exit, killing it if ctx is
+// cancelled or the timeout (if non-zero) is reached.
+func run(ctx context.Context, cmd *exec.Cmd, timeout time.Duration, priority Priority) error {
+	errBuff := &bytes.Buffer{}
+	cmd.Stderr = errBuff
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start %s", cmd.Path)
+	}
+	// The process has already started, but nothing it does before this
+	// point is heavy enough to matter
+	if priority.isSet() {
+		if err := setPriority(cmd.Process.Pid, priority); err != nil {
+			log.WithError(err).Warn("Failed to lower process priority")
+		}
 	}
 
 	doneCh := make(chan error, 1)
 	go func() {
-		doneCh <- dumpCmd.Wait()
+		doneCh <- cmd.Wait()
 	}()
 
 	timeoutCh := make(chan struct{})
-	if d.Timeout != 0 {
-		timeoutTimer := time.AfterFunc(d.Timeout, func() {
+	if timeout != 0 {
+		timeoutTimer := time.AfterFunc(timeout, func() {
 			close(timeoutCh)
 		})
 		defer timeoutTimer.Stop()
 	}
 
+	// Whatever happens the process is waited for before returning, so it is
+	// never left running or unreaped
 	select {
 	case <-ctx.Done():
-		if err := dumpCmd.Process.Kill(); err != nil {
-			<-doneCh // wait for the command to terminate
-		}
+		cmd.Process.Kill() // nolint:errcheck
+		<-doneCh
 		return errors.Wrap(ctx.Err(), "context was cancelled")
 	case <-timeoutCh:
-		if err := dumpCmd.Process.Kill(); err != nil {
-			<-doneCh // wait for the command to terminate
-		}
-		return fmt.Errorf("timed out dumping database: %s", db)
+		cmd.Process.Kill() // nolint:errcheck
+		<-doneCh
+		return errTimeout
 	case err := <-doneCh:
 		if err != nil {
-			log.WithField("db", db).WithError(err).Error(string(errBuff.Bytes()))
-			return errors.Wrap(err, "dumper failed")
+			return errors.Wrapf(err, "%s failed: %s", cmd.Path, strings.TrimSpace(errBuff.String()))
+		}
+		return nil
+	}
+}
+
+// pgEnv returns the environment for a postgres cli tool connecting as u.
+func pgEnv(u *url.URL) []string {
+	if pass, ok := u.User.Password(); ok {
+		return []string{
+			fmt.Sprintf("PGPASSWORD=%s", pass),
 		}
-		return buf.Flush()
 	}
+	return nil
 }
 
 func dsnToURL(dsn string) (*url.URL, error) {
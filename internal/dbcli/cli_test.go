@@ -0,0 +1,35 @@
+package dbcli
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun_CancelReapsProcess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	cmd := exec.Command("sleep", "10")
+	err := run(ctx, cmd, 0, Priority{})
+	assert.Error(t, err)
+	// ProcessState is only set once the process has been waited for
+	assert.NotNil(t, cmd.ProcessState)
+}
+
+func TestRun_TimeoutReapsProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	err := run(context.Background(), cmd, 50*time.Millisecond, Priority{})
+	assert.Equal(t, errTimeout, err)
+	assert.NotNil(t, cmd.ProcessState)
+}
+
+func TestRun_Failure(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "echo oops >&2; exit 3")
+	err := run(context.Background(), cmd, 0, Priority{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "oops")
+}
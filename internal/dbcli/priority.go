@@ -0,0 +1,50 @@
+package dbcli
+
+import (
+	"fmt"
+)
+
+const (
+	// IOClassNone leaves the IO scheduling class unchanged
+	IOClassNone IOClass = iota
+	// IOClassRealtime always gets first access to the disk
+	IOClassRealtime
+	// IOClassBestEffort is the default class for processes
+	IOClassBestEffort
+	// IOClassIdle only gets disk time when no other process needs it
+	IOClassIdle
+)
+
+// IOClass is an IO scheduling class, as used by ionice(1)
+type IOClass int
+
+// ParseIOClass returns the IOClass named s
+func ParseIOClass(s string) (IOClass, error) {
+	switch s {
+	case "":
+		return IOClassNone, nil
+	case "realtime":
+		return IOClassRealtime, nil
+	case "best-effort":
+		return IOClassBestEffort, nil
+	case "idle":
+		return IOClassIdle, nil
+	default:
+		return IOClassNone, fmt.Errorf("unknown io class: %s", s)
+	}
+}
+
+// Priority is the CPU and IO scheduling priority given to spawned processes
+type Priority struct {
+	// Nice is the niceness the process is given, from -20 to 19, rather
+	// than added to the niceness it inherits as with nice(1)
+	Nice int
+	// IOClass and IOLevel are the IO scheduling class and priority within
+	// that class (0-7, lower is higher priority), as with ionice(1)
+	IOClass IOClass
+	IOLevel int
+}
+
+func (p Priority) isSet() bool {
+	return p.Nice != 0 || p.IOClass != IOClassNone
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package dbcli
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// setPriority applies p to the running process pid
+func setPriority(pid int, p Priority) error {
+	if p.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, p.Nice); err != nil {
+			return errors.Wrap(err, "failed to set niceness")
+		}
+	}
+	if p.IOClass != IOClassNone {
+		ioprio := int(p.IOClass)<<ioprioClassShift | p.IOLevel
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(ioprio)); errno != 0 {
+			return errors.Wrap(errno, "failed to set io priority")
+		}
+	}
+	return nil
+}
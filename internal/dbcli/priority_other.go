@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package dbcli
+
+import (
+	"errors"
+)
+
+// setPriority applies p to the running process pid
+func setPriority(pid int, p Priority) error {
+	return errors.New("process priority is only supported on linux")
+}
@@ -0,0 +1,288 @@
+package dbcli
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+)
+
+// Sections of a split dump, restored in this order. The data parts can be
+// restored in any order, or in parallel.
+const (
+	PreData  = "pre-data"
+	Data     = "data"
+	PostData = "post-data"
+)
+
+// Splitter dumps a database in parts that can be stored, and restored, on
+// their own
+type Splitter interface {
+	Split(ctx context.Context, database string) (Split, error)
+}
+
+// Split is a database being dumped in parts, all read from the same snapshot.
+// It must be closed once every part has been dumped.
+type Split interface {
+	Parts() []Part
+	DumpPart(ctx context.Context, p Part, w io.Writer) error
+	Close() error
+}
+
+// Part is a piece of a split dump
+type Part struct {
+	// Name is unique within the dump, eg. pre-data or data/0001
+	Name    string
+	Section string
+	// Tables are the schema qualified tables, or sequences, whose data the
+	// part holds
+	Tables []string
+	// Size is the size of the tables on disk, to schedule the largest
+	// parts first
+	Size int64
+	// LargeObjects is set on the part holding the contents of the
+	// database's large objects, which aren't in any table dumped with -t
+	LargeObjects bool
+}
+
+// SplitDumper dumps the schema of a database up to its tables, the data of
+// each table, or group of small tables, and then the rest of the schema, each
+// with pg_dump and as a part of their own
+type SplitDumper struct {
+	Cmd      string
+	DSN      string
+	Timeout  time.Duration
+	Priority Priority
+	// Kind is FullDump if empty. DataDump leaves out the schema. There's
+	// nothing to split in a SchemaDump.
+	Kind string
+	// GroupSize is the size tables smaller than it are grouped up to, so
+	// lots of small tables don't make lots of tiny parts. Zero gives every
+	// table a part of its own.
+	GroupSize int64
+}
+
+// NewSplitDumper returns a populated SplitDumper
+func NewSplitDumper(cmd, dsn string) (SplitDumper, error) {
+	if _, err := os.Stat(cmd); os.IsNotExist(err) {
+		_, lookErr := exec.LookPath(cmd)
+		if lookErr != nil {
+			return SplitDumper{}, errors.Wrapf(lookErr, "failed to find db binary")
+		}
+	}
+	return SplitDumper{Cmd: cmd, DSN: dsn}, nil
+}
+
+const relationsQuery = `
+SELECT n.nspname, c.relname, pg_table_size(c.oid)
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = $1
+AND n.nspname <> 'information_schema'
+AND n.nspname NOT LIKE 'pg\_%'
+AND NOT EXISTS (
+	SELECT 1 FROM pg_depend d
+	WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'
+)
+ORDER BY 1, 2`
+
+// largeObjectsQuery returns whether the database has large objects, and how
+// much space their contents take
+const largeObjectsQuery = `
+SELECT EXISTS (SELECT 1 FROM pg_largeobject_metadata), pg_table_size('pg_catalog.pg_largeobject')`
+
+// relation is a table or sequence
+type relation struct {
+	name string
+	size int64
+}
+
+// Split starts a dump of database in parts. The transaction whose snapshot
+// the parts are dumped from stays open until the Split is closed.
+func (d SplitDumper) Split(ctx context.Context, database string) (Split, error) {
+	if d.Kind == SchemaDump {
+		return nil, errors.New("schema dumps can't be split")
+	}
+	conn, err := db.Open(d.DSN, database)
+	if err != nil {
+		return nil, err
+	}
+	s := &pgSplit{d: d, database: database, conn: conn}
+	if err := s.start(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+type pgSplit struct {
+	d        SplitDumper
+	database string
+	conn     *sql.DB
+	tx       *sql.Tx
+	snapshot string
+	parts    []Part
+}
+
+func (s *pgSplit) start(ctx context.Context) error {
+	var err error
+	// The transaction outlives ctx, which only covers planning the parts
+	s.tx, err = s.conn.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	if err := s.tx.QueryRowContext(ctx, "SELECT pg_export_snapshot()").Scan(&s.snapshot); err != nil {
+		return errors.Wrap(err, "failed to export snapshot")
+	}
+	tables, err := s.relations(ctx, "r")
+	if err != nil {
+		return errors.Wrap(err, "failed to list tables")
+	}
+	sequences, err := s.relations(ctx, "S")
+	if err != nil {
+		return errors.Wrap(err, "failed to list sequences")
+	}
+	var largeObjects *relation
+	var exists bool
+	var size int64
+	if err := s.tx.QueryRowContext(ctx, largeObjectsQuery).Scan(&exists, &size); err != nil {
+		return errors.Wrap(err, "failed to check for large objects")
+	}
+	if exists {
+		largeObjects = &relation{name: "pg_catalog.pg_largeobject", size: size}
+	}
+	s.parts = planParts(s.d.Kind, tables, sequences, largeObjects, s.d.GroupSize)
+	return nil
+}
+
+func (s *pgSplit) relations(ctx context.Context, relkind string) ([]relation, error) {
+	rows, err := s.tx.QueryContext(ctx, relationsQuery, relkind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var relations []relation
+	for rows.Next() {
+		var schema, name string
+		var r relation
+		if err := rows.Scan(&schema, &name, &r.size); err != nil {
+			return nil, err
+		}
+		r.name = pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+		relations = append(relations, r)
+	}
+	return relations, rows.Err()
+}
+
+// planParts splits a dump into the schema before and after the data, a part
+// for each table at least groupSize large, parts grouping the smaller tables
+// up to groupSize, a part setting the sequences and, if largeObjects isn't
+// nil, a part with the contents of the large objects
+func planParts(kind string, tables, sequences []relation, largeObjects *relation, groupSize int64) []Part {
+	var parts []Part
+	if kind != DataDump {
+		parts = append(parts, Part{Name: PreData, Section: PreData})
+	}
+
+	sorted := append([]relation(nil), tables...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].size > sorted[j].size })
+	var group *Part
+	groups := 0
+	for _, t := range sorted {
+		if group == nil || groupSize == 0 || group.Size+t.size > groupSize {
+			groups++
+			parts = append(parts, Part{Name: fmt.Sprintf("data/%04d", groups), Section: Data})
+			group = &parts[len(parts)-1]
+		}
+		group.Tables = append(group.Tables, t.name)
+		group.Size += t.size
+	}
+
+	if len(sequences) > 0 {
+		p := Part{Name: "data/sequences", Section: Data}
+		for _, s := range sequences {
+			p.Tables = append(p.Tables, s.name)
+		}
+		parts = append(parts, p)
+	}
+
+	if largeObjects != nil {
+		parts = append(parts, Part{Name: "data/blobs", Section: Data, Size: largeObjects.size, LargeObjects: true})
+	}
+
+	if kind != DataDump {
+		parts = append(parts, Part{Name: PostData, Section: PostData})
+	}
+	return parts
+}
+
+// Parts returns the parts of the dump, in restore order
+func (s *pgSplit) Parts() []Part {
+	return s.parts
+}
+
+// DumpPart writes a part of the dump with pg_dump
+func (s *pgSplit) DumpPart(ctx context.Context, p Part, w io.Writer) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	u, err := dsnToURL(s.d.DSN)
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"-d", s.database,
+		"-h", u.Hostname(),
+		"-U", u.User.Username(),
+		"--no-password",
+		"--snapshot=" + s.snapshot,
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	switch {
+	case p.LargeObjects:
+		// Large objects are only dumped without -t, so every table's
+		// data is left out instead. Their entries are created by the
+		// pre-data part.
+		args = append(args, "--data-only", "-b", "--exclude-table-data=*.*")
+	case p.Section == Data:
+		args = append(args, "--data-only")
+		for _, t := range p.Tables {
+			// Quoted names are matched exactly rather than as patterns
+			args = append(args, "-t", t)
+		}
+	default:
+		args = append(args, "--section="+p.Section)
+	}
+
+	buf := bufio.NewWriter(w)
+	// #nosec G204
+	cmd := exec.Command(s.d.Cmd, args...)
+	cmd.Env = pgEnv(u)
+	cmd.Stdout = buf
+	if err := run(ctx, cmd, s.d.Timeout, s.d.Priority); err != nil {
+		if err == errTimeout {
+			return fmt.Errorf("timed out dumping %s of database: %s", p.Name, s.database)
+		}
+		return errors.Wrapf(err, "failed to dump %s", p.Name)
+	}
+	return buf.Flush()
+}
+
+// Close ends the transaction the parts were dumped from
+func (s *pgSplit) Close() error {
+	if s.tx != nil {
+		s.tx.Rollback() // nolint:errcheck
+	}
+	return s.conn.Close()
+}
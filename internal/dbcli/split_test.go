@@ -0,0 +1,40 @@
+package dbcli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanParts(t *testing.T) {
+	tables := []relation{
+		{`public.small`, 10},
+		{`public.huge`, 500},
+		{`public.tiny`, 5},
+		{`public."Big"`, 120},
+		{`public.empty`, 0},
+	}
+	sequences := []relation{{`public.users_id_seq`, 8192}}
+
+	assert.Equal(t, []Part{
+		{Name: PreData, Section: PreData},
+		{Name: "data/0001", Section: Data, Tables: []string{`public.huge`}, Size: 500},
+		{Name: "data/0002", Section: Data, Tables: []string{`public."Big"`}, Size: 120},
+		{Name: "data/0003", Section: Data, Tables: []string{`public.small`, `public.tiny`, `public.empty`}, Size: 15},
+		{Name: "data/sequences", Section: Data, Tables: []string{`public.users_id_seq`}},
+		{Name: "data/blobs", Section: Data, Size: 64, LargeObjects: true},
+		{Name: PostData, Section: PostData},
+	}, planParts(FullDump, tables, sequences, &relation{"pg_catalog.pg_largeobject", 64}, 100))
+
+	parts := planParts(DataDump, tables, nil, nil, 0)
+	assert.Len(t, parts, len(tables))
+	for _, p := range parts {
+		assert.Equal(t, Data, p.Section)
+		assert.Len(t, p.Tables, 1)
+	}
+
+	assert.Equal(t, []Part{
+		{Name: PreData, Section: PreData},
+		{Name: PostData, Section: PostData},
+	}, planParts("", nil, nil, nil, 0))
+}
@@ -0,0 +1,133 @@
+package dbcli
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+	"github.com/utilitywarehouse/sql-backup/internal/subset"
+)
+
+// SubsetDumper dumps the schema of a database with pg_dump, but only the rows
+// of it that subset rules select. The result is a plain format dump that can
+// be restored with psql.
+type SubsetDumper struct {
+	Cmd      string
+	DSN      string
+	Rules    *subset.Rules
+	Timeout  time.Duration
+	Priority Priority
+	// Kind is FullDump if empty. A SchemaDump has no rows, and a DataDump
+	// only has rows.
+	Kind string
+}
+
+// NewSubsetDumper returns a populated SubsetDumper
+func NewSubsetDumper(cmd, dsn string, rules *subset.Rules) (SubsetDumper, error) {
+	if _, err := os.Stat(cmd); os.IsNotExist(err) {
+		_, lookErr := exec.LookPath(cmd)
+		if lookErr != nil {
+			return SubsetDumper{}, errors.Wrapf(lookErr, "failed to find db binary")
+		}
+	}
+	return SubsetDumper{Cmd: cmd, DSN: dsn, Rules: rules}, nil
+}
+
+// Validate checks the connection to the database server
+func (d SubsetDumper) Validate() error {
+	return validateConnection(d.DSN)
+}
+
+// Dump writes the schema of the database up to its tables, the subset of its
+// rows, and then the rest of the schema, such as indexes and constraints,
+// which are quicker to create after loading the rows. Everything is read from
+// the same snapshot.
+func (d SubsetDumper) Dump(ctx context.Context, database string, w io.Writer) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if d.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	err := d.dump(ctx, database, w)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out dumping database: %s", database)
+	}
+	return err
+}
+
+func (d SubsetDumper) dump(ctx context.Context, database string, w io.Writer) error {
+	conn, err := db.Open(d.DSN, database)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	// pg_dump reads the schema from the same snapshot as the rows
+	var snapshot string
+	if err := tx.QueryRowContext(ctx, "SELECT pg_export_snapshot()").Scan(&snapshot); err != nil {
+		return errors.Wrap(err, "failed to export snapshot")
+	}
+
+	buf := bufio.NewWriter(w)
+	if d.Kind != DataDump {
+		if err := d.dumpSection(ctx, database, snapshot, "pre-data", buf); err != nil {
+			return err
+		}
+	}
+	if d.Kind != SchemaDump {
+		if err := subset.Dump(ctx, tx, d.Rules, database, buf); err != nil {
+			return errors.Wrap(err, "failed to dump subset")
+		}
+	}
+	if d.Kind != DataDump {
+		if err := d.dumpSection(ctx, database, snapshot, "post-data", buf); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// dumpSection writes a section of the database's schema with pg_dump
+func (d SubsetDumper) dumpSection(ctx context.Context, database, snapshot, section string, w io.Writer) error {
+	u, err := dsnToURL(d.DSN)
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"-d", database,
+		"-h", u.Hostname(),
+		"-U", u.User.Username(),
+		"--no-password",
+		"--section=" + section,
+		"--snapshot=" + snapshot,
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+
+	// #nosec G204
+	cmd := exec.Command(d.Cmd, args...)
+	cmd.Env = pgEnv(u)
+	cmd.Stdout = w
+	if err := run(ctx, cmd, 0, d.Priority); err != nil {
+		return errors.Wrapf(err, "failed to dump %s", section)
+	}
+	return nil
+}
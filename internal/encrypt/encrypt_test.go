@@ -0,0 +1,43 @@
+package encrypt_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/sql-backup/internal/encrypt"
+)
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, encrypt.KeySize)
+
+	parsed, err := encrypt.ParseKey(hex.EncodeToString(key))
+	assert.Nil(t, err)
+	assert.Equal(t, key, parsed)
+
+	parsed, err = encrypt.ParseKey(base64.StdEncoding.EncodeToString(key))
+	assert.Nil(t, err)
+	assert.Equal(t, key, parsed)
+
+	_, err = encrypt.ParseKey("too-short")
+	assert.Equal(t, encrypt.ErrInvalidKey, err)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01}, encrypt.KeySize)
+	plaintext := []byte("some wal segment")
+
+	ciphertext, err := encrypt.Encrypt(key, plaintext)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(ciphertext), string(plaintext))
+
+	decrypted, err := encrypt.Decrypt(key, ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	otherKey := bytes.Repeat([]byte{0x02}, encrypt.KeySize)
+	_, err = encrypt.Decrypt(otherKey, ciphertext)
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+// Locker lets one of many replicas claim a key, so only it does the work the
+// key stands for
+type Locker interface {
+	// TryLock claims key without waiting. If another replica holds it, ok is
+	// false. Otherwise release must be called once the work is done.
+	TryLock(ctx context.Context, key string) (release func(), ok bool, err error)
+}
+
+// PGLocker claims keys with postgres advisory locks. Each lock is held by a
+// connection of its own, which is closed on release.
+type PGLocker struct {
+	// MinHold is the least time a lock is held for, however quickly the work
+	// is done, so replicas whose clocks are slightly behind don't claim it
+	// once it has been released
+	MinHold time.Duration
+
+	db *sql.DB
+}
+
+// NewPGLocker returns a PGLocker taking locks on the server and database dsn
+// points at
+func NewPGLocker(dsn string) (*PGLocker, error) {
+	if !strings.HasPrefix(dsn, "postgresql://") {
+		dsn = "postgresql://" + dsn
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return nil, err
+	}
+	// Advisory locks belong to the session, so connections mustn't be kept
+	// around once released
+	db.SetMaxIdleConns(0)
+	return &PGLocker{db: db}, nil
+}
+
+// TryLock takes the advisory lock for key
+func (l *PGLocker) TryLock(ctx context.Context, key string) (func(), bool, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to connect")
+	}
+
+	var ok bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", advisoryKey(key)).Scan(&ok); err != nil {
+		conn.Close()
+		return nil, false, errors.Wrap(err, "failed to take advisory lock")
+	}
+	if !ok {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	acquired := time.Now()
+	release := func() {
+		// Closing the connection ends the session, which releases the lock
+		if wait := l.MinHold - time.Since(acquired); wait > 0 {
+			time.AfterFunc(wait, func() { conn.Close() })
+			return
+		}
+		conn.Close()
+	}
+	return release, true, nil
+}
+
+// advisoryKey hashes key into the bigint advisory locks are identified by
+func advisoryKey(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+// ObjectLocker claims keys by creating lease files in storage. Leases are
+// never released, so a key can only ever be claimed once, and record which
+// replica claimed it. Leases older than Expiry are removed.
+type ObjectLocker struct {
+	Store  store.Storer
+	Prefix string
+	// Holder identifies this replica in the leases it creates
+	Holder string
+	// Expiry is how long leases are kept for. Zero keeps them forever.
+	Expiry time.Duration
+
+	creator store.Creator
+}
+
+// NewObjectLocker returns an ObjectLocker creating leases under prefix in s,
+// which must support conditional writes
+func NewObjectLocker(s store.Storer, prefix string) (*ObjectLocker, error) {
+	creator, ok := s.(store.Creator)
+	if !ok {
+		return nil, errors.New("storage does not support conditional writes")
+	}
+	holder, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectLocker{
+		Store:   s,
+		Prefix:  prefix,
+		Holder:  holder,
+		Expiry:  7 * 24 * time.Hour,
+		creator: creator,
+	}, nil
+}
+
+type lease struct {
+	Key      string    `json:"key"`
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+}
+
+// TryLock creates the lease for key
+func (l *ObjectLocker) TryLock(ctx context.Context, key string) (func(), bool, error) {
+	data, err := json.Marshal(lease{Key: key, Holder: l.Holder, Acquired: time.Now().UTC()})
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = l.creator.Create(ctx, l.leaseName(key), data)
+	if err == store.ErrExists {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to create lease")
+	}
+
+	if l.Expiry > 0 {
+		if err := l.expire(ctx); err != nil {
+			log.WithError(err).Warn("Failed to remove expired leases")
+		}
+	}
+	return func() {}, true, nil
+}
+
+func (l *ObjectLocker) leaseName(key string) string {
+	return path.Join(l.Prefix, key+".lease")
+}
+
+// expire removes leases older than Expiry
+func (l *ObjectLocker) expire(ctx context.Context) error {
+	prefix := l.Prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	objects, err := l.Store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-l.Expiry)
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Name, ".lease") && obj.ModTime.Before(cutoff) {
+			if err := l.Store.Delete(ctx, obj.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build integration
+// +build integration
+
+package lock_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/lock"
+)
+
+func integrationDSN() string {
+	if dsn := os.Getenv("DBCLI_DSN"); dsn != "" {
+		return dsn
+	}
+	return "postgres@localhost:5432/postgres?sslmode=disable"
+}
+
+func TestPGLocker_TryLock(t *testing.T) {
+	ctx := context.Background()
+	first, err := lock.NewPGLocker(integrationDSN())
+	require.Nil(t, err)
+	first.MinHold = 200 * time.Millisecond
+	second, err := lock.NewPGLocker(integrationDSN())
+	require.Nil(t, err)
+
+	release, ok, err := first.TryLock(ctx, "default@20240301T120000Z")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	_, ok, err = second.TryLock(ctx, "default@20240301T120000Z")
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	// Still held until MinHold has passed
+	release()
+	_, ok, err = second.TryLock(ctx, "default@20240301T120000Z")
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Eventually(t, func() bool {
+		release, ok, err := second.TryLock(ctx, "default@20240301T120000Z")
+		if err != nil || !ok {
+			return false
+		}
+		release()
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+}
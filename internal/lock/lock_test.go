@@ -0,0 +1,71 @@
+package lock_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/lock"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+func TestObjectLocker_TryLock(t *testing.T) {
+	ctx := context.Background()
+	s := store.File{Dir: t.TempDir()}
+
+	first, err := lock.NewObjectLocker(s, "locks")
+	require.Nil(t, err)
+	second, err := lock.NewObjectLocker(s, "locks")
+	require.Nil(t, err)
+
+	release, ok, err := first.TryLock(ctx, "default@20240301T120000Z")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	release()
+
+	// Leases outlive their release, so the key can't be claimed again
+	_, ok, err = second.TryLock(ctx, "default@20240301T120000Z")
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = second.TryLock(ctx, "default@20240301T130000Z")
+	require.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestObjectLocker_Expiry(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	l, err := lock.NewObjectLocker(store.File{Dir: dir}, "locks")
+	require.Nil(t, err)
+	l.Expiry = time.Hour
+
+	_, ok, err := l.TryLock(ctx, "old")
+	require.Nil(t, err)
+	require.True(t, ok)
+	old := time.Now().Add(-2 * time.Hour)
+	require.Nil(t, os.Chtimes(filepath.Join(dir, "locks", "old.lease"), old, old))
+
+	_, ok, err = l.TryLock(ctx, "new")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	_, err = os.Stat(filepath.Join(dir, "locks", "old.lease"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "locks", "new.lease"))
+	assert.Nil(t, err)
+}
+
+func TestNewObjectLocker_Unsupported(t *testing.T) {
+	_, err := lock.NewObjectLocker(readOnlyStore{}, "locks")
+	assert.Error(t, err)
+}
+
+// readOnlyStore is a Storer that can't do conditional writes
+type readOnlyStore struct {
+	store.Storer
+}
@@ -0,0 +1,142 @@
+package mask
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `
+salt: pepper
+tables:
+  - name: users
+    columns:
+      email: email
+      full_name: name
+      password: "null"
+      notes: truncate:5
+      id: keep
+  - name: billing."Card Details"
+    databases: [billing*]
+    columns:
+      "Card Number": {strategy: hash, length: 8}
+`
+
+const testDump = `--
+-- PostgreSQL database dump
+--
+
+COPY public.users (id, email, full_name, password, notes) FROM stdin;
+1	jane@example.org	Jane Doe	secret	a note\twith a tab
+2	\N	John Smith	hunter2	short
+\.
+
+COPY public.events (id, payload) FROM stdin;
+1	jane@example.org
+\.
+
+COPY billing."Card Details" (id, "Card Number") FROM stdin;
+1	4111111111111111
+\.
+
+CREATE INDEX users_email ON public.users USING btree (email);
+`
+
+func maskDump(t *testing.T, rules *Rules, database, dump string, chunk int) string {
+	t.Helper()
+	var out bytes.Buffer
+	w := NewWriter(&out, rules, database)
+	for len(dump) > 0 {
+		n := min(chunk, len(dump))
+		_, err := w.Write([]byte(dump[:n]))
+		require.Nil(t, err)
+		dump = dump[n:]
+	}
+	require.Nil(t, w.Close())
+	return out.String()
+}
+
+func TestWriter(t *testing.T) {
+	rules, err := Load(strings.NewReader(testRules))
+	require.Nil(t, err)
+
+	// However the dump is split across writes, the result is the same
+	masked := maskDump(t, rules, "billing_eu", testDump, len(testDump))
+	for _, chunk := range []int{1, 7, 64} {
+		assert.Equal(t, masked, maskDump(t, rules, "billing_eu", testDump, chunk))
+	}
+
+	lines := strings.Split(masked, "\n")
+	jane := strings.Split(lines[5], "\t")
+	assert.Equal(t, "1", jane[0])
+	assert.Regexp(t, `^user_[0-9a-f]{12}@example\.com$`, jane[1])
+	assert.NotEqual(t, "Jane Doe", jane[2])
+	assert.Equal(t, `\N`, jane[3])
+	assert.Equal(t, "a not", jane[4])
+
+	john := strings.Split(lines[6], "\t")
+	assert.Equal(t, `\N`, john[1], "NULL stays NULL")
+	assert.Equal(t, "short", john[4])
+
+	assert.Equal(t, "1\tjane@example.org", lines[10], "tables without rules are untouched")
+	assert.Regexp(t, `^1\t[0-9a-f]{8}$`, lines[14])
+	assert.Equal(t, "CREATE INDEX users_email ON public.users USING btree (email);", lines[17])
+	assert.NotContains(t, masked, "hunter2")
+
+	// Rules limited to other databases don't apply
+	other := maskDump(t, rules, "users", testDump, len(testDump))
+	assert.Contains(t, other, "4111111111111111")
+}
+
+func TestWriter_Deterministic(t *testing.T) {
+	c := Column{Strategy: Email}
+	assert.Equal(t, mask(c, "salt", "jane@example.org"), mask(c, "salt", "jane@example.org"))
+	assert.NotEqual(t, mask(c, "salt", "jane@example.org"), mask(c, "other", "jane@example.org"))
+}
+
+func TestWriter_Errors(t *testing.T) {
+	rules, err := Load(strings.NewReader(testRules))
+	require.Nil(t, err)
+
+	const copyUsers = "COPY public.users (id, email, full_name, password, notes) FROM stdin;\n"
+	w := NewWriter(&bytes.Buffer{}, rules, "db")
+	_, err = w.Write([]byte(copyUsers + "1\ta\tb\n"))
+	assert.EqualError(t, err, "COPY row has 3 fields, expected 5")
+
+	// Columns to mask must all be there
+	w = NewWriter(&bytes.Buffer{}, rules, "db")
+	_, err = w.Write([]byte("COPY public.users (id, mail, full_name) FROM stdin;\n"))
+	assert.EqualError(t, err, "no column email, notes, password in public.users to mask")
+
+	w = NewWriter(&bytes.Buffer{}, rules, "db")
+	_, err = w.Write([]byte("COPY public.users FROM stdin;\n"))
+	assert.Error(t, err)
+
+	w = NewWriter(&bytes.Buffer{}, rules, "db")
+	_, err = w.Write([]byte(copyUsers + "1\ta\tb\tc\td\n"))
+	require.Nil(t, err)
+	assert.EqualError(t, w.Close(), "dump ended inside a COPY block")
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	for _, rules := range []string{
+		"tables: [{columns: {a: hash}}]",
+		"tables: [{name: t, columns: {a: scramble}}]",
+		"tables: [{name: t, columns: {a: truncate}}]",
+		"tables: [{name: t, columns: {a: truncate:x}}]",
+		"tables: [{name: t, databases: ['['], columns: {a: hash}}]",
+		"tables: [{name: t, colums: {a: hash}}]",
+	} {
+		_, err := Load(strings.NewReader(rules))
+		assert.Error(t, err, rules)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, "a\tb\nc\\d", unescape(`a\tb\nc\\d`))
+	assert.Equal(t, "A!", unescape(`\101\x21`))
+	assert.Equal(t, `a\tb\nc\\d`, escape("a\tb\nc\\d"))
+}
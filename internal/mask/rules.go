@@ -0,0 +1,162 @@
+// Package mask rewrites the data in plain format postgres dumps, so they can
+// be restored outside production without exposing personal data.
+package mask
+
+import (
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Strategies for masking a column
+const (
+	// Keep leaves values as they are
+	Keep = "keep"
+	// Hash replaces values with their salted SHA-256, hex encoded
+	Hash = "hash"
+	// Email replaces values with a fake email address
+	Email = "email"
+	// Name replaces values with a fake full name
+	Name = "name"
+	// Null replaces values with NULL
+	Null = "null"
+	// Truncate keeps the first Length characters of values
+	Truncate = "truncate"
+)
+
+// Rules are the masking rules of a config file
+type Rules struct {
+	// Salt is mixed into every value that is hashed, so they can't be
+	// reversed by hashing guesses
+	Salt   string  `yaml:"salt"`
+	Tables []Table `yaml:"tables"`
+}
+
+// Table masks the columns of a table
+type Table struct {
+	// Name is the schema qualified name of the table, eg. public.users. The
+	// schema defaults to public, and names may be quoted as in SQL.
+	Name string `yaml:"name"`
+	// Databases limits the rules to databases matching these globs. Empty
+	// matches every database.
+	Databases []string          `yaml:"databases"`
+	Columns   map[string]Column `yaml:"columns"`
+}
+
+// Column masks the values of a column
+type Column struct {
+	Strategy string `yaml:"strategy"`
+	// Length is how many characters truncate keeps, and how many hash keeps
+	// if set
+	Length int `yaml:"length"`
+}
+
+// UnmarshalYAML accepts a column as a mapping or, more briefly, as a strategy
+// optionally followed by a length, eg. "email" or "truncate:10"
+func (c *Column) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		type column Column
+		return node.Decode((*column)(c))
+	}
+	strategy, length, ok := strings.Cut(node.Value, ":")
+	c.Strategy = strategy
+	if ok {
+		n, err := strconv.Atoi(length)
+		if err != nil {
+			return errors.Errorf("invalid length in %q", node.Value)
+		}
+		c.Length = n
+	}
+	return nil
+}
+
+// Load reads and validates rules
+func Load(r io.Reader) (*Rules, error) {
+	rules := &Rules{}
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(rules); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "failed to parse masking rules")
+	}
+	if err := rules.validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadFile reads and validates the rules in the file at filename
+func LoadFile(filename string) (*Rules, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open masking rules")
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+func (r *Rules) validate() error {
+	for i, t := range r.Tables {
+		if t.Name == "" {
+			return errors.Errorf("masking rule %d has no table name", i)
+		}
+		if _, rest, err := parseQualifiedName(t.Name); err != nil || rest != "" {
+			return errors.Errorf("invalid table name %q", t.Name)
+		}
+		for _, pattern := range t.Databases {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid database pattern %q for table %s", pattern, t.Name)
+			}
+		}
+		for name, c := range t.Columns {
+			switch c.Strategy {
+			case Keep, Hash, Email, Name, Null:
+				if c.Length < 0 {
+					return errors.Errorf("negative length for %s.%s", t.Name, name)
+				}
+			case Truncate:
+				if c.Length <= 0 {
+					return errors.Errorf("truncate needs a positive length for %s.%s", t.Name, name)
+				}
+			default:
+				return errors.Errorf("unknown masking strategy %q for %s.%s", c.Strategy, t.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// forDatabase returns the columns to mask in the database, by the qualified
+// name of their table. Later rules for a column win.
+func (r *Rules) forDatabase(database string) map[string]map[string]Column {
+	tables := map[string]map[string]Column{}
+	for _, t := range r.Tables {
+		if !matchAny(t.Databases, database) {
+			continue
+		}
+		name, _, _ := parseQualifiedName(t.Name) // nolint:errcheck
+		if tables[name] == nil {
+			tables[name] = map[string]Column{}
+		}
+		for column, c := range t.Columns {
+			tables[name][column] = c
+		}
+	}
+	return tables
+}
+
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok { // nolint:errcheck
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package mask
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+var (
+	firstNames = []string{
+		"Alex", "Sam", "Jordan", "Taylor", "Morgan", "Casey", "Jamie", "Robin",
+		"Charlie", "Avery", "Riley", "Quinn", "Drew", "Rowan", "Elliot", "Kai",
+	}
+	lastNames = []string{
+		"Smith", "Jones", "Taylor", "Brown", "Williams", "Wilson", "Johnson", "Davies",
+		"Patel", "Robinson", "Wright", "Thompson", "Evans", "Walker", "White", "Roberts",
+	}
+)
+
+// mask applies c to a value that isn't NULL. The fake values are derived
+// from a hash of the value, so equal values stay equal and joins on masked
+// columns still work.
+func mask(c Column, salt, value string) string {
+	sum := sha256.Sum256([]byte(salt + value))
+	switch c.Strategy {
+	case Hash:
+		h := hex.EncodeToString(sum[:])
+		if c.Length > 0 && c.Length < len(h) {
+			h = h[:c.Length]
+		}
+		return h
+	case Email:
+		return "user_" + hex.EncodeToString(sum[:6]) + "@example.com"
+	case Name:
+		first := binary.BigEndian.Uint32(sum[0:4]) % uint32(len(firstNames))
+		last := binary.BigEndian.Uint32(sum[4:8]) % uint32(len(lastNames))
+		return firstNames[first] + " " + lastNames[last]
+	case Truncate:
+		r := []rune(value)
+		if len(r) > c.Length {
+			return string(r[:c.Length])
+		}
+		return value
+	default:
+		return value
+	}
+}
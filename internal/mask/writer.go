@@ -0,0 +1,339 @@
+package mask
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nullValue is how COPY's text format writes NULL
+const nullValue = `\N`
+
+// Writer masks the rows of the COPY blocks in a plain format dump written
+// through it, passing everything else through unchanged. Rows are buffered a
+// line at a time, so Close must be called to flush the end of the dump.
+type Writer struct {
+	w      *bufio.Writer
+	salt   string
+	tables map[string]map[string]Column
+
+	// line holds the start of a line split across writes
+	line []byte
+	// inCopy is set between a COPY statement and the end of its data
+	inCopy bool
+	// columns are the rules for each column of the current COPY block, nil
+	// if none of them are masked
+	columns []*Column
+	err     error
+}
+
+// NewWriter returns a Writer masking the dump of database with rules and
+// writing it to w
+func NewWriter(w io.Writer, rules *Rules, database string) *Writer {
+	return &Writer{
+		w:      bufio.NewWriter(w),
+		salt:   rules.Salt,
+		tables: rules.forDatabase(database),
+	}
+}
+
+// Write masks the complete lines in p and buffers any incomplete one
+func (mw *Writer) Write(p []byte) (int, error) {
+	if mw.err != nil {
+		return 0, mw.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			mw.line = append(mw.line, p...)
+			break
+		}
+		line := p[:i]
+		if len(mw.line) > 0 {
+			mw.line = append(mw.line, line...)
+			line = mw.line
+		}
+		if mw.err = mw.writeLine(line); mw.err != nil {
+			return 0, mw.err
+		}
+		mw.line = mw.line[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close writes out any incomplete last line and flushes the underlying
+// writer. It doesn't close it.
+func (mw *Writer) Close() error {
+	if mw.err != nil {
+		return mw.err
+	}
+	if mw.inCopy {
+		return errors.New("dump ended inside a COPY block")
+	}
+	if _, err := mw.w.Write(mw.line); err != nil {
+		return err
+	}
+	return mw.w.Flush()
+}
+
+func (mw *Writer) writeLine(line []byte) error {
+	switch {
+	case mw.inCopy && string(line) == `\.`:
+		mw.inCopy, mw.columns = false, nil
+	case mw.inCopy && mw.columns != nil:
+		masked, err := mw.maskRow(line)
+		if err != nil {
+			return err
+		}
+		line = masked
+	case !mw.inCopy && bytes.HasPrefix(line, []byte("COPY ")):
+		if err := mw.startCopy(string(line)); err != nil {
+			return err
+		}
+	}
+	if _, err := mw.w.Write(line); err != nil {
+		return err
+	}
+	return mw.w.WriteByte('\n')
+}
+
+// startCopy reads the table and columns of a statement such as
+// COPY public.users (id, email) FROM stdin;
+func (mw *Writer) startCopy(stmt string) error {
+	rest, ok := strings.CutSuffix(strings.TrimPrefix(stmt, "COPY "), " FROM stdin;")
+	if !ok {
+		// Not the start of a COPY block in a dump
+		return nil
+	}
+	mw.inCopy = true
+
+	table, rest, err := parseQualifiedName(rest)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %q", stmt)
+	}
+	rules := mw.tables[table]
+	if len(rules) == 0 {
+		return nil
+	}
+	if !strings.HasPrefix(rest, " (") || !strings.HasSuffix(rest, ")") {
+		return errors.Errorf("no column list to mask %s by in %q", table, stmt)
+	}
+	names, err := parseColumns(rest[2 : len(rest)-1])
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %q", stmt)
+	}
+
+	mw.columns = make([]*Column, len(names))
+	found := 0
+	for i, name := range names {
+		c, ok := rules[name]
+		if !ok {
+			continue
+		}
+		found++
+		if c.Strategy != Keep {
+			mw.columns[i] = &c
+		}
+	}
+	if found < len(rules) {
+		// A renamed column would otherwise be dumped unmasked
+		var missing []string
+		for name := range rules {
+			if !slices.Contains(names, name) {
+				missing = append(missing, name)
+			}
+		}
+		sort.Strings(missing)
+		return errors.Errorf("no column %s in %s to mask", strings.Join(missing, ", "), table)
+	}
+	return nil
+}
+
+func (mw *Writer) maskRow(row []byte) ([]byte, error) {
+	fields := strings.Split(string(row), "\t")
+	if len(fields) != len(mw.columns) {
+		return nil, errors.Errorf("COPY row has %d fields, expected %d", len(fields), len(mw.columns))
+	}
+	for i, c := range mw.columns {
+		if c == nil || fields[i] == nullValue {
+			continue
+		}
+		if c.Strategy == Null {
+			fields[i] = nullValue
+			continue
+		}
+		fields[i] = escape(mask(*c, mw.salt, unescape(fields[i])))
+	}
+	return []byte(strings.Join(fields, "\t")), nil
+}
+
+// parseQualifiedName parses a possibly quoted schema.table name at the start
+// of s, returning it unquoted and what follows it. The schema defaults to
+// public.
+func parseQualifiedName(s string) (string, string, error) {
+	schema, rest, err := parseIdentifier(s)
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.HasPrefix(rest, ".") {
+		return "public." + schema, rest, nil
+	}
+	table, rest, err := parseIdentifier(rest[1:])
+	if err != nil {
+		return "", "", err
+	}
+	return schema + "." + table, rest, nil
+}
+
+// parseColumns parses a comma separated list of possibly quoted identifiers
+func parseColumns(s string) ([]string, error) {
+	var names []string
+	for {
+		name, rest, err := parseIdentifier(strings.TrimLeft(s, " "))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if rest == "" {
+			return names, nil
+		}
+		if !strings.HasPrefix(rest, ",") {
+			return nil, errors.Errorf("unexpected %q in column list", rest)
+		}
+		s = rest[1:]
+	}
+}
+
+// parseIdentifier parses the identifier at the start of s. Quoted
+// identifiers are unquoted, and unquoted ones run until a space, dot, comma
+// or parenthesis.
+func parseIdentifier(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		end := strings.IndexAny(s, " .,()")
+		if end == -1 {
+			end = len(s)
+		}
+		if end == 0 {
+			return "", "", errors.Errorf("expected an identifier at %q", s)
+		}
+		return s[:end], s[end:], nil
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			b.WriteByte(s[i])
+			continue
+		}
+		// A doubled quote is a literal one
+		if i+1 < len(s) && s[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+			continue
+		}
+		return b.String(), s[i+1:], nil
+	}
+	return "", "", errors.Errorf("unterminated identifier in %q", s)
+}
+
+// unescape decodes a value in COPY's text format
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			v, n := parseDigits(s[i+1:], 16, 2)
+			if n == 0 {
+				b.WriteByte(c)
+				continue
+			}
+			b.WriteByte(v)
+			i += n
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			v, n := parseDigits(s[i:], 8, 3)
+			b.WriteByte(v)
+			i += n - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseDigits parses up to limit digits in base at the start of s, returning
+// the value and how many digits there were
+func parseDigits(s string, base, limit int) (byte, int) {
+	var v, n int
+	for n < limit && n < len(s) {
+		d := strings.IndexByte("0123456789abcdef", lower(s[n]))
+		if d == -1 || d >= base {
+			break
+		}
+		v = v*base + d
+		n++
+	}
+	return byte(v), n
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'F' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// escape encodes a value in COPY's text format
+func escape(s string) string {
+	if !strings.ContainsAny(s, "\\\b\f\n\r\t\v") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\v':
+			b.WriteString(`\v`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,215 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+)
+
+// Statuses of a run
+const (
+	StatusFailed    = "failed"
+	StatusRecovered = "recovered"
+	StatusSucceeded = "succeeded"
+)
+
+// Triggers deciding which runs are notified about
+const (
+	// OnFailure notifies about failed runs
+	OnFailure = "failure"
+	// OnRecovery notifies about failed runs and the first successful run
+	// after a failure
+	OnRecovery = "recovery"
+	// OnAlways notifies about every run
+	OnAlways = "always"
+)
+
+// DefaultTemplate is the message sent when no template is configured
+const DefaultTemplate = `Backup {{.Status}} for job {{.Job}}
+{{- if .Run.Error}}: {{.Run.Error}}{{end}}
+{{- range .Failed}}
+{{.Name}}: {{.Error}}
+{{- end}}
+{{- range .Run.Missing}}
+{{.}}: not found
+{{- end}}
+{{- range .Changed}}
+{{.Name}}: {{len .SchemaChanges}} schema changes
+{{- end}}`
+
+// Event is a finished run being notified about. It is what message templates
+// are executed with.
+type Event struct {
+	Job    string
+	Status string
+	Run    *report.Run
+}
+
+// Failed returns the databases that failed to be backed up
+func (e Event) Failed() []report.Database {
+	var failed []report.Database
+	for _, d := range e.Run.Databases {
+		if d.Status == report.StatusFailed {
+			failed = append(failed, d)
+		}
+	}
+	return failed
+}
+
+// Changed returns the databases whose schema changed since their previous
+// backup
+func (e Event) Changed() []report.Database {
+	var changed []report.Database
+	for _, d := range e.Run.Databases {
+		if len(d.SchemaChanges) > 0 {
+			changed = append(changed, d)
+		}
+	}
+	return changed
+}
+
+// Sender delivers a message about an event
+type Sender interface {
+	Send(ctx context.Context, e Event, msg string) error
+}
+
+// Notifier decides which runs to notify about and sends them with a Sender.
+// It is safe for concurrent use.
+type Notifier struct {
+	Sender Sender
+	// On is one of OnFailure, OnRecovery or OnAlways
+	On string
+	// OnSchemaChange also notifies about runs that found schema changes,
+	// whatever On is
+	OnSchemaChange bool
+	// MinInterval is the least time between notifications about the same
+	// job, so a failing job doesn't flood the channel. Recoveries are always
+	// sent.
+	MinInterval time.Duration
+	// State, if set, keeps whether jobs are failing and when they were last
+	// notified about beyond the life of the Notifier
+	State State
+
+	tmpl *template.Template
+
+	mu       sync.Mutex
+	failing  map[string]bool
+	lastSent map[string]time.Time
+}
+
+// New returns a Notifier sending messages rendered from tmpl, or from
+// DefaultTemplate if tmpl is empty
+func New(sender Sender, on string, tmpl string, minInterval time.Duration) (*Notifier, error) {
+	switch on {
+	case OnFailure, OnRecovery, OnAlways:
+	case "":
+		on = OnFailure
+	default:
+		return nil, fmt.Errorf("unknown notification trigger: %s", on)
+	}
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+	t, err := template.New("message").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification template: %v", err)
+	}
+	return &Notifier{
+		Sender:      sender,
+		On:          on,
+		MinInterval: minInterval,
+		tmpl:        t,
+		failing:     map[string]bool{},
+		lastSent:    map[string]time.Time{},
+	}, nil
+}
+
+// Notify sends a notification about a finished run of job, if its trigger
+// and rate limit allow
+func (n *Notifier) Notify(ctx context.Context, job string, run *report.Run) error {
+	e := Event{Job: job, Run: run.Snapshot()}
+
+	n.mu.Lock()
+	n.load(ctx, job)
+	switch failed := e.Run.Error != ""; {
+	case failed:
+		e.Status = StatusFailed
+	case n.failing[job]:
+		e.Status = StatusRecovered
+	default:
+		e.Status = StatusSucceeded
+	}
+	n.failing[job] = e.Status == StatusFailed
+
+	changed := n.OnSchemaChange && len(e.Changed()) > 0
+	if !n.triggered(e.Status) && !changed {
+		n.save(ctx, job)
+		n.mu.Unlock()
+		return nil
+	}
+	if last, ok := n.lastSent[job]; ok && e.Status != StatusRecovered && time.Since(last) < n.MinInterval {
+		n.save(ctx, job)
+		n.mu.Unlock()
+		log.WithFields(log.Fields{
+			"job":    job,
+			"status": e.Status,
+		}).Debug("Notification suppressed by rate limit")
+		return nil
+	}
+	n.lastSent[job] = time.Now()
+	n.save(ctx, job)
+	n.mu.Unlock()
+
+	var msg bytes.Buffer
+	if err := n.tmpl.Execute(&msg, e); err != nil {
+		return fmt.Errorf("failed to render notification: %v", err)
+	}
+	return n.Sender.Send(ctx, e, msg.String())
+}
+
+// load replaces what n knows about job with its State, if any. Failing to
+// load it falls back to what n knows.
+func (n *Notifier) load(ctx context.Context, job string) {
+	if n.State == nil {
+		return
+	}
+	s, err := n.State.Load(ctx, job)
+	if err != nil {
+		log.WithError(err).WithField("job", job).Warn("Failed to load notification state")
+		return
+	}
+	if s == nil {
+		return
+	}
+	n.failing[job] = s.Failing
+	if !s.LastSent.IsZero() {
+		n.lastSent[job] = s.LastSent
+	}
+}
+
+func (n *Notifier) save(ctx context.Context, job string) {
+	if n.State == nil {
+		return
+	}
+	s := JobState{Failing: n.failing[job], LastSent: n.lastSent[job]}
+	if err := n.State.Save(ctx, job, s); err != nil {
+		log.WithError(err).WithField("job", job).Warn("Failed to save notification state")
+	}
+}
+
+func (n *Notifier) triggered(status string) bool {
+	switch n.On {
+	case OnAlways:
+		return true
+	case OnRecovery:
+		return status != StatusSucceeded
+	default:
+		return status == StatusFailed
+	}
+}
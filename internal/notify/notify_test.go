@@ -0,0 +1,222 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/notify"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+	"github.com/utilitywarehouse/sql-backup/internal/schema"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+type sent struct {
+	status string
+	msg    string
+}
+
+type recordingSender struct {
+	sent []sent
+}
+
+func (s *recordingSender) Send(ctx context.Context, e notify.Event, msg string) error {
+	s.sent = append(s.sent, sent{e.Status, msg})
+	return nil
+}
+
+func finishedRun(err error) *report.Run {
+	run := report.New()
+	run.AddDatabase(report.Database{Name: "users", Finished: time.Now()})
+	if err != nil {
+		run.AddDatabase(report.Database{Name: "billing", Finished: time.Now(), Error: err.Error()})
+	}
+	run.Finish(err)
+	return run
+}
+
+func statuses(s *recordingSender) []string {
+	var statuses []string
+	for _, m := range s.sent {
+		statuses = append(statuses, m.status)
+	}
+	return statuses
+}
+
+func TestNotify_Triggers(t *testing.T) {
+	failure := errors.New("dumping failed")
+	runs := []error{nil, failure, failure, nil, nil}
+
+	for on, expected := range map[string][]string{
+		notify.OnFailure:  {notify.StatusFailed, notify.StatusFailed},
+		notify.OnRecovery: {notify.StatusFailed, notify.StatusFailed, notify.StatusRecovered},
+		notify.OnAlways: {
+			notify.StatusSucceeded,
+			notify.StatusFailed,
+			notify.StatusFailed,
+			notify.StatusRecovered,
+			notify.StatusSucceeded,
+		},
+	} {
+		s := &recordingSender{}
+		n, err := notify.New(s, on, "", 0)
+		require.Nil(t, err)
+		for _, runErr := range runs {
+			require.Nil(t, n.Notify(context.Background(), "default", finishedRun(runErr)))
+		}
+		assert.Equal(t, expected, statuses(s), on)
+	}
+}
+
+func TestNotify_MinInterval(t *testing.T) {
+	s := &recordingSender{}
+	n, err := notify.New(s, notify.OnRecovery, "", time.Hour)
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	failure := errors.New("dumping failed")
+	require.Nil(t, n.Notify(ctx, "default", finishedRun(failure)))
+	require.Nil(t, n.Notify(ctx, "default", finishedRun(failure)))
+	// Jobs are limited separately
+	require.Nil(t, n.Notify(ctx, "other", finishedRun(failure)))
+	// Recoveries aren't limited
+	require.Nil(t, n.Notify(ctx, "default", finishedRun(nil)))
+
+	assert.Equal(t, []string{notify.StatusFailed, notify.StatusFailed, notify.StatusRecovered}, statuses(s))
+}
+
+func TestNotify_State(t *testing.T) {
+	state := notify.StoreState{Store: store.File{Dir: t.TempDir()}, Prefix: "notifications/0"}
+	s := &recordingSender{}
+	// Each run gets a new Notifier, as with the once command
+	notifyRun := func(err error) {
+		n, nerr := notify.New(s, notify.OnRecovery, "", time.Hour)
+		require.Nil(t, nerr)
+		n.State = state
+		require.Nil(t, n.Notify(context.Background(), "default", finishedRun(err)))
+	}
+
+	failure := errors.New("dumping failed")
+	notifyRun(failure)
+	notifyRun(failure)
+	notifyRun(nil)
+	notifyRun(nil)
+
+	assert.Equal(t, []string{notify.StatusFailed, notify.StatusRecovered}, statuses(s))
+}
+
+func TestNotify_SchemaChange(t *testing.T) {
+	s := &recordingSender{}
+	n, err := notify.New(s, notify.OnFailure, "", time.Hour)
+	require.Nil(t, err)
+	n.OnSchemaChange = true
+
+	ctx := context.Background()
+	require.Nil(t, n.Notify(ctx, "default", finishedRun(nil)))
+	assert.Empty(t, s.sent)
+
+	changed := func() *report.Run {
+		run := finishedRun(nil)
+		run.AddDatabase(report.Database{
+			Name:          "users",
+			Finished:      time.Now(),
+			SchemaChanges: []schema.Change{{Action: schema.Added, Type: schema.Column, Name: "public.users.email"}},
+		})
+		return run
+	}
+	// Schema changes are rate limited like anything else
+	require.Nil(t, n.Notify(ctx, "default", changed()))
+	require.Nil(t, n.Notify(ctx, "default", changed()))
+	assert.Equal(t, []string{notify.StatusSucceeded}, statuses(s))
+	assert.Equal(t, "Backup succeeded for job default\nusers: 1 schema changes", s.sent[0].msg)
+}
+
+func TestNotify_Template(t *testing.T) {
+	s := &recordingSender{}
+	n, err := notify.New(s, notify.OnFailure, "", 0)
+	require.Nil(t, err)
+	require.Nil(t, n.Notify(context.Background(), "default", finishedRun(errors.New("dumping failed"))))
+	assert.Equal(t, "Backup failed for job default: dumping failed\nbilling: dumping failed", s.sent[0].msg)
+
+	s = &recordingSender{}
+	n, err = notify.New(s, notify.OnFailure, "{{.Job}} {{len .Failed}}", 0)
+	require.Nil(t, err)
+	require.Nil(t, n.Notify(context.Background(), "default", finishedRun(errors.New("dumping failed"))))
+	assert.Equal(t, "default 1", s.sent[0].msg)
+
+	_, err = notify.New(s, notify.OnFailure, "{{.Job", 0)
+	assert.Error(t, err)
+	_, err = notify.New(s, "sometimes", "", 0)
+	assert.Error(t, err)
+}
+
+func TestWebhook(t *testing.T) {
+	var payload map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+	}))
+	defer srv.Close()
+
+	n, err := notify.New(notify.Webhook{URL: srv.URL}, notify.OnFailure, "", 0)
+	require.Nil(t, err)
+	require.Nil(t, n.Notify(context.Background(), "default", finishedRun(errors.New("dumping failed"))))
+
+	assert.Equal(t, "default", payload["job"])
+	assert.Equal(t, notify.StatusFailed, payload["status"])
+	run := payload["run"].(map[string]interface{})
+	assert.Equal(t, "dumping failed", run["error"])
+	assert.Len(t, run["databases"], 2)
+}
+
+func TestSlack(t *testing.T) {
+	var payload map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+	}))
+	defer srv.Close()
+
+	n, err := notify.New(notify.Slack{URL: srv.URL}, notify.OnFailure, "{{.Job}} {{.Status}}", 0)
+	require.Nil(t, err)
+	require.Nil(t, n.Notify(context.Background(), "default", finishedRun(errors.New("dumping failed"))))
+	assert.Equal(t, map[string]string{"text": "default failed"}, payload)
+}
+
+func TestEmail_Timeout(t *testing.T) {
+	// A server that accepts connections but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	m := notify.Email{Addr: l.Addr().String(), From: "backup@example.com", To: []string{"ops@example.com"}, Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	assert.Error(t, m.Send(context.Background(), notify.Event{Job: "default", Status: notify.StatusFailed}, "failed"))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestWebhook_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	n, err := notify.New(notify.Webhook{URL: srv.URL}, notify.OnFailure, "", 0)
+	require.Nil(t, err)
+	assert.Error(t, n.Notify(context.Background(), "default", finishedRun(errors.New("dumping failed"))))
+}
@@ -0,0 +1,172 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+)
+
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// Webhook posts a JSON payload with the message and the run's report
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+type webhookPayload struct {
+	Job     string      `json:"job"`
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Run     *report.Run `json:"run"`
+}
+
+// Send posts the event to the webhook
+func (w Webhook) Send(ctx context.Context, e Event, msg string) error {
+	return postJSON(ctx, w.Client, w.URL, webhookPayload{
+		Job:     e.Job,
+		Status:  e.Status,
+		Message: msg,
+		Run:     e.Run,
+	})
+}
+
+// Slack posts the message to a Slack incoming webhook
+type Slack struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send posts the message to Slack
+func (s Slack) Send(ctx context.Context, e Event, msg string) error {
+	return postJSON(ctx, s.Client, s.URL, map[string]string{"text": msg})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = defaultClient
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send notification")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return errors.Errorf("failed to send notification: %s", resp.Status)
+	}
+	return nil
+}
+
+// Email sends the message by SMTP. Auth is only used if Username is set.
+type Email struct {
+	// Addr is the host:port of the SMTP server
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+	// Timeout bounds the whole exchange with the server, 30s if zero
+	Timeout time.Duration
+}
+
+// Send emails the message. STARTTLS is used if the server supports it.
+func (m Email) Send(ctx context.Context, e Event, msg string) error {
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", m.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&body, "Subject: [sql-backup] Backup %s for job %s\r\n", e.Status, e.Job)
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(msg, "\n", "\r\n"))
+
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to send notification email")
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return errors.Wrap(err, "failed to send notification email")
+	}
+	// Deadlines don't catch cancellation, so close the connection on it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "failed to send notification email")
+	}
+	defer c.Close()
+	if err := m.send(c, host, body.Bytes()); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return errors.Wrap(err, "failed to send notification email")
+	}
+	return nil
+}
+
+// send does what smtp.SendMail does over an established client
+func (m Email) send(c *smtp.Client, host string, body []byte) error {
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+// JobState is what a Notifier remembers about a job between runs
+type JobState struct {
+	Failing  bool      `json:"failing"`
+	LastSent time.Time `json:"last_sent,omitempty"`
+}
+
+// State keeps the JobStates of a Notifier, so recoveries and rate limits hold
+// across restarts and runs of the once command
+type State interface {
+	// Load returns the job's state, or nil if it has none
+	Load(ctx context.Context, job string) (*JobState, error)
+	Save(ctx context.Context, job string, s JobState) error
+}
+
+// StoreState keeps JobStates as JSON files under Prefix in Store
+type StoreState struct {
+	Store  store.Storer
+	Prefix string
+}
+
+func (s StoreState) name(job string) string {
+	return path.Join(s.Prefix, job+".json")
+}
+
+// Load reads the job's state
+func (s StoreState) Load(ctx context.Context, job string) (*JobState, error) {
+	ok, err := s.Store.Exists(ctx, s.name(job))
+	if err != nil || !ok {
+		return nil, err
+	}
+	r, err := s.Store.Reader(ctx, s.name(job))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var st JobState
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Save writes the job's state
+func (s StoreState) Save(ctx context.Context, job string, st JobState) error {
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	w, err := s.Store.Writer(ctx, s.name(job))
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		abort()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
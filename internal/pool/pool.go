@@ -3,7 +3,11 @@ package pool
 import (
 	"context"
 	"errors"
-	"sync"
+	"fmt"
+	"sort"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 var (
@@ -11,66 +15,141 @@ var (
 	ErrZeroItems = errors.New("zero items provided")
 )
 
+const (
+	// FIFO handles items in the order they were provided
+	FIFO Strategy = "fifo"
+	// LargestFirst handles the largest items first, so the longest running
+	// ones don't start last
+	LargestFirst Strategy = "largest-first"
+	// SmallestFirst handles the smallest items first, so as many as possible
+	// are done early. Items of unknown size are handled last.
+	SmallestFirst Strategy = "smallest-first"
+)
+
+// Strategy decides the order items in a pool are handled in
+type Strategy string
+
+// ParseStrategy returns the Strategy named s
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case FIFO, LargestFirst, SmallestFirst:
+		return Strategy(s), nil
+	case "":
+		return FIFO, nil
+	default:
+		return "", fmt.Errorf("unknown pool strategy: %s", s)
+	}
+}
+
+// Item is a unit of work handled by a pool
+type Item struct {
+	Name string
+	// Size is used to order and weight items. Zero or less if unknown.
+	Size int64
+}
+
 // Handler handles
 type Handler func(ctx context.Context, db string) error
 
 // Pooler interface abstracts a Pool instance
 type Pooler interface {
-	Start(context.Context, []string, Handler) error
+	Start(context.Context, []Item, Handler) error
 }
 
 // SizablePool is a pool with a size!
 type SizablePool struct {
-	Size int
+	Size     int
+	Strategy Strategy
+	// Priority names items handled before all others, in the order listed
+	Priority []string
+	// SlotSize is the item size that occupies one of the pool's Size slots.
+	// Larger items occupy proportionally more slots, up to all of them, so
+	// fewer are handled alongside them. Zero means every item occupies one.
+	SlotSize int64
 }
 
-// Start kicks handling of items in a pool
-func (p SizablePool) Start(ctx context.Context, items []string, h Handler) error {
+// Start kicks handling of items in a pool. The first handler to fail cancels
+// the context passed to the rest. Start only returns once every handler it
+// started has returned, so handlers must stop promptly when their context is
+// cancelled.
+func (p SizablePool) Start(ctx context.Context, items []Item, h Handler) error {
 	if len(items) == 0 {
 		return ErrZeroItems
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(items))
+	if p.Size < 1 {
+		p.Size = 1
+	}
+	slots := semaphore.NewWeighted(int64(p.Size))
+	g, gCtx := errgroup.WithContext(ctx)
 
-	jobs := make(chan string)
-	errCh := make(chan error)
-	doneCh := make(chan struct{})
+	for _, item := range p.order(items) {
+		weight := p.weight(item)
+		// Only fails once gCtx is cancelled, in which case whatever caused
+		// that is returned by Wait or below
+		if err := slots.Acquire(gCtx, weight); err != nil {
+			break
+		}
 
-	finishCtx, finishCancel := context.WithCancel(ctx)
-	defer finishCancel()
+		name := item.Name
+		g.Go(func() error {
+			defer slots.Release(weight)
+			return h(gCtx, name)
+		})
+	}
 
-	if p.Size < 1 {
-		p.Size = 1
+	err := g.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
-	for i := 0; i < p.Size; i++ {
-		go func() {
-			for job := range jobs {
-				func(t string) {
-					defer wg.Done()
-					if err := h(finishCtx, t); err != nil {
-						errCh <- err
-					}
-				}(job)
-			}
-		}()
+	return err
+}
+
+// order returns items in the order they should be handled
+func (p SizablePool) order(items []Item) []Item {
+	ordered := make([]Item, len(items))
+	copy(ordered, items)
+
+	priority := map[string]int{}
+	for i, name := range p.Priority {
+		if _, ok := priority[name]; !ok {
+			priority[name] = i
+		}
+	}
+	rank := func(item Item) int {
+		if r, ok := priority[item.Name]; ok {
+			return r
+		}
+		return len(p.Priority)
 	}
 
-	go func() {
-		for _, item := range items {
-			jobs <- item
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ri, rj := rank(ordered[i]), rank(ordered[j]); ri != rj {
+			return ri < rj
+		}
+		switch p.Strategy {
+		case LargestFirst:
+			return ordered[i].Size > ordered[j].Size
+		case SmallestFirst:
+			if ki, kj := ordered[i].Size > 0, ordered[j].Size > 0; ki != kj {
+				return ki
+			}
+			return ordered[i].Size < ordered[j].Size
+		default:
+			return false
 		}
-		close(jobs)
-		wg.Wait()
-		close(doneCh)
-	}()
+	})
+	return ordered
+}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-errCh:
-		return err
-	case <-doneCh:
-		return nil
+// weight returns the number of slots item occupies
+func (p SizablePool) weight(item Item) int64 {
+	if p.SlotSize <= 0 || item.Size <= 0 {
+		return 1
+	}
+	weight := (item.Size + p.SlotSize - 1) / p.SlotSize
+	if weight > int64(p.Size) {
+		weight = int64(p.Size)
 	}
+	return weight
 }
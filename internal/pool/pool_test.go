@@ -0,0 +1,166 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func names(items []Item) []string {
+	var n []string
+	for _, item := range items {
+		n = append(n, item.Name)
+	}
+	return n
+}
+
+func TestSizablePool_Order(t *testing.T) {
+	items := []Item{{"small", 10}, {"large", 300}, {"unknown", -1}, {"medium", 100}, {"billing", 50}}
+
+	inputs := []struct {
+		strategy Strategy
+		priority []string
+		expected []string
+	}{
+		{FIFO, nil, []string{"small", "large", "unknown", "medium", "billing"}},
+		{LargestFirst, nil, []string{"large", "medium", "billing", "small", "unknown"}},
+		{SmallestFirst, nil, []string{"small", "billing", "medium", "large", "unknown"}},
+		{LargestFirst, []string{"billing", "small"}, []string{"billing", "small", "large", "medium", "unknown"}},
+	}
+
+	for _, input := range inputs {
+		p := SizablePool{Strategy: input.strategy, Priority: input.priority}
+		assert.Equal(t, input.expected, names(p.order(items)))
+	}
+}
+
+func TestSizablePool_Weight(t *testing.T) {
+	p := SizablePool{Size: 4, SlotSize: 100}
+
+	assert.Equal(t, int64(1), p.weight(Item{Size: -1}))
+	assert.Equal(t, int64(1), p.weight(Item{Size: 100}))
+	assert.Equal(t, int64(2), p.weight(Item{Size: 101}))
+	assert.Equal(t, int64(4), p.weight(Item{Size: 10000}))
+	assert.Equal(t, int64(1), SizablePool{Size: 4}.weight(Item{Size: 10000}))
+}
+
+func TestSizablePool_WeightedConcurrency(t *testing.T) {
+	p := SizablePool{Size: 2, SlotSize: 100, Strategy: LargestFirst}
+	items := []Item{{"a", 10}, {"big", 500}, {"b", 10}, {"c", 10}}
+	weights := map[string]int64{}
+	for _, item := range items {
+		weights[item.Name] = p.weight(item)
+	}
+
+	var mu sync.Mutex
+	running := map[string]bool{}
+	var weight, peak int64
+	bigRanAlone := true
+	err := p.Start(context.Background(), items, func(ctx context.Context, name string) error {
+		mu.Lock()
+		if running["big"] || (name == "big" && len(running) > 0) {
+			bigRanAlone = false
+		}
+		running[name] = true
+		weight += weights[name]
+		if weight > peak {
+			peak = weight
+		}
+		mu.Unlock()
+
+		// Hold the slots long enough for other items to start alongside
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		delete(running, name)
+		weight -= weights[name]
+		mu.Unlock()
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, bigRanAlone)
+	assert.Equal(t, int64(2), peak)
+}
+
+var errHandler = errors.New("handler failed")
+
+// blockingHandler fails for "fail" and blocks every other item until its
+// context is cancelled, like a dump that has to be killed.
+func blockingHandler(running *int32) Handler {
+	return func(ctx context.Context, name string) error {
+		atomic.AddInt32(running, 1)
+		defer atomic.AddInt32(running, -1)
+		if name == "fail" {
+			return errHandler
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+}
+
+// assertNoLeaks fails if more goroutines are running than before, after
+// giving any that are exiting a moment to do so.
+func assertNoLeaks(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines leaked")
+}
+
+func TestSizablePool_NoLeaksOnHandlerError(t *testing.T) {
+	items := []Item{{Name: "one"}, {Name: "two"}, {Name: "fail"}, {Name: "three"}, {Name: "four"}, {Name: "five"}}
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 500; i++ {
+		var running int32
+		p := SizablePool{Size: 3}
+
+		err := p.Start(context.Background(), items, blockingHandler(&running))
+		assert.Equal(t, errHandler, err)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&running), "handlers still running after Start returned")
+	}
+
+	assertNoLeaks(t, before)
+}
+
+func TestSizablePool_NoLeaksOnCancel(t *testing.T) {
+	items := []Item{{Name: "one"}, {Name: "two"}, {Name: "three"}, {Name: "four"}, {Name: "five"}}
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 500; i++ {
+		var running int32
+		p := SizablePool{Size: 2, SlotSize: 1}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Duration(i%3)*time.Millisecond, cancel)
+
+		err := p.Start(ctx, items, blockingHandler(&running))
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&running), "handlers still running after Start returned")
+		cancel()
+	}
+
+	assertNoLeaks(t, before)
+}
+
+func TestSizablePool_AllHandled(t *testing.T) {
+	var handled int32
+	items := []Item{{Name: "one"}, {Name: "two"}, {Name: "three"}}
+
+	err := SizablePool{Size: 2}.Start(context.Background(), items, func(ctx context.Context, name string) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), handled)
+
+	assert.Equal(t, ErrZeroItems, SizablePool{}.Start(context.Background(), nil, nil))
+}
@@ -0,0 +1,176 @@
+package report
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/sql-backup/internal/schema"
+)
+
+// Database statuses
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Run is a report of a single backup run
+type Run struct {
+	mu sync.Mutex
+
+	ID  string `json:"id"`
+	Job string `json:"job,omitempty"`
+	// Kind is the kind of backup, eg. full or schema
+	Kind string `json:"kind,omitempty"`
+	// Trigger is what started the run, eg. schedule or api
+	Trigger string `json:"trigger,omitempty"`
+	// TraceID identifies the trace of the run, if it was traced
+	TraceID   string     `json:"trace_id,omitempty"`
+	Started   time.Time  `json:"started"`
+	Finished  time.Time  `json:"finished"`
+	Databases []Database `json:"databases,omitempty"`
+	// Size is the total size in bytes of the databases being backed up
+	Size int64 `json:"size,omitempty"`
+	// Estimate is how long the run was expected to take, based on the
+	// throughput of previous runs
+	Estimate time.Duration `json:"estimate,omitempty"`
+	// Missing lists databases that were explicitly requested but not found
+	Missing []string `json:"missing,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Database is the outcome of backing up a single database
+type Database struct {
+	Name     string `json:"name"`
+	Filename string `json:"filename,omitempty"`
+	// MaskedFilename is where the masked variant of the backup was written,
+	// if it was written alongside the raw one
+	MaskedFilename string `json:"masked_filename,omitempty"`
+	// Unchanged is set for schema backups that weren't uploaded because
+	// they were the same as the newest one in storage, which Filename then
+	// names
+	Unchanged bool `json:"unchanged,omitempty"`
+	// Parts is the number of parts a split backup was stored in, under the
+	// prefix Filename names
+	Parts int `json:"parts,omitempty"`
+	// SchemaChanges are what changed in the schema since the previous
+	// backup, if schema changes are looked for
+	SchemaChanges []schema.Change `json:"schema_changes,omitempty"`
+	Size          int64           `json:"size,omitempty"`
+	Owner         string          `json:"owner,omitempty"`
+	Encoding      string          `json:"encoding,omitempty"`
+	Collation     string          `json:"collation,omitempty"`
+	// LastActivity is when a session connected to the database was last
+	// active, if any was when the backup started
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+	Status       string     `json:"status,omitempty"`
+	// Written is the number of bytes written to storage so far
+	Written int64 `json:"written,omitempty"`
+	// Uncompressed is the size of the backup before compression
+	Uncompressed int64     `json:"uncompressed,omitempty"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// New returns a Run started now
+func New() *Run {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &Run{ID: hex.EncodeToString(id), Started: time.Now()}
+}
+
+// AddDatabase records the progress or outcome of backing up a database,
+// replacing what was recorded for it before. It is safe for concurrent use.
+func (r *Run) AddDatabase(d Database) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d.Status == "" && !d.Finished.IsZero() {
+		d.Status = StatusSucceeded
+		if d.Error != "" {
+			d.Status = StatusFailed
+		}
+	}
+	for i := range r.Databases {
+		if r.Databases[i].Name == d.Name {
+			d.Written = r.Databases[i].Written
+			r.Databases[i] = d
+			return
+		}
+	}
+	r.Databases = append(r.Databases, d)
+}
+
+// AddWritten adds n to the bytes written for database
+func (r *Run) AddWritten(database string, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Databases {
+		if r.Databases[i].Name == database {
+			r.Databases[i].Written += n
+			return
+		}
+	}
+}
+
+// Update calls fn with the run locked, to set fields while it may be being
+// read
+func (r *Run) Update(fn func(r *Run)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(r)
+}
+
+// Snapshot returns a copy of the run as it is now, which is safe to read while
+// the run carries on
+func (r *Run) Snapshot() *Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Run{
+		ID:        r.ID,
+		Job:       r.Job,
+		Kind:      r.Kind,
+		Trigger:   r.Trigger,
+		TraceID:   r.TraceID,
+		Started:   r.Started,
+		Finished:  r.Finished,
+		Databases: append([]Database(nil), r.Databases...),
+		Size:      r.Size,
+		Estimate:  r.Estimate,
+		Missing:   append([]string(nil), r.Missing...),
+		Error:     r.Error,
+	}
+}
+
+// Done reports whether the run has finished
+func (r *Run) Done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.Finished.IsZero()
+}
+
+// Finish marks the run as finished, recording err if it failed
+func (r *Run) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Failed returns the number of databases that failed to back up
+func (r *Run) Failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var failed int
+	for _, d := range r.Databases {
+		if d.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,104 @@
+package report_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/report"
+)
+
+func TestRun_Concurrent(t *testing.T) {
+	r := report.New()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("db%d", i)
+		wg.Add(2)
+		// A pool worker backing up a database
+		go func(fail bool) {
+			defer wg.Done()
+			r.AddDatabase(report.Database{Name: name, Status: report.StatusRunning, Started: time.Now()})
+			for j := 0; j < 100; j++ {
+				r.AddWritten(name, 10)
+			}
+			d := report.Database{Name: name, Started: time.Now(), Finished: time.Now()}
+			if fail {
+				d.Error = "failed"
+			}
+			r.AddDatabase(d)
+		}(i%2 == 0)
+		// The api and metrics reading it as it goes
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s := r.Snapshot()
+				for _, d := range s.Databases {
+					_ = d.Written
+				}
+				r.Done()
+				r.Failed()
+			}
+		}()
+	}
+	r.Update(func(r *report.Run) { r.Size = 1024 })
+	wg.Wait()
+	r.Finish(errors.New("4 databases failed"))
+
+	assert.True(t, r.Done())
+	assert.Equal(t, 4, r.Failed())
+	s := r.Snapshot()
+	require.Len(t, s.Databases, 8)
+	for _, d := range s.Databases {
+		// The written bytes outlive the database being replaced
+		assert.Equal(t, int64(1000), d.Written, d.Name)
+		assert.NotEqual(t, report.StatusRunning, d.Status, d.Name)
+	}
+	assert.Equal(t, int64(1024), s.Size)
+	assert.Equal(t, "4 databases failed", s.Error)
+}
+
+func TestRun_AddDatabaseStatus(t *testing.T) {
+	r := report.New()
+	r.AddDatabase(report.Database{Name: "users", Finished: time.Now()})
+	r.AddDatabase(report.Database{Name: "billing", Finished: time.Now(), Error: "timed out"})
+	r.AddDatabase(report.Database{Name: "audit", Status: report.StatusPending})
+
+	s := r.Snapshot()
+	require.Len(t, s.Databases, 3)
+	assert.Equal(t, report.StatusSucceeded, s.Databases[0].Status)
+	assert.Equal(t, report.StatusFailed, s.Databases[1].Status)
+	assert.Equal(t, report.StatusPending, s.Databases[2].Status)
+	assert.False(t, r.Done())
+}
+
+func TestRun_Snapshot(t *testing.T) {
+	r := report.New()
+	r.Missing = []string{"billing"}
+	r.AddDatabase(report.Database{Name: "users", Status: report.StatusRunning})
+	s := r.Snapshot()
+
+	r.AddWritten("users", 100)
+	r.AddDatabase(report.Database{Name: "users", Finished: time.Now()})
+	r.AddDatabase(report.Database{Name: "audit", Status: report.StatusPending})
+	r.Update(func(r *report.Run) {
+		r.Size = 1024
+		r.Missing[0] = "accounts"
+	})
+	r.Finish(errors.New("cancelled"))
+
+	// Later updates don't show through the copy
+	assert.Equal(t, r.ID, s.ID)
+	require.Len(t, s.Databases, 1)
+	assert.Equal(t, report.StatusRunning, s.Databases[0].Status)
+	assert.Zero(t, s.Databases[0].Written)
+	assert.Equal(t, []string{"billing"}, s.Missing)
+	assert.Zero(t, s.Size)
+	assert.True(t, s.Finished.IsZero())
+	assert.Empty(t, s.Error)
+
+	assert.Equal(t, int64(100), r.Snapshot().Databases[0].Written)
+}
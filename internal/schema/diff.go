@@ -0,0 +1,75 @@
+package schema
+
+import "sort"
+
+// Actions of a change
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// Change is an object added, removed or changed between two schemas
+type Change struct {
+	Action string `json:"action"`
+	// Type is the type of the object, eg. TABLE, COLUMN or INDEX
+	Type string `json:"type"`
+	// Name is the schema qualified name of the object, eg. public.users or
+	// public.users.email for a column
+	Name string `json:"name"`
+	// Before and After are the definitions of the object in each schema
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Compare returns the changes from before to after, ordered by name. The
+// columns of a table in both are compared one by one.
+func Compare(before, after *Schema) []Change {
+	var changes []Change
+	for k, b := range before.objects {
+		a, ok := after.objects[k]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Action: Removed, Type: b.typ, Name: b.name, Before: b.source})
+		case b.typ == Table:
+			changes = append(changes, compareTable(b, a)...)
+		case a.statement != b.statement:
+			changes = append(changes, Change{Action: Changed, Type: b.typ, Name: b.name, Before: b.statement, After: a.statement})
+		}
+	}
+	for k, a := range after.objects {
+		if _, ok := before.objects[k]; !ok {
+			changes = append(changes, Change{Action: Added, Type: a.typ, Name: a.name, After: a.source})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		return changes[i].Type < changes[j].Type
+	})
+	return changes
+}
+
+func compareTable(before, after *object) []Change {
+	var changes []Change
+	if before.statement != after.statement {
+		changes = append(changes, Change{Action: Changed, Type: Table, Name: before.name, Before: before.source, After: after.source})
+	}
+	for k, b := range before.items {
+		a, ok := after.items[k]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Action: Removed, Type: b.typ, Name: b.name, Before: b.definition})
+		case a.definition != b.definition:
+			changes = append(changes, Change{Action: Changed, Type: b.typ, Name: b.name, Before: b.definition, After: a.definition})
+		}
+	}
+	for k, a := range after.items {
+		if _, ok := before.items[k]; !ok {
+			changes = append(changes, Change{Action: Added, Type: a.typ, Name: a.name, After: a.definition})
+		}
+	}
+	return changes
+}
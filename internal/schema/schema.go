@@ -0,0 +1,216 @@
+// Package schema reads the objects in a plain format pg_dump and compares the
+// objects of two dumps, to find the DDL run between them.
+package schema
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Object types reported on their own or treated specially. Other types are
+// named as pg_dump names them, eg. VIEW or SEQUENCE.
+const (
+	Table      = "TABLE"
+	Column     = "COLUMN"
+	Constraint = "CONSTRAINT"
+)
+
+// dataTypes are the entries of a dump holding data rather than definitions
+var dataTypes = map[string]bool{
+	"TABLE DATA":   true,
+	"SEQUENCE SET": true,
+	"BLOB":         true,
+	"BLOBS":        true,
+	"LARGE OBJECT": true,
+}
+
+// Schema is the objects defined by a dump
+type Schema struct {
+	objects map[string]*object
+}
+
+// object is an entry of a dump. Tables are split into their columns and the
+// rest of their definition, so a new column is reported as such.
+type object struct {
+	typ  string
+	name string
+	// source is the SQL defining the object, without comments
+	source string
+	// statement is source less the items of tables
+	statement string
+	// items are the columns and inline constraints of a table
+	items map[string]item
+}
+
+type item struct {
+	typ        string
+	name       string
+	definition string
+}
+
+func key(typ, name string) string {
+	return typ + " " + name
+}
+
+// Parse reads the objects defined by a plain format dump. The data in it is
+// skipped, so full dumps can be read as well as schema only ones.
+func Parse(r io.Reader) (*Schema, error) {
+	s := &Schema{objects: map[string]*object{}}
+	scanner := bufio.NewScanner(r)
+	// COPY rows can be as long as the values in them
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+
+	var current *object
+	var lines []string
+	finish := func() {
+		if current != nil {
+			current.source = strings.Join(lines, "\n")
+			current.statement = current.source
+			if current.typ == Table {
+				current.splitTable()
+			}
+			s.objects[key(current.typ, current.name)] = current
+		}
+		current, lines = nil, nil
+	}
+
+	inCopy := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if inCopy {
+			inCopy = line != `\.`
+			continue
+		}
+		if strings.HasPrefix(line, "--") {
+			if typ, name, ok := parseHeader(line); ok {
+				finish()
+				if !dataTypes[typ] {
+					current = &object{typ: typ, name: name}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "COPY ") && strings.HasSuffix(line, "FROM stdin;") {
+			inCopy = true
+			continue
+		}
+		if current == nil || ignored(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read dump")
+	}
+	finish()
+	return s, nil
+}
+
+// parseHeader parses the comment pg_dump writes before each entry, eg.
+// -- Name: users; Type: TABLE; Schema: public; Owner: app
+func parseHeader(line string) (string, string, bool) {
+	line = strings.TrimPrefix(line, "-- ")
+	line = strings.TrimPrefix(line, "Data for ")
+	if !strings.HasPrefix(line, "Name: ") {
+		return "", "", false
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(line, "; ") {
+		if k, v, ok := strings.Cut(field, ": "); ok {
+			fields[k] = v
+		}
+	}
+	typ, name := fields["Type"], fields["Name"]
+	if typ == "" {
+		return "", "", false
+	}
+	return typ, qualify(typ, fields["Schema"], name), true
+}
+
+// qualify adds the schema to the name pg_dump gives an entry. Objects of a
+// table are named after it, eg. "users users_pkey" becomes
+// public.users.users_pkey, and comments and privileges after the type of
+// object they're on, eg. "TABLE users" becomes TABLE public.users.
+func qualify(typ, schema, name string) string {
+	if schema == "" || schema == "-" {
+		return name
+	}
+	switch typ {
+	case "COMMENT", "ACL", "SECURITY LABEL":
+		if on, rest, ok := strings.Cut(name, " "); ok {
+			return on + " " + schema + "." + rest
+		}
+	case Constraint, "FK CONSTRAINT", "CHECK CONSTRAINT", "DEFAULT", "TRIGGER", "POLICY", "RULE":
+		name = strings.Replace(name, " ", ".", 1)
+	}
+	return schema + "." + name
+}
+
+// ignored reports whether a line of an entry is noise rather than part of the
+// object's definition: session settings pg_dump writes between entries and
+// the random keys of \restrict lines
+func ignored(line string) bool {
+	return line == "" ||
+		strings.HasPrefix(line, "SET ") ||
+		strings.HasPrefix(line, "SELECT pg_catalog.set_config(") ||
+		strings.HasPrefix(line, "SELECT pg_catalog.setval(") ||
+		strings.HasPrefix(line, `\restrict `) ||
+		strings.HasPrefix(line, `\unrestrict `)
+}
+
+// splitTable moves the columns and inline constraints of a CREATE TABLE out
+// of the table's statement and into its items
+func (o *object) splitTable() {
+	lines := strings.Split(o.statement, "\n")
+	var rest, items []string
+	inBody := false
+	for _, line := range lines {
+		switch {
+		case !inBody:
+			rest = append(rest, line)
+			inBody = strings.HasPrefix(line, "CREATE ") && strings.HasSuffix(line, " (")
+		case strings.HasPrefix(line, ")"):
+			rest = append(rest, line)
+			inBody = false
+		case strings.HasPrefix(line, "    ") || len(items) == 0:
+			items = append(items, strings.TrimSpace(line))
+		default:
+			// A definition carried over onto the next line
+			items[len(items)-1] += "\n" + line
+		}
+	}
+
+	o.statement = strings.Join(rest, "\n")
+	o.items = map[string]item{}
+	for _, definition := range items {
+		definition = strings.TrimSuffix(definition, ",")
+		typ, name := Column, firstIdentifier(definition)
+		if rest, ok := strings.CutPrefix(definition, "CONSTRAINT "); ok {
+			typ, name = Constraint, firstIdentifier(rest)
+		}
+		name = o.name + "." + name
+		o.items[key(typ, name)] = item{typ: typ, name: name, definition: definition}
+	}
+}
+
+// firstIdentifier returns the identifier s starts with, which may be quoted
+func firstIdentifier(s string) string {
+	if !strings.HasPrefix(s, `"`) {
+		name, _, _ := strings.Cut(s, " ")
+		return name
+	}
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			i++
+			continue
+		}
+		return s[:i+1]
+	}
+	return s
+}
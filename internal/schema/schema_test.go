@@ -0,0 +1,149 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const before = `--
+-- PostgreSQL database dump
+--
+
+\restrict 3LzmHdXTd0a8bHXvJpShDk
+
+-- Dumped from database version 16.2
+
+SET statement_timeout = 0;
+SELECT pg_catalog.set_config('search_path', '', false);
+
+--
+-- Name: tally(integer); Type: FUNCTION; Schema: public; Owner: app
+--
+
+CREATE FUNCTION public.tally(n integer) RETURNS integer
+    LANGUAGE sql
+    AS $$ SELECT n + 1 $$;
+
+
+ALTER FUNCTION public.tally(n integer) OWNER TO app;
+
+SET default_tablespace = '';
+
+--
+-- Name: users; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.users (
+    id integer NOT NULL,
+    name text,
+    "Nick Name" text,
+    CONSTRAINT name_length CHECK ((length(name) < 100))
+);
+
+
+ALTER TABLE public.users OWNER TO app;
+
+--
+-- Name: legacy; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.legacy (
+    id integer
+);
+
+--
+-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: app
+--
+
+COPY public.users (id, name, "Nick Name") FROM stdin;
+1	-- Name: not a header; Type: TABLE; Schema: public; Owner: app
+\.
+
+--
+-- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: app
+--
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+--
+-- Name: TABLE users; Type: COMMENT; Schema: public; Owner: app
+--
+
+COMMENT ON TABLE public.users IS 'People';
+
+\unrestrict 3LzmHdXTd0a8bHXvJpShDk
+`
+
+func TestParse(t *testing.T) {
+	s, err := Parse(strings.NewReader(before))
+	require.Nil(t, err)
+
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	assert.ElementsMatch(t, []string{
+		"FUNCTION public.tally(integer)",
+		"TABLE public.users",
+		"TABLE public.legacy",
+		"CONSTRAINT public.users.users_pkey",
+		"COMMENT TABLE public.users",
+	}, keys)
+
+	users := s.objects["TABLE public.users"]
+	assert.Equal(t, "CREATE TABLE public.users (\n);\nALTER TABLE public.users OWNER TO app;", users.statement)
+	assert.Equal(t, map[string]item{
+		"COLUMN public.users.id":              {Column, "public.users.id", "id integer NOT NULL"},
+		"COLUMN public.users.name":            {Column, "public.users.name", "name text"},
+		`COLUMN public.users."Nick Name"`:     {Column, `public.users."Nick Name"`, `"Nick Name" text`},
+		"CONSTRAINT public.users.name_length": {Constraint, "public.users.name_length", "CONSTRAINT name_length CHECK ((length(name) < 100))"},
+	}, users.items)
+
+	assert.Equal(t,
+		"CREATE FUNCTION public.tally(n integer) RETURNS integer\n    LANGUAGE sql\n    AS $$ SELECT n + 1 $$;\nALTER FUNCTION public.tally(n integer) OWNER TO app;",
+		s.objects["FUNCTION public.tally(integer)"].statement,
+	)
+}
+
+func TestCompare(t *testing.T) {
+	after := strings.NewReplacer(
+		"$$ SELECT n + 1 $$", "$$ SELECT n + 2 $$",
+		"    name text,\n", "    name text NOT NULL,\n    email text,\n",
+		`    "Nick Name" text,`+"\n", "",
+		"--\n-- Name: legacy; Type: TABLE; Schema: public; Owner: app\n--\n\nCREATE TABLE public.legacy (\n    id integer\n);\n", "",
+		"\\restrict 3LzmHdXTd0a8bHXvJpShDk", "\\restrict 9eGgqKuV4iGbW0Q7dfJm1u",
+	).Replace(before) + `
+--
+-- Name: users_name_idx; Type: INDEX; Schema: public; Owner: app
+--
+
+CREATE INDEX users_name_idx ON public.users USING btree (name);
+`
+	b, err := Parse(strings.NewReader(before))
+	require.Nil(t, err)
+	a, err := Parse(strings.NewReader(after))
+	require.Nil(t, err)
+
+	changes := Compare(b, a)
+	var summary []string
+	for _, c := range changes {
+		summary = append(summary, c.Action+" "+c.Type+" "+c.Name)
+	}
+	assert.Equal(t, []string{
+		"removed TABLE public.legacy",
+		"changed FUNCTION public.tally(integer)",
+		`removed COLUMN public.users."Nick Name"`,
+		"added COLUMN public.users.email",
+		"changed COLUMN public.users.name",
+		"added INDEX public.users_name_idx",
+	}, summary)
+	assert.Equal(t, "name text", changes[4].Before)
+	assert.Equal(t, "name text NOT NULL", changes[4].After)
+	assert.Equal(t, "CREATE TABLE public.legacy (\n    id integer\n);", changes[0].Before)
+
+	assert.Empty(t, Compare(b, b))
+}
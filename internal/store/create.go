@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// ErrExists is returned by Create when the file already exists
+var ErrExists = errors.New("file already exists")
+
+// Creator is implemented by Storers that can create a file only if it doesn't
+// already exist, atomically, so that only one of many concurrent callers
+// succeeds
+type Creator interface {
+	Create(ctx context.Context, filename string, data []byte) error
+}
+
+// Create creates a File, returning ErrExists if it already exists
+func (s File) Create(ctx context.Context, filename string, data []byte) error {
+	p := s.path(filename)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if os.IsExist(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Create creates an S3 object with an If-None-Match: * precondition,
+// returning ErrExists if it already exists
+func (s S3) Create(ctx context.Context, filename string, data []byte) error {
+	bucket, err := s.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	err = bucket.WriteAll(ctx, s.key(filename), data, &blob.WriterOptions{
+		BeforeWrite: func(as func(interface{}) bool) error {
+			var uploader *s3manager.Uploader
+			if !as(&uploader) {
+				return errors.New("unable to set write precondition")
+			}
+			uploader.RequestOptions = append(uploader.RequestOptions, func(r *request.Request) {
+				r.HTTPRequest.Header.Set("If-None-Match", "*")
+			})
+			return nil
+		},
+	})
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		// 409 is returned when a concurrent conditional write wins the race
+		switch reqErr.StatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return ErrExists
+		}
+	}
+	return err
+}
+
+// Create creates an object in google cloud storage with a DoesNotExist
+// precondition, returning ErrExists if it already exists
+func (g GCS) Create(ctx context.Context, filename string, data []byte) error {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	err = bucket.WriteAll(ctx, g.key(filename), data, &blob.WriterOptions{
+		BeforeWrite: func(as func(interface{}) bool) error {
+			var obj **storage.ObjectHandle
+			if !as(&obj) {
+				return errors.New("unable to set write precondition")
+			}
+			*obj = (*obj).If(storage.Conditions{DoesNotExist: true})
+			return nil
+		},
+	})
+	if gcerrors.Code(err) == gcerrors.FailedPrecondition {
+		return ErrExists
+	}
+	return err
+}
+
+// Create creates a file in the first Storer
+func (m Multi) Create(ctx context.Context, filename string, data []byte) error {
+	c, ok := m[0].(Creator)
+	if !ok {
+		return errors.New("storage does not support conditional writes")
+	}
+	return c.Create(ctx, filename, data)
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"io"
+)
+
+// Multi writes to every one of its Storers. Everything else is done with the
+// first of them.
+type Multi []Storer
+
+// Writer returns a writer that writes to every Storer
+func (m Multi) Writer(ctx context.Context, filename string) (io.WriteCloser, error) {
+	w := &multiWriteCloser{}
+	for _, s := range m {
+		sw, err := s.Writer(ctx, filename)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.writers = append(w.writers, sw)
+	}
+	return w, nil
+}
+
+// Reader reads from the first Storer
+func (m Multi) Reader(ctx context.Context, filename string) (io.ReadCloser, error) {
+	return m[0].Reader(ctx, filename)
+}
+
+// Exists reports whether a file exists in the first Storer
+func (m Multi) Exists(ctx context.Context, filename string) (bool, error) {
+	return m[0].Exists(ctx, filename)
+}
+
+// List lists files in the first Storer
+func (m Multi) List(ctx context.Context, prefix string) ([]Object, error) {
+	return m[0].List(ctx, prefix)
+}
+
+// Delete deletes a file from every Storer
+func (m Multi) Delete(ctx context.Context, filename string) error {
+	var firstErr error
+	for _, s := range m {
+		if err := s.Delete(ctx, filename); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type multiWriteCloser struct {
+	writers []io.WriteCloser
+}
+
+func (w *multiWriteCloser) Write(p []byte) (int, error) {
+	for _, sw := range w.writers {
+		n, err := sw.Write(p)
+		if err != nil {
+			return n, err
+		}
+		if n != len(p) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return len(p), nil
+}
+
+func (w *multiWriteCloser) Close() error {
+	var firstErr error
+	for _, sw := range w.writers {
+		if err := sw.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// layoutTokens are the elements of a time.Format layout, longest first so
+// that eg. 2006 is not read as 2 followed by 006, and what they can format to
+var layoutTokens = []struct {
+	token   string
+	pattern string
+}{
+	{"January", `[A-Za-z]+`},
+	{"Monday", `[A-Za-z]+`},
+	{"Z07:00:00", `(?:Z|[-+]\d\d:\d\d:\d\d)`},
+	{"-07:00:00", `[-+]\d\d:\d\d:\d\d`},
+	{"Z070000", `(?:Z|[-+]\d{6})`},
+	{"-070000", `[-+]\d{6}`},
+	{"Z07:00", `(?:Z|[-+]\d\d:\d\d)`},
+	{"-07:00", `[-+]\d\d:\d\d`},
+	{"Z0700", `(?:Z|[-+]\d{4})`},
+	{"-0700", `[-+]\d{4}`},
+	{"Z07", `(?:Z|[-+]\d\d)`},
+	{"-07", `[-+]\d\d`},
+	// _2006 is a literal _ followed by the year, not _2 followed by 006
+	{"_2006", `_\d{4}`},
+	{"2006", `\d{4}`},
+	{"Jan", `[A-Za-z]+`},
+	{"Mon", `[A-Za-z]+`},
+	{"MST", `[A-Za-z0-9+-]+`},
+	{"002", `\d{3}`},
+	{"_2", `[ \d]\d`},
+	{"01", `\d\d`},
+	{"02", `\d\d`},
+	{"03", `\d\d`},
+	{"04", `\d\d`},
+	{"05", `\d\d`},
+	{"06", `\d\d`},
+	{"15", `\d\d`},
+	{"PM", `(?:AM|PM)`},
+	{"pm", `(?:am|pm)`},
+	{"1", `\d\d?`},
+	{"2", `\d\d?`},
+	{"3", `\d\d?`},
+	{"4", `\d\d?`},
+	{"5", `\d\d?`},
+}
+
+// fractionalSeconds matches the fractional second elements of a layout
+var fractionalSeconds = regexp.MustCompile(`^[.,](0+|9+)`)
+
+// FilenamePattern returns a regexp matching the names Filename generates for
+// format. The database name is captured as "db" and the name Filename
+// generated, without any .gz suffix or files stored under it, as "backup".
+func FilenamePattern(format string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^(?P<backup>")
+
+	for i := 0; i < len(format); {
+		rest := format[i:]
+
+		// fmt.Sprintf verbs
+		if strings.HasPrefix(rest, "%%") {
+			b.WriteString("%")
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(rest, "%s") {
+			b.WriteString(`(?P<db>.+?)`)
+			i += 2
+			continue
+		}
+
+		if m := fractionalSeconds.FindString(rest); m != "" {
+			b.WriteString(`(?:[.,]\d+)?`)
+			i += len(m)
+			continue
+		}
+
+		matched := false
+		for _, t := range layoutTokens {
+			if strings.HasPrefix(rest, t.token) {
+				b.WriteString(t.pattern)
+				i += len(t.token)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			b.WriteString(regexp.QuoteMeta(format[i : i+1]))
+			i++
+		}
+	}
+
+	b.WriteString(`)(?:\.gz)?(?:/.*)?$`)
+	return regexp.Compile(b.String())
+}
+
+// FilenamePrefix returns the directory every name Filename generates for
+// format is stored under, up to the first element of the name that varies, eg.
+// backups/ for backups/%s/2006-01-02.sql. It's empty if the first directory
+// varies, or there is none.
+func FilenamePrefix(format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); {
+		rest := format[i:]
+		if strings.HasPrefix(rest, "%%") {
+			b.WriteString("%")
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(rest, "%s") || fractionalSeconds.MatchString(rest) {
+			break
+		}
+		varies := false
+		for _, t := range layoutTokens {
+			if strings.HasPrefix(rest, t.token) {
+				varies = true
+				break
+			}
+		}
+		if varies {
+			break
+		}
+		b.WriteByte(format[i])
+		i++
+	}
+	prefix := b.String()
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
+
+// Timestamped reports whether the names Filename generates for format change
+// from one second to the next, so that backups taken at different times don't
+// share a name
+func Timestamped(format string) bool {
+	t := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	return t.Format(format) != t.Add(time.Second).Format(format)
+}
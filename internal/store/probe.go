@@ -0,0 +1,39 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+// ProbePrefix starts the names of the files Probe writes
+const ProbePrefix = ".sql-backup-probe-"
+
+// Probe checks that s can be written to and deleted from, by writing a small
+// file and deleting it again
+func Probe(ctx context.Context, s Storer) error {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	name := ProbePrefix + hex.EncodeToString(id)
+
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	w, err := s.Writer(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to write probe")
+	}
+	if _, err := w.Write([]byte("probe")); err != nil {
+		abort()
+		w.Close()
+		return errors.Wrap(err, "failed to write probe")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "failed to write probe")
+	}
+	if err := s.Delete(ctx, name); err != nil {
+		return errors.Wrap(err, "failed to delete probe")
+	}
+	return nil
+}
@@ -10,14 +10,29 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
+	"gocloud.dev/blob"
 	"gocloud.dev/blob/gcsblob"
 	"gocloud.dev/blob/s3blob"
 	"gocloud.dev/gcp"
 )
 
-// Storer interface abstracts a Writer func
+// Storer interface abstracts reading and writing backup files
 type Storer interface {
+	// Writer stores what is written as filename once closed. Cancelling
+	// ctx before then abandons the write, so nothing is stored.
 	Writer(ctx context.Context, filename string) (io.WriteCloser, error)
+	Reader(ctx context.Context, filename string) (io.ReadCloser, error)
+	Exists(ctx context.Context, filename string) (bool, error)
+	// List returns every file whose name starts with prefix
+	List(ctx context.Context, prefix string) ([]Object, error)
+	Delete(ctx context.Context, filename string) error
+}
+
+// Object describes a stored file
+type Object struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
 }
 
 // Filename embellishes a output file.
@@ -25,20 +40,117 @@ func Filename(database, format string) string {
 	return fmt.Sprintf(time.Now().Format(format), database)
 }
 
+// KindFormat returns the format for backups of a kind other than full ones,
+// so they don't collide with them or each other. The kind is added before a
+// .sql extension, or else at the end: %s.sql becomes %s.schema.sql. An empty
+// format stays empty.
+func KindFormat(format, kind string) string {
+	if format == "" {
+		return ""
+	}
+	if strings.HasSuffix(format, ".sql") {
+		return strings.TrimSuffix(format, ".sql") + "." + kind + ".sql"
+	}
+	return format + "." + kind
+}
+
 // File type is used for file based operations
 type File struct {
 	Dir string
 }
 
-// Writer writes a File type.
-func (s File) Writer(ctx context.Context, filename string) (io.WriteCloser, error) {
+func (s File) path(filename string) string {
 	if s.Dir == "" {
 		s.Dir = "./"
 	}
 	if !strings.HasSuffix(s.Dir, "/") {
 		s.Dir = s.Dir + "/"
 	}
-	return os.Create(s.Dir + filename)
+	return s.Dir + filename
+}
+
+// Writer writes a File type. The file is written under a temporary name and
+// only renamed to filename once closed, so a crash or a cancelled write can't
+// leave a partial file.
+func (s File) Writer(ctx context.Context, filename string) (io.WriteCloser, error) {
+	p := s.path(filename)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), tmpPrefix+filepath.Base(p)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: f, ctx: ctx, path: p}, nil
+}
+
+// tmpPrefix starts the names of Files being written, which List skips
+const tmpPrefix = ".tmp-"
+
+type fileWriter struct {
+	*os.File
+	ctx  context.Context
+	path string
+}
+
+func (w *fileWriter) Close() error {
+	err := w.File.Close()
+	if err == nil {
+		err = w.ctx.Err()
+	}
+	if err == nil {
+		// CreateTemp creates files only the owner can read
+		err = os.Chmod(w.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.Name())
+	}
+	return err
+}
+
+// Reader reads a File type.
+func (s File) Reader(ctx context.Context, filename string) (io.ReadCloser, error) {
+	return os.Open(s.path(filename))
+}
+
+// Exists reports whether a File exists.
+func (s File) Exists(ctx context.Context, filename string) (bool, error) {
+	_, err := os.Stat(s.path(filename))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List lists Files under the directory.
+func (s File) List(ctx context.Context, prefix string) ([]Object, error) {
+	root := s.path("")
+	var objects []Object
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tmpPrefix) {
+			return nil
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(path, root))
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, Object{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// Delete deletes a File.
+func (s File) Delete(ctx context.Context, filename string) error {
+	return os.Remove(s.path(filename))
 }
 
 // S3 type is used for S3 based opertaions
@@ -47,23 +159,75 @@ type S3 struct {
 	Dir    string
 }
 
+func (s S3) bucket(ctx context.Context) (*blob.Bucket, error) {
+	sess := session.Must(session.NewSession())
+	return s3blob.OpenBucket(ctx, sess, s.Bucket, nil)
+}
+
+func (s S3) key(filename string) string {
+	if s.Dir != "" {
+		return filepath.Join(s.Dir, filename)
+	}
+	return filename
+}
+
 // Writer writes an S3 type.
 func (s S3) Writer(ctx context.Context, filename string) (io.WriteCloser, error) {
-	sess := session.Must(session.NewSession())
-	bucket, err := s3blob.OpenBucket(ctx, sess, s.Bucket, nil)
+	bucket, err := s.bucket(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if s.Dir != "" {
-		filename = filepath.Join(s.Dir, filename)
+	w, err := bucket.NewWriter(ctx, s.key(filename), nil)
+	if err != nil {
+		bucket.Close()
+		return nil, err
 	}
+	return bucketWriter{w, bucket}, nil
+}
 
-	w, err := bucket.NewWriter(ctx, filename, nil)
+// Reader reads an S3 type.
+func (s S3) Reader(ctx context.Context, filename string) (io.ReadCloser, error) {
+	bucket, err := s.bucket(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return w, nil
+	r, err := bucket.NewReader(ctx, s.key(filename), nil)
+	if err != nil {
+		bucket.Close()
+		return nil, err
+	}
+	return bucketReader{r, bucket}, nil
+}
+
+// Exists reports whether an S3 object exists.
+func (s S3) Exists(ctx context.Context, filename string) (bool, error) {
+	bucket, err := s.bucket(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer bucket.Close()
+	return bucket.Exists(ctx, s.key(filename))
+}
+
+// List lists S3 objects under the directory.
+func (s S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	bucket, err := s.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+	return list(ctx, bucket, s.Dir, prefix)
+}
+
+// Delete deletes an S3 object.
+func (s S3) Delete(ctx context.Context, filename string) error {
+	bucket, err := s.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+	return bucket.Delete(ctx, s.key(filename))
 }
 
 // GCS type is used for GCS storage on GCP
@@ -72,8 +236,7 @@ type GCS struct {
 	Dir    string
 }
 
-// Writer writes to googe cloud storage
-func (g GCS) Writer(ctx context.Context, filename string) (io.WriteCloser, error) {
+func (g GCS) bucket(ctx context.Context) (*blob.Bucket, error) {
 	creds, err := gcp.DefaultCredentials(ctx)
 	if err != nil {
 		return nil, err
@@ -83,18 +246,127 @@ func (g GCS) Writer(ctx context.Context, filename string) (io.WriteCloser, error
 		return nil, err
 	}
 
-	bucket, err := gcsblob.OpenBucket(ctx, c, g.Bucket, nil)
+	return gcsblob.OpenBucket(ctx, c, g.Bucket, nil)
+}
+
+func (g GCS) key(filename string) string {
+	if g.Dir != "" {
+		return filepath.Join(g.Dir, filename)
+	}
+	return filename
+}
+
+// Writer writes to googe cloud storage
+func (g GCS) Writer(ctx context.Context, filename string) (io.WriteCloser, error) {
+	bucket, err := g.bucket(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if g.Dir != "" {
-		filename = filepath.Join(g.Dir, filename)
+	w, err := bucket.NewWriter(ctx, g.key(filename), nil)
+	if err != nil {
+		bucket.Close()
+		return nil, err
 	}
+	return bucketWriter{w, bucket}, nil
+}
 
-	w, err := bucket.NewWriter(ctx, filename, nil)
+// Reader reads from google cloud storage
+func (g GCS) Reader(ctx context.Context, filename string) (io.ReadCloser, error) {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := bucket.NewReader(ctx, g.key(filename), nil)
 	if err != nil {
+		bucket.Close()
 		return nil, err
 	}
-	return w, nil
+	return bucketReader{r, bucket}, nil
+}
+
+// Exists reports whether an object exists in google cloud storage
+func (g GCS) Exists(ctx context.Context, filename string) (bool, error) {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer bucket.Close()
+	return bucket.Exists(ctx, g.key(filename))
+}
+
+// List lists objects under the directory in google cloud storage
+func (g GCS) List(ctx context.Context, prefix string) ([]Object, error) {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+	return list(ctx, bucket, g.Dir, prefix)
+}
+
+// Delete deletes an object from google cloud storage
+func (g GCS) Delete(ctx context.Context, filename string) error {
+	bucket, err := g.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+	return bucket.Delete(ctx, g.key(filename))
+}
+
+// bucketWriter closes the bucket it writes to along with itself
+type bucketWriter struct {
+	*blob.Writer
+	bucket *blob.Bucket
+}
+
+func (w bucketWriter) Close() error {
+	err := w.Writer.Close()
+	if bErr := w.bucket.Close(); err == nil {
+		err = bErr
+	}
+	return err
+}
+
+// bucketReader closes the bucket it reads from along with itself
+type bucketReader struct {
+	*blob.Reader
+	bucket *blob.Bucket
+}
+
+func (r bucketReader) Close() error {
+	err := r.Reader.Close()
+	if bErr := r.bucket.Close(); err == nil {
+		err = bErr
+	}
+	return err
+}
+
+// list lists the objects in bucket under dir starting with prefix, with names
+// relative to dir
+func list(ctx context.Context, bucket *blob.Bucket, dir, prefix string) ([]Object, error) {
+	if dir != "" {
+		dir = strings.TrimSuffix(dir, "/") + "/"
+	}
+
+	var objects []Object
+	iter := bucket.List(&blob.ListOptions{Prefix: dir + prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if obj.IsDir {
+			continue
+		}
+		objects = append(objects, Object{
+			Name:    strings.TrimPrefix(obj.Key, dir),
+			Size:    obj.Size,
+			ModTime: obj.ModTime,
+		})
+	}
 }
@@ -0,0 +1,219 @@
+package store_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/store"
+)
+
+func TestFilenamePattern(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		name   string
+		db     string
+	}{
+		{"%s_2006-01-02_150405.sql", "accounts_2024-03-01_120000.sql", "accounts"},
+		{"%s_2006-01-02_150405.sql", "accounts_2024-03-01_120000.sql.gz", "accounts"},
+		{"%s_2006-01-02_150405.sql", "my_db_2024-03-01_120000.sql.gz", "my_db"},
+		{"backups/2006/01/%s-150405.sql", "backups/2024/03/accounts-120000.sql", "accounts"},
+		{"%s_basebackup_2006-01-02_150405", "db.local_basebackup_2024-03-01_120000/base.tar.gz", "db.local"},
+		{"Jan-2_%s.sql", "Mar-1_accounts.sql", "accounts"},
+	} {
+		re, err := store.FilenamePattern(tc.format)
+		require.Nil(t, err)
+
+		m := re.FindStringSubmatch(tc.name)
+		require.NotNil(t, m, "%s should match %s", tc.name, tc.format)
+		assert.Equal(t, tc.db, m[re.SubexpIndex("db")])
+		assert.True(t, strings.HasPrefix(tc.name, m[re.SubexpIndex("backup")]))
+	}
+}
+
+func TestFilenamePattern_Generated(t *testing.T) {
+	format := "%s_2006-01-02T15:04:05.000Z07:00.sql"
+	re, err := store.FilenamePattern(format)
+	require.Nil(t, err)
+
+	m := re.FindStringSubmatch(store.Filename("accounts", format))
+	require.NotNil(t, m)
+	assert.Equal(t, "accounts", m[re.SubexpIndex("db")])
+}
+
+func TestFilenamePrefix(t *testing.T) {
+	for format, expected := range map[string]string{
+		"%s_2006-01-02_150405.sql":        "",
+		"backups/%s/2006-01-02.sql":       "backups/",
+		"backups/daily/2006/01/%s.sql":    "backups/daily/",
+		"backups/daily-2006/%s.sql":       "backups/",
+		"archive%%/%s.sql":                "archive%/",
+		"%s_basebackup_2006-01-02_150405": "",
+	} {
+		assert.Equal(t, expected, store.FilenamePrefix(format), format)
+	}
+}
+
+func TestTimestamped(t *testing.T) {
+	for format, expected := range map[string]bool{
+		"%s_2006-01-02_150405.sql":             true,
+		"%s_2006-01-02_150405.000000000.sql":   true,
+		"backups/%s/2006-01-02T15:04:05Z07:00": true,
+		"%s_2006-01-02.sql":                    false,
+		"backups/%s/2006/01/02/1504.sql":       false,
+		"%s.sql":                               false,
+	} {
+		assert.Equal(t, expected, store.Timestamped(format), format)
+	}
+}
+
+func TestFilenamePattern_NoMatch(t *testing.T) {
+	re, err := store.FilenamePattern("%s_2006-01-02_150405.sql")
+	require.Nil(t, err)
+
+	for _, name := range []string{
+		"accounts.sql",
+		"accounts_2024-03-01.sql",
+		"accounts_2024-03-01_120000.sql.bak",
+		"wal/000000010000000000000001.gz",
+	} {
+		assert.False(t, re.MatchString(name), name)
+	}
+}
+
+func TestKindFormat(t *testing.T) {
+	format := "%s_2006-01-02_150405.sql"
+	assert.Equal(t, "%s_2006-01-02_150405.schema.sql", store.KindFormat(format, "schema"))
+	assert.Equal(t, "backups/%s-150405.data", store.KindFormat("backups/%s-150405", "data"))
+	assert.Equal(t, "", store.KindFormat("", "schema"))
+
+	// Backups of one kind don't look like backups of another
+	full, err := store.FilenamePattern(format)
+	require.Nil(t, err)
+	schema, err := store.FilenamePattern(store.KindFormat(format, "schema"))
+	require.Nil(t, err)
+	assert.False(t, full.MatchString(store.Filename("accounts", store.KindFormat(format, "schema"))))
+	assert.False(t, schema.MatchString(store.Filename("accounts", format)))
+	assert.True(t, schema.MatchString(store.Filename("accounts", store.KindFormat(format, "schema"))+".gz"))
+}
+
+func TestFile_ListDelete(t *testing.T) {
+	ctx := context.Background()
+	s := store.File{Dir: t.TempDir()}
+
+	for _, name := range []string{"a.sql", "wal/1", "wal/2"} {
+		w, err := s.Writer(ctx, name)
+		require.Nil(t, err)
+		_, err = io.WriteString(w, name)
+		require.Nil(t, err)
+		require.Nil(t, w.Close())
+	}
+
+	objects, err := s.List(ctx, "wal/")
+	require.Nil(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "wal/1", objects[0].Name)
+	assert.Equal(t, int64(5), objects[0].Size)
+	assert.WithinDuration(t, time.Now(), objects[0].ModTime, time.Minute)
+
+	require.Nil(t, s.Delete(ctx, "wal/1"))
+	objects, err = s.List(ctx, "")
+	require.Nil(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "a.sql", objects[0].Name)
+	assert.Equal(t, "wal/2", objects[1].Name)
+}
+
+func TestFile_WriterIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	s := store.File{Dir: t.TempDir()}
+
+	w, err := s.Writer(ctx, "wal/1")
+	require.Nil(t, err)
+	_, err = io.WriteString(w, "partial")
+	require.Nil(t, err)
+
+	// Until it's closed, the file is neither listed nor there to read
+	exists, err := s.Exists(ctx, "wal/1")
+	require.Nil(t, err)
+	assert.False(t, exists)
+	objects, err := s.List(ctx, "")
+	require.Nil(t, err)
+	assert.Empty(t, objects)
+
+	require.Nil(t, w.Close())
+	r, err := s.Reader(ctx, "wal/1")
+	require.Nil(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, "partial", string(data))
+}
+
+func TestFile_WriterCancelled(t *testing.T) {
+	dir := t.TempDir()
+	s := store.File{Dir: dir}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w, err := s.Writer(ctx, "a.sql")
+	require.Nil(t, err)
+	_, err = io.WriteString(w, "partial")
+	require.Nil(t, err)
+	cancel()
+	assert.Equal(t, context.Canceled, w.Close())
+
+	// Neither the file nor its temporary one are left behind
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFile_ListMissingDir(t *testing.T) {
+	s := store.File{Dir: t.TempDir() + "/missing"}
+	objects, err := s.List(context.Background(), "")
+	assert.Nil(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestMulti(t *testing.T) {
+	ctx := context.Background()
+	first, second := store.File{Dir: t.TempDir()}, store.File{Dir: t.TempDir()}
+	m := store.Multi{first, second}
+
+	w, err := m.Writer(ctx, "a.sql")
+	require.Nil(t, err)
+	_, err = io.WriteString(w, "dump")
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+
+	for _, s := range []store.Storer{first, second} {
+		exists, err := s.Exists(ctx, "a.sql")
+		require.Nil(t, err)
+		assert.True(t, exists)
+	}
+
+	require.Nil(t, m.Delete(ctx, "a.sql"))
+	for _, s := range []store.Storer{first, second} {
+		exists, err := s.Exists(ctx, "a.sql")
+		require.Nil(t, err)
+		assert.False(t, exists)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+	s := store.File{Dir: t.TempDir()}
+	require.Nil(t, store.Probe(ctx, s))
+
+	// Nothing is left behind
+	objects, err := s.List(ctx, "")
+	require.Nil(t, err)
+	assert.Empty(t, objects)
+
+	assert.Error(t, store.Probe(ctx, store.File{Dir: "/dev/null"}))
+}
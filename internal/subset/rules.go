@@ -0,0 +1,124 @@
+// Package subset selects a referentially consistent slice of the rows of a
+// postgres database, for restoring outside production.
+package subset
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults for the tables without a rule
+const (
+	// All includes every row of the table, unless it references a table
+	// that is subset
+	All = "all"
+	// None includes only the rows other tables need
+	None = "none"
+)
+
+// Rules select the rows of a subset
+type Rules struct {
+	// Default is what tables without a rule get, All or None
+	Default string  `yaml:"default"`
+	Tables  []Table `yaml:"tables"`
+}
+
+// Table selects the rows of a table
+type Table struct {
+	// Name is the schema qualified name of the table as it is in the
+	// catalog, eg. public.users. The schema defaults to public.
+	Name string `yaml:"name"`
+	// Databases limits the rule to databases matching these globs. Empty
+	// matches every database.
+	Databases []string `yaml:"databases"`
+	// Where is an SQL condition rows must meet, eg.
+	// created_at > now() - interval '30 days'
+	Where string `yaml:"where"`
+	// Sample is the percentage of rows to pick at random, after Where. Zero
+	// picks them all.
+	Sample float64 `yaml:"sample"`
+}
+
+// Load reads and validates rules
+func Load(r io.Reader) (*Rules, error) {
+	rules := &Rules{}
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(rules); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "failed to parse subset rules")
+	}
+	if err := rules.validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadFile reads and validates the rules in the file at filename
+func LoadFile(filename string) (*Rules, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open subset rules")
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+func (r *Rules) validate() error {
+	switch r.Default {
+	case All, None:
+	case "":
+		r.Default = All
+	default:
+		return errors.Errorf("unknown subset default %q", r.Default)
+	}
+	for i, t := range r.Tables {
+		if t.Name == "" {
+			return errors.Errorf("subset rule %d has no table name", i)
+		}
+		for _, pattern := range t.Databases {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid database pattern %q for table %s", pattern, t.Name)
+			}
+		}
+		if t.Sample < 0 || t.Sample > 100 {
+			return errors.Errorf("sample for table %s must be a percentage", t.Name)
+		}
+	}
+	return nil
+}
+
+// forDatabase returns the rules that apply to the database, by the qualified
+// name of their table. Later rules for a table win.
+func (r *Rules) forDatabase(database string) map[string]Table {
+	tables := map[string]Table{}
+	for _, t := range r.Tables {
+		if matchAny(t.Databases, database) {
+			tables[qualify(t.Name)] = t
+		}
+	}
+	return tables
+}
+
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok { // nolint:errcheck
+			return true
+		}
+	}
+	return false
+}
+
+func qualify(table string) string {
+	if !strings.Contains(table, ".") {
+		return "public." + table
+	}
+	return table
+}
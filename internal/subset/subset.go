@@ -0,0 +1,583 @@
+package subset
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// tablesQuery lists the tables that hold data, and the partitioned tables
+// whose partitions do, leaving out those that belong to extensions, which
+// recreate their own
+const tablesQuery = `
+SELECT c.oid::bigint, n.nspname, c.relname, c.relkind = 'p'
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p')
+AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+AND n.nspname NOT LIKE 'pg_toast%'
+AND n.nspname NOT LIKE 'pg_temp%'
+AND NOT EXISTS (
+	SELECT 1 FROM pg_depend d
+	WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'
+)
+ORDER BY 2, 3`
+
+// columnsQuery lists the columns of tables that COPY can load, which
+// leaves out generated ones
+const columnsQuery = `
+SELECT a.attrelid::bigint, a.attname
+FROM pg_attribute a
+WHERE a.attrelid = ANY($1::oid[]) AND a.attnum > 0 AND NOT a.attisdropped AND a.attgenerated = ''
+ORDER BY a.attrelid, a.attnum`
+
+// foreignKeysQuery lists foreign keys with their columns in order, once for
+// the referenced table and once for each of its leaf partitions if it's
+// partitioned. Foreign keys on a partitioned table are listed for each of
+// its partitions by postgres itself. The copies postgres keeps for each
+// partition of a referenced table are left out, being listed already.
+const foreignKeysQuery = `
+SELECT c.oid::bigint, c.conrelid::bigint, p.relid::bigint,
+	ARRAY(
+		SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY k(num, i)
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.num
+		ORDER BY k.i
+	),
+	ARRAY(
+		SELECT a.attname FROM unnest(c.confkey) WITH ORDINALITY k(num, i)
+		JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.num
+		ORDER BY k.i
+	)
+FROM pg_constraint c
+CROSS JOIN LATERAL (
+	SELECT c.confrelid AS relid
+	UNION
+	SELECT t.relid::oid FROM pg_partition_tree(c.confrelid) t WHERE t.isleaf
+) p
+WHERE c.contype = 'f'
+AND NOT EXISTS (
+	SELECT 1 FROM pg_constraint pc
+	WHERE pc.oid = c.conparentid AND pc.conrelid = c.conrelid
+)
+ORDER BY c.conname, 3`
+
+// sequencesQuery lists the sequences that have been used
+const sequencesQuery = `
+SELECT schemaname, sequencename, last_value
+FROM pg_sequences
+WHERE last_value IS NOT NULL
+ORDER BY 1, 2`
+
+// table is a table of the database and the rows selected from it
+type table struct {
+	schema  string
+	name    string
+	columns []string
+	// references are the table's foreign keys
+	references []*foreignKey
+	rule       *Table
+	// all is set if every row is selected. Otherwise rows holds the ctids
+	// of those that are.
+	all  bool
+	rows map[string]bool
+}
+
+// foreignKey references the referenced columns of one table from the columns
+// of another
+type foreignKey struct {
+	// constraint identifies the foreign key. A foreign key referencing a
+	// partitioned table is one foreignKey per partition, sharing it.
+	constraint        int64
+	table             *table
+	columns           []string
+	referenced        *table
+	referencedColumns []string
+}
+
+type database struct {
+	// tables are in name order
+	tables []*table
+	byName map[string]*table
+	// partitioned are the names of partitioned tables, whose rows are in
+	// their partitions
+	partitioned map[string]bool
+}
+
+// Dump writes the rows of database that rules select, and the rows those
+// reference, to w as the COPY blocks of a plain format dump, followed by the
+// values of sequences. Everything is read in tx, which should be at least
+// REPEATABLE READ for the result to be consistent.
+//
+// Rows are selected in three steps. Tables with a rule get the rows it
+// selects. Tables without one, with the default All, get the rows whose
+// references to subset tables are all to selected rows, so the children of
+// selected rows follow them. Finally, every row referenced by a selected row
+// is added, until nothing more is.
+func Dump(ctx context.Context, tx *sql.Tx, rules *Rules, database string, w io.Writer) error {
+	d, err := loadDatabase(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err := d.selectRows(ctx, tx, rules.forDatabase(database), rules.Default); err != nil {
+		return err
+	}
+	return d.write(ctx, tx, w)
+}
+
+func loadDatabase(ctx context.Context, tx *sql.Tx) (*database, error) {
+	d := &database{byName: map[string]*table{}, partitioned: map[string]bool{}}
+	byOID := map[int64]*table{}
+	var oids []int64
+
+	rows, err := tx.QueryContext(ctx, tablesQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list tables")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid int64
+		var partitioned bool
+		t := &table{}
+		if err := rows.Scan(&oid, &t.schema, &t.name, &partitioned); err != nil {
+			return nil, err
+		}
+		if partitioned {
+			d.partitioned[t.qualified()] = true
+			continue
+		}
+		d.tables = append(d.tables, t)
+		d.byName[t.qualified()] = t
+		byOID[oid] = t
+		oids = append(oids, oid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, columnsQuery, pq.Array(oids))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list columns")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid int64
+		var column string
+		if err := rows.Scan(&oid, &column); err != nil {
+			return nil, err
+		}
+		byOID[oid].columns = append(byOID[oid].columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, foreignKeysQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list foreign keys")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid, referencedOID int64
+		fk := &foreignKey{}
+		if err := rows.Scan(&fk.constraint, &oid, &referencedOID, pq.Array(&fk.columns), pq.Array(&fk.referencedColumns)); err != nil {
+			return nil, err
+		}
+		// Partitioned tables themselves are skipped, their partitions
+		// being listed too
+		fk.table, fk.referenced = byOID[oid], byOID[referencedOID]
+		if fk.table == nil || fk.referenced == nil {
+			continue
+		}
+		fk.table.references = append(fk.table.references, fk)
+	}
+	return d, rows.Err()
+}
+
+func (d *database) selectRows(ctx context.Context, tx *sql.Tx, rules map[string]Table, def string) error {
+	for name := range rules {
+		// Most likely a typo, which would otherwise dump the whole table
+		if d.partitioned[name] {
+			return errors.Errorf("subset rule for partitioned table %s, give rules for its partitions instead", name)
+		}
+		if d.byName[name] == nil {
+			return errors.Errorf("subset rule for unknown table %s", name)
+		}
+	}
+
+	for _, t := range d.tables {
+		rule, ok := rules[t.qualified()]
+		if !ok {
+			continue
+		}
+		t.rule = &rule
+		if rule.Where == "" && rule.Sample == 0 {
+			t.all = true
+			continue
+		}
+		found, err := queryCtids(ctx, tx, t.selectQuery())
+		if err != nil {
+			return errors.Wrapf(err, "failed to select rows of %s", t.qualified())
+		}
+		t.add(found)
+	}
+
+	for _, t := range d.ordered() {
+		if t.rule != nil {
+			continue
+		}
+		t.rows = map[string]bool{}
+		if def == None {
+			continue
+		}
+		query, args := t.followQuery()
+		if query == "" {
+			t.all = true
+			continue
+		}
+		found, err := queryCtids(ctx, tx, query, args...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to select rows of %s", t.qualified())
+		}
+		t.add(found)
+	}
+
+	return d.addReferenced(ctx, tx)
+}
+
+// ordered returns the tables with those referenced before those referencing
+// them. Cycles of references are broken in name order.
+func (d *database) ordered() []*table {
+	done := map[*table]bool{}
+	order := make([]*table, 0, len(d.tables))
+	for len(order) < len(d.tables) {
+		progressed := false
+		for _, t := range d.tables {
+			if done[t] || !t.referencedIn(done) {
+				continue
+			}
+			done[t] = true
+			order = append(order, t)
+			progressed = true
+		}
+		if progressed {
+			continue
+		}
+		for _, t := range d.tables {
+			if !done[t] {
+				done[t] = true
+				order = append(order, t)
+				break
+			}
+		}
+	}
+	return order
+}
+
+// addReferenced adds the rows referenced by selected rows, and the rows those
+// reference in turn, to the selection
+func (d *database) addReferenced(ctx context.Context, tx *sql.Tx) error {
+	// pending holds the rows of each queued table whose references haven't
+	// been followed yet. They aren't needed for tables with all rows.
+	pending := map[*table][]string{}
+	var queue []*table
+	for _, t := range d.tables {
+		if t.all || len(t.rows) > 0 {
+			queue = append(queue, t)
+			pending[t] = t.ctids()
+		}
+	}
+
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		rows := pending[t]
+		delete(pending, t)
+
+		for _, fk := range t.references {
+			if fk.referenced.all {
+				continue
+			}
+			var args []interface{}
+			if !t.all {
+				args = append(args, pq.Array(rows))
+			}
+			found, err := queryCtids(ctx, tx, fk.referencedQuery(t.all), args...)
+			if err != nil {
+				return errors.Wrapf(err, "failed to select rows of %s referenced by %s", fk.referenced.qualified(), t.qualified())
+			}
+			added := fk.referenced.add(found)
+			if len(added) == 0 {
+				continue
+			}
+			if _, queued := pending[fk.referenced]; !queued {
+				queue = append(queue, fk.referenced)
+			}
+			pending[fk.referenced] = append(pending[fk.referenced], added...)
+		}
+	}
+	return nil
+}
+
+// queryCtids runs a query selecting ctids
+func queryCtids(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ctids []string
+	for rows.Next() {
+		var ctid string
+		if err := rows.Scan(&ctid); err != nil {
+			return nil, err
+		}
+		ctids = append(ctids, ctid)
+	}
+	return ctids, rows.Err()
+}
+
+func (d *database) write(ctx context.Context, tx *sql.Tx, w io.Writer) error {
+	for _, t := range d.tables {
+		if !t.all && len(t.rows) == 0 {
+			continue
+		}
+		if err := t.write(ctx, tx, w); err != nil {
+			return errors.Wrapf(err, "failed to dump %s", t.qualified())
+		}
+	}
+	return writeSequences(ctx, tx, w)
+}
+
+func (t *table) qualified() string {
+	return t.schema + "." + t.name
+}
+
+func (t *table) ident() string {
+	return pq.QuoteIdentifier(t.schema) + "." + pq.QuoteIdentifier(t.name)
+}
+
+// referencedIn reports whether every table t references, other than itself,
+// is in tables
+func (t *table) referencedIn(tables map[*table]bool) bool {
+	for _, fk := range t.references {
+		if fk.referenced != t && !tables[fk.referenced] {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds rows to the selection, returning those that weren't in it
+func (t *table) add(rows []string) []string {
+	if t.rows == nil {
+		t.rows = map[string]bool{}
+	}
+	var added []string
+	for _, r := range rows {
+		if !t.rows[r] {
+			t.rows[r] = true
+			added = append(added, r)
+		}
+	}
+	return added
+}
+
+func (t *table) ctids() []string {
+	ctids := make([]string, 0, len(t.rows))
+	for r := range t.rows {
+		ctids = append(ctids, r)
+	}
+	return ctids
+}
+
+// selectQuery selects the rows matching the table's rule
+func (t *table) selectQuery() string {
+	q := "SELECT ctid FROM ONLY " + t.ident()
+	if t.rule.Sample > 0 {
+		q += fmt.Sprintf(" TABLESAMPLE BERNOULLI (%g)", t.rule.Sample)
+	}
+	if t.rule.Where != "" {
+		q += " WHERE (" + t.rule.Where + ")"
+	}
+	return q
+}
+
+// followQuery selects the rows whose references to subset tables are all to
+// selected rows, or null. A reference to a partitioned table only needs to be
+// to a selected row of one of its partitions. It returns no query if the table
+// references no subset tables.
+func (t *table) followQuery() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, fks := range t.referencesByConstraint() {
+		if !t.follows(fks) {
+			continue
+		}
+		var null, exists []string
+		for _, c := range fks[0].columns {
+			null = append(null, fmt.Sprintf("t.%s IS NULL", pq.QuoteIdentifier(c)))
+		}
+		for _, fk := range fks {
+			var match []string
+			for i, c := range fk.columns {
+				match = append(match, fmt.Sprintf("r.%s = t.%s", pq.QuoteIdentifier(fk.referencedColumns[i]), pq.QuoteIdentifier(c)))
+			}
+			if !fk.referenced.all {
+				args = append(args, pq.Array(fk.referenced.ctids()))
+				match = append([]string{fmt.Sprintf("r.ctid = ANY($%d::tid[])", len(args))}, match...)
+			}
+			exists = append(exists, fmt.Sprintf(
+				"EXISTS (SELECT 1 FROM ONLY %s r WHERE %s)", fk.referenced.ident(), strings.Join(match, " AND "),
+			))
+		}
+		conds = append(conds, fmt.Sprintf("(%s OR %s)", strings.Join(null, " OR "), strings.Join(exists, " OR ")))
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("SELECT t.ctid FROM ONLY %s t WHERE %s", t.ident(), strings.Join(conds, " AND ")), args
+}
+
+// referencesByConstraint groups the table's foreign keys by constraint, in
+// the order they're first referenced
+func (t *table) referencesByConstraint() [][]*foreignKey {
+	var groups [][]*foreignKey
+	index := map[int64]int{}
+	for _, fk := range t.references {
+		i, ok := index[fk.constraint]
+		if !ok {
+			i = len(groups)
+			index[fk.constraint] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], fk)
+	}
+	return groups
+}
+
+// follows reports whether the rows selected from the table depend on those
+// selected from the tables fks reference. They don't if every row of them is
+// selected, and references to the table itself are left to addReferenced.
+func (t *table) follows(fks []*foreignKey) bool {
+	all := true
+	for _, fk := range fks {
+		if fk.referenced == t {
+			return false
+		}
+		all = all && fk.referenced.all
+	}
+	return !all
+}
+
+// referencedQuery selects the rows referenced by the rows of the referencing
+// table whose ctids are $1, or by any of its rows if all is set
+func (fk *foreignKey) referencedQuery(all bool) string {
+	var match []string
+	for i, c := range fk.columns {
+		match = append(match, fmt.Sprintf("t.%s = r.%s", pq.QuoteIdentifier(c), pq.QuoteIdentifier(fk.referencedColumns[i])))
+	}
+	if !all {
+		match = append([]string{"t.ctid = ANY($1::tid[])"}, match...)
+	}
+	return fmt.Sprintf(
+		"SELECT r.ctid FROM ONLY %s r WHERE EXISTS (SELECT 1 FROM ONLY %s t WHERE %s)",
+		fk.referenced.ident(), fk.table.ident(), strings.Join(match, " AND "),
+	)
+}
+
+// write writes the selected rows of the table as a COPY block. Values are
+// read as text, which is what COPY writes them as.
+func (t *table) write(ctx context.Context, tx *sql.Tx, w io.Writer) error {
+	if len(t.columns) == 0 {
+		return nil
+	}
+	columns := make([]string, len(t.columns))
+	values := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		columns[i] = pq.QuoteIdentifier(c)
+		values[i] = columns[i] + "::text"
+	}
+	q := fmt.Sprintf("SELECT %s FROM ONLY %s", strings.Join(values, ", "), t.ident())
+	var args []interface{}
+	if !t.all {
+		q += " WHERE ctid = ANY($1::tid[])"
+		args = append(args, pq.Array(t.ctids()))
+	}
+
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if _, err := fmt.Fprintf(w, "COPY %s (%s) FROM stdin;\n", t.ident(), strings.Join(columns, ", ")); err != nil {
+		return err
+	}
+	row := make([]sql.NullString, len(t.columns))
+	dest := make([]interface{}, len(row))
+	for i := range row {
+		dest[i] = &row[i]
+	}
+	fields := make([]string, len(row))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, v := range row {
+			fields[i] = `\N`
+			if v.Valid {
+				fields[i] = escape(v.String)
+			}
+		}
+		if _, err := io.WriteString(w, strings.Join(fields, "\t")+"\n"); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\\.\n\n")
+	return err
+}
+
+// writeSequences sets sequences to their current values, so new rows don't
+// collide with those in the subset
+func writeSequences(ctx context.Context, tx *sql.Tx, w io.Writer) error {
+	rows, err := tx.QueryContext(ctx, sequencesQuery)
+	if err != nil {
+		return errors.Wrap(err, "failed to list sequences")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var schema, name string
+		var value int64
+		if err := rows.Scan(&schema, &name, &value); err != nil {
+			return err
+		}
+		ident := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+		if _, err := fmt.Fprintf(w, "SELECT pg_catalog.setval(%s, %d, true);\n", pq.QuoteLiteral(ident), value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// escape encodes a value in COPY's text format
+func escape(s string) string {
+	return copyEscaper.Replace(s)
+}
+
+var copyEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"\b", `\b`,
+	"\f", `\f`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"\v", `\v`,
+)
@@ -0,0 +1,125 @@
+//go:build integration
+// +build integration
+
+package subset_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/sql-backup/internal/db"
+	"github.com/utilitywarehouse/sql-backup/internal/subset"
+)
+
+func integrationDSN() string {
+	if dsn := os.Getenv("DBCLI_DSN"); dsn != "" {
+		return dsn
+	}
+	return "postgres@localhost:5432/postgres?sslmode=disable"
+}
+
+const fixture = `
+DROP SCHEMA IF EXISTS subset_test CASCADE;
+CREATE SCHEMA subset_test;
+CREATE TABLE subset_test.customers (id int PRIMARY KEY, name text);
+CREATE TABLE subset_test.products (id int PRIMARY KEY, name text);
+CREATE TABLE subset_test.orders (
+	id int PRIMARY KEY,
+	customer_id int REFERENCES subset_test.customers,
+	product_id int REFERENCES subset_test.products
+);
+INSERT INTO subset_test.customers VALUES (1, 'kept'), (2, 'dropped'), (3, E'tab\there');
+INSERT INTO subset_test.products VALUES (10, 'bought by 1'), (20, 'bought by 2'), (30, 'unsold');
+INSERT INTO subset_test.orders VALUES (100, 1, 10), (200, 2, 20), (300, NULL, 30), (400, 3, 30);
+`
+
+func TestDump(t *testing.T) {
+	ctx := context.Background()
+	conn, err := db.Open(integrationDSN(), "postgres")
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, fixture)
+	require.Nil(t, err)
+	defer conn.ExecContext(ctx, "DROP SCHEMA subset_test CASCADE") // nolint:errcheck
+
+	rules, err := subset.Load(strings.NewReader(`
+default: none
+tables:
+  - name: subset_test.orders
+    where: id <> 200
+`))
+	require.Nil(t, err)
+
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	require.Nil(t, err)
+	defer tx.Rollback() // nolint:errcheck
+
+	var out bytes.Buffer
+	require.Nil(t, subset.Dump(ctx, tx, rules, "postgres", &out))
+	dump := out.String()
+
+	assert.Contains(t, dump, `COPY "subset_test"."orders" ("id", "customer_id", "product_id") FROM stdin;`)
+	assert.Contains(t, dump, "100\t1\t10\n")
+	assert.Contains(t, dump, "300\t\\N\t30\n")
+	assert.NotContains(t, dump, "200\t2\t20")
+
+	// Only the parents of the selected orders come along
+	assert.Contains(t, dump, "1\tkept\n")
+	assert.NotContains(t, dump, "dropped")
+	assert.Contains(t, dump, "3\ttab\\there\n")
+	assert.Contains(t, dump, "10\tbought by 1\n")
+	assert.Contains(t, dump, "30\tunsold\n")
+	assert.NotContains(t, dump, "bought by 2")
+}
+
+const partitionedFixture = `
+CREATE TABLE subset_test.invoices (id int, year int, PRIMARY KEY (id, year)) PARTITION BY LIST (year);
+CREATE TABLE subset_test.invoices_2023 PARTITION OF subset_test.invoices FOR VALUES IN (2023);
+CREATE TABLE subset_test.invoices_2024 PARTITION OF subset_test.invoices FOR VALUES IN (2024);
+CREATE TABLE subset_test.payments (
+	id int PRIMARY KEY,
+	invoice_id int,
+	invoice_year int,
+	FOREIGN KEY (invoice_id, invoice_year) REFERENCES subset_test.invoices
+);
+INSERT INTO subset_test.invoices VALUES (1, 2023), (2, 2024), (3, 2024);
+INSERT INTO subset_test.payments VALUES (10, 1, 2023), (20, 3, 2024);
+`
+
+func TestDump_Partitioned(t *testing.T) {
+	ctx := context.Background()
+	conn, err := db.Open(integrationDSN(), "postgres")
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, fixture+partitionedFixture)
+	require.Nil(t, err)
+	defer conn.ExecContext(ctx, "DROP SCHEMA subset_test CASCADE") // nolint:errcheck
+
+	rules, err := subset.Load(strings.NewReader(`
+default: none
+tables:
+  - name: subset_test.payments
+    where: id = 20
+`))
+	require.Nil(t, err)
+
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	require.Nil(t, err)
+	defer tx.Rollback() // nolint:errcheck
+
+	var out bytes.Buffer
+	require.Nil(t, subset.Dump(ctx, tx, rules, "postgres", &out))
+	dump := out.String()
+
+	// The referenced invoice comes along from its partition
+	assert.Contains(t, dump, "20\t3\t2024\n")
+	assert.Contains(t, dump, `COPY "subset_test"."invoices_2024" ("id", "year") FROM stdin;`+"\n3\t2024\n")
+	assert.NotContains(t, dump, "invoices_2023")
+	assert.NotContains(t, dump, "10\t1\t2023")
+}
@@ -0,0 +1,165 @@
+package subset
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDatabase has customers, their orders and the order items, which
+// reference products, and employees who report to each other
+func testDatabase() *database {
+	customers := &table{schema: "public", name: "customers", columns: []string{"id"}}
+	orders := &table{schema: "public", name: "orders", columns: []string{"id", "customer_id"}}
+	items := &table{schema: "public", name: "items", columns: []string{"order_id", "product_id"}}
+	products := &table{schema: "shop", name: "products", columns: []string{"id"}}
+	employees := &table{schema: "public", name: "employees", columns: []string{"id", "manager_id"}}
+	var constraint int64
+	reference := func(t *table, columns []string, referenced *table) {
+		constraint++
+		t.references = append(t.references, &foreignKey{constraint: constraint, table: t, columns: columns, referenced: referenced, referencedColumns: []string{"id"}})
+	}
+	reference(orders, []string{"customer_id"}, customers)
+	reference(items, []string{"order_id"}, orders)
+	reference(items, []string{"product_id"}, products)
+	reference(employees, []string{"manager_id"}, employees)
+
+	d := &database{byName: map[string]*table{}}
+	for _, t := range []*table{customers, employees, items, orders, products} {
+		d.tables = append(d.tables, t)
+		d.byName[t.qualified()] = t
+	}
+	return d
+}
+
+func names(tables []*table) []string {
+	var names []string
+	for _, t := range tables {
+		names = append(names, t.qualified())
+	}
+	return names
+}
+
+func TestOrdered(t *testing.T) {
+	d := testDatabase()
+	assert.Equal(t, []string{
+		"public.customers", "public.employees", "public.orders", "shop.products", "public.items",
+	}, names(d.ordered()))
+
+	// A cycle is broken rather than leaving tables out
+	customers := d.byName["public.customers"]
+	items := d.byName["public.items"]
+	customers.references = append(customers.references, &foreignKey{table: customers, columns: []string{"last_item"}, referenced: items, referencedColumns: []string{"id"}})
+	assert.Equal(t, []string{
+		"public.employees", "shop.products", "public.customers", "public.orders", "public.items",
+	}, names(d.ordered()))
+}
+
+func TestQueries(t *testing.T) {
+	d := testDatabase()
+	customers := d.byName["public.customers"]
+	customers.rule = &Table{Where: "created_at > now() - interval '30 days'", Sample: 1.5}
+	assert.Equal(t,
+		`SELECT ctid FROM ONLY "public"."customers" TABLESAMPLE BERNOULLI (1.5) WHERE (created_at > now() - interval '30 days')`,
+		customers.selectQuery(),
+	)
+
+	orders := d.byName["public.orders"]
+	query, args := orders.followQuery()
+	assert.Equal(t,
+		`SELECT t.ctid FROM ONLY "public"."orders" t WHERE (t."customer_id" IS NULL OR EXISTS (SELECT 1 FROM ONLY "public"."customers" r WHERE r.ctid = ANY($1::tid[]) AND r."id" = t."customer_id"))`,
+		query,
+	)
+	assert.Len(t, args, 1)
+
+	// Tables with every row selected don't need following
+	customers.all = true
+	query, _ = orders.followQuery()
+	assert.Equal(t, "", query)
+
+	// Nor do references to the table itself
+	query, _ = d.byName["public.employees"].followQuery()
+	assert.Equal(t, "", query)
+
+	fk := orders.references[0]
+	assert.Equal(t,
+		`SELECT r.ctid FROM ONLY "public"."customers" r WHERE EXISTS (SELECT 1 FROM ONLY "public"."orders" t WHERE t.ctid = ANY($1::tid[]) AND t."customer_id" = r."id")`,
+		fk.referencedQuery(false),
+	)
+	assert.Equal(t,
+		`SELECT r.ctid FROM ONLY "public"."customers" r WHERE EXISTS (SELECT 1 FROM ONLY "public"."orders" t WHERE t."customer_id" = r."id")`,
+		fk.referencedQuery(true),
+	)
+}
+
+func TestQueries_Partitioned(t *testing.T) {
+	// Payments reference a table partitioned by year
+	payments := &table{schema: "public", name: "payments", columns: []string{"id", "invoice_id"}}
+	invoices2023 := &table{schema: "public", name: "invoices_2023", columns: []string{"id"}, all: true}
+	invoices2024 := &table{schema: "public", name: "invoices_2024", columns: []string{"id"}}
+	for _, p := range []*table{invoices2023, invoices2024} {
+		payments.references = append(payments.references, &foreignKey{constraint: 1, table: payments, columns: []string{"invoice_id"}, referenced: p, referencedColumns: []string{"id"}})
+	}
+
+	// A row need only reference a selected row of one partition
+	query, args := payments.followQuery()
+	assert.Equal(t,
+		`SELECT t.ctid FROM ONLY "public"."payments" t WHERE (t."invoice_id" IS NULL OR `+
+			`EXISTS (SELECT 1 FROM ONLY "public"."invoices_2023" r WHERE r."id" = t."invoice_id") OR `+
+			`EXISTS (SELECT 1 FROM ONLY "public"."invoices_2024" r WHERE r.ctid = ANY($1::tid[]) AND r."id" = t."invoice_id"))`,
+		query,
+	)
+	assert.Len(t, args, 1)
+
+	invoices2024.all = true
+	query, _ = payments.followQuery()
+	assert.Equal(t, "", query)
+}
+
+func TestSelectRows_PartitionedRule(t *testing.T) {
+	d := testDatabase()
+	d.partitioned = map[string]bool{"public.invoices": true}
+	err := d.selectRows(context.Background(), nil, map[string]Table{"public.invoices": {}}, All)
+	assert.EqualError(t, err, "subset rule for partitioned table public.invoices, give rules for its partitions instead")
+}
+
+func TestAdd(t *testing.T) {
+	tbl := &table{}
+	assert.Equal(t, []string{"(0,1)", "(0,2)"}, tbl.add([]string{"(0,1)", "(0,2)"}))
+	assert.Equal(t, []string{"(0,3)"}, tbl.add([]string{"(0,2)", "(0,3)"}))
+	assert.Len(t, tbl.ctids(), 3)
+}
+
+func TestLoad(t *testing.T) {
+	rules, err := Load(strings.NewReader(`
+tables:
+  - name: events
+    where: created_at > now() - interval '30 days'
+  - name: shop.customers
+    sample: 1
+    databases: [shop_*]
+`))
+	require.Nil(t, err)
+	assert.Equal(t, All, rules.Default)
+	assert.Len(t, rules.forDatabase("shop_eu"), 2)
+	assert.Contains(t, rules.forDatabase("billing"), "public.events")
+	assert.NotContains(t, rules.forDatabase("billing"), "shop.customers")
+
+	for _, invalid := range []string{
+		"default: some",
+		"tables: [{where: 'true'}]",
+		"tables: [{name: t, sample: 101}]",
+		"tables: [{name: t, databases: ['[']}]",
+		"tables: [{name: t, filter: 'true'}]",
+	} {
+		_, err := Load(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `a\tb\nc\\d`, escape("a\tb\nc\\d"))
+}
@@ -0,0 +1,65 @@
+package throttle
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// NewLimiter returns a token bucket limiting throughput to bytesPerSecond,
+// with a burst of one second's worth. It returns nil, meaning unlimited, if
+// bytesPerSecond isn't positive.
+func NewLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+}
+
+type writer struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+// NewWriter returns a writer that writes to w no faster than every one of
+// limiters allows. nil limiters are ignored, and if all of them are nil w is
+// returned as is.
+func NewWriter(ctx context.Context, w io.Writer, limiters ...*rate.Limiter) io.Writer {
+	var active []*rate.Limiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return w
+	}
+	return &writer{ctx: ctx, w: w, limiters: active}
+}
+
+func (t *writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := len(p)
+		for _, l := range t.limiters {
+			if l.Burst() < chunk {
+				chunk = l.Burst()
+			}
+		}
+		for _, l := range t.limiters {
+			if err := l.WaitN(t.ctx, chunk); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := t.w.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
@@ -0,0 +1,40 @@
+package throttle_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/sql-backup/internal/throttle"
+)
+
+func TestNewWriter_Unlimited(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Equal(t, buf, throttle.NewWriter(context.Background(), buf, nil, throttle.NewLimiter(0)))
+}
+
+func TestNewWriter_Limited(t *testing.T) {
+	buf := &bytes.Buffer{}
+	global := throttle.NewLimiter(100 * 1024)
+	perDB := throttle.NewLimiter(10 * 1024)
+	w := throttle.NewWriter(context.Background(), buf, global, perDB)
+
+	start := time.Now()
+	// The first 10KiB is the burst, the next 5KiB takes half a second
+	n, err := w.Write(make([]byte, 15*1024))
+	assert.Nil(t, err)
+	assert.Equal(t, 15*1024, n)
+	assert.Equal(t, 15*1024, buf.Len())
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestNewWriter_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := throttle.NewWriter(ctx, &bytes.Buffer{}, throttle.NewLimiter(1024))
+	_, err := w.Write(make([]byte, 4096))
+	assert.Error(t, err)
+}